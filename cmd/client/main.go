@@ -1,21 +1,58 @@
 package main
 
 import (
+	"compress/flate"
+	"flag"
 	"log"
 	"net/url"
-	"os"
 
 	"github.com/0ya-sh0/GoChatTUI/internal/client"
 )
 
 func main() {
-	if len(os.Args) < 3 {
-		log.Fatal("Username and server is required: $ ./client localhost:8123 user123")
+	transport := flag.String("transport", client.TRANSPORT_AUTO, "transport: auto, ws, sse or poll")
+	encrypt := flag.Bool("encrypt", false, "encrypt the local history with a passphrase")
+	keyring := flag.Bool("keyring", false, "keep the history passphrase in the OS keyring instead of prompting")
+	split := flag.Bool("split", false, "show the contact list next to the open chat on wide terminals")
+	compress := flag.Bool("compress", true, "negotiate permessage-deflate on websockets")
+	compressLevel := flag.Int("compression-level", flate.BestSpeed, "deflate level, -2 to 9")
+	compressMin := flag.Int("compression-threshold", 256, "frames smaller than this are sent uncompressed")
+	flag.Parse()
+	if flag.NArg() < 2 {
+		log.Fatal("Username and server is required: $ ./client [-transport auto] [-encrypt] [-keyring] [-split] localhost:8123 user123")
 		return
 	}
-	host := os.Args[1]
+	host := flag.Arg(0)
 	url := url.URL{Scheme: "ws", Host: host, Path: "/ws"}
-	username := os.Args[2]
+	username := flag.Arg(1)
+
+	err := client.SetCompression(client.CompressionConfig{
+		Enabled:   *compress,
+		Level:     *compressLevel,
+		Threshold: *compressMin,
+	})
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	if *encrypt || *keyring || client.StorageEncrypted(username) {
+		var passphrase string
+		var err error
+		if *keyring {
+			passphrase, err = client.KeyringPassphrase(username)
+		} else {
+			passphrase, err = client.PromptPassphrase(!client.StorageEncrypted(username))
+		}
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+		if err := client.UnlockStorage(username, passphrase); err != nil {
+			log.Fatal(err)
+			return
+		}
+	}
 
 	if err := client.SetupTerminal(); err != nil {
 		log.Fatal(err)
@@ -23,7 +60,7 @@ func main() {
 	}
 	defer client.RestoreTerminal()
 
-	if err := client.Start(username, url); err != nil {
+	if err := client.Start(username, url, *transport, *split); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,32 @@
+// devredis runs an in-process redis stand-in for development, so several
+// server instances can share the redis backplane without a real redis:
+//
+//	go run ./cmd/devredis -addr localhost:6379
+//	go run ./cmd/server -backplane redis -addr localhost:8123
+//	go run ./cmd/server -backplane redis -addr localhost:8124
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:6379", "listen address")
+	flag.Parse()
+
+	embedded := miniredis.NewMiniRedis()
+	if err := embedded.StartAddr(*addr); err != nil {
+		log.Fatal(err)
+	}
+	defer embedded.Close()
+	log.Print("redis stand-in on ", embedded.Addr())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	<-signals
+}
@@ -1,16 +1,82 @@
 package main
 
 import (
+	"compress/flate"
+	"flag"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"runtime"
 
 	"github.com/0ya-sh0/GoChatTUI/internal/server"
 )
 
 func main() {
-	broker := server.NewBroker()
+	var (
+		addr          = flag.String("addr", "localhost:8123", "listen address")
+		backplaneName = flag.String("backplane", "memory", "backplane: memory or redis")
+		redisAddr     = flag.String("redis", "localhost:6379", "redis address for the redis backplane")
+		shards        = flag.Int("shards", runtime.NumCPU(), "number of broker event loops")
+		tcpAddr       = flag.String("tcp", "", "optional address for newline delimited JSON over TCP")
+		unixPath      = flag.String("unix", "", "optional unix socket path for newline delimited JSON")
+		compress      = flag.Bool("compress", true, "negotiate permessage-deflate on websockets")
+		compressLevel = flag.Int("compression-level", flate.BestSpeed, "deflate level, -2 to 9")
+		compressMin   = flag.Int("compression-threshold", 256, "frames smaller than this are sent uncompressed")
+	)
+	flag.Parse()
+
+	err := server.SetCompression(server.CompressionConfig{
+		Enabled:   *compress,
+		Level:     *compressLevel,
+		Threshold: *compressMin,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var backplane server.Backplane
+	switch *backplaneName {
+	case "memory":
+		backplane = server.NewLocalBackplane()
+	case "redis":
+		redisBackplane, err := server.NewRedisBackplane(*redisAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		backplane = redisBackplane
+	default:
+		log.Fatal("unknown backplane: ", *backplaneName)
+	}
+
+	broker := server.NewBrokerWithBackplane(backplane, *shards)
 	broker.Start()
+	if *tcpAddr != "" {
+		listener, err := net.Listen("tcp", *tcpAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Print("tcp on ", *tcpAddr)
+		go serveListener(broker, listener)
+	}
+	if *unixPath != "" {
+		os.Remove(*unixPath)
+		listener, err := net.Listen("unix", *unixPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer listener.Close()
+		log.Print("unix socket on ", *unixPath)
+		go serveListener(broker, listener)
+	}
 	http.HandleFunc("/ws", broker.HandleWebsocketConnection)
-	log.Print("start on localhost:8123")
-	http.ListenAndServe("localhost:8123", nil)
+	server.NewHTTPTransport(broker).Register(http.DefaultServeMux)
+	log.Print("start on ", *addr)
+	http.ListenAndServe(*addr, nil)
+}
+
+func serveListener(broker *server.Broker, listener net.Listener) {
+	if err := broker.ServeListener(listener); err != nil {
+		log.Print("err listener:", err)
+	}
 }
@@ -29,6 +29,7 @@ func main() {
 		toUser   = flag.String("to", "", "send messages to user")
 		duration = flag.Duration("duration", 60*time.Second, "how long to run")
 		interval = flag.Duration("interval", time.Second, "send interval")
+		codec    = flag.String("codec", "json", "wire codec: json or msgpack")
 	)
 	flag.Parse()
 
@@ -50,7 +51,7 @@ func main() {
 	stats := &Stats{}
 	start := time.Now()
 
-	if err := runClient(ctx, *username, *toUser, *interval, stats); err != nil {
+	if err := runClient(ctx, *username, *toUser, *interval, *codec, stats); err != nil {
 		log.Printf("[%s] exited with error: %v", *username, err)
 	}
 
@@ -71,6 +72,7 @@ func runClient(
 	ctx context.Context,
 	username, to string,
 	interval time.Duration,
+	codecName string,
 	stats *Stats,
 ) error {
 
@@ -81,10 +83,36 @@ func runClient(
 	}
 	defer conn.Close()
 
+	// handshake, no presence so the server skips presence broadcasts
+	capabilities := []string{}
+	if codecName == "msgpack" {
+		capabilities = append(capabilities, protocol.CAPABILITY_MSGPACK)
+	}
+	if err := writeFrame(conn, protocol.JSONCodec, protocol.NewFrame(&protocol.Hello{
+		ProtocolVersion: protocol.PROTOCOL_VERSION,
+		ClientName:      "testclient",
+		ClientVersion:   "1.0",
+		Capabilities:    capabilities,
+	})); err != nil {
+		return fmt.Errorf("hello: %w", err)
+	}
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return fmt.Errorf("welcome: %w", err)
+	}
+	welcome, err := protocol.Decode(data)
+	if err != nil {
+		return fmt.Errorf("welcome: %w", err)
+	}
+	if welcome.Type() != protocol.MESSAGE_TYPE_WELCOME {
+		return fmt.Errorf("handshake rejected: %s", data)
+	}
+	codec := protocol.NegotiatedCodec(welcome.Payload.(*protocol.Welcome).Capabilities)
+
 	// claim username
-	if err := conn.WriteJSON(&protocol.ClaimUsernameRequest{
+	if err := writeFrame(conn, codec, protocol.NewFrame(&protocol.ClaimUsername{
 		Username: username,
-	}); err != nil {
+	})); err != nil {
 		return fmt.Errorf("claim username: %w", err)
 	}
 
@@ -116,9 +144,12 @@ func runClient(
 		case <-ctx.Done():
 			return nil
 		case <-ticker.C:
-			err := conn.WriteJSON(&protocol.ForwardMessageRequest{
-				ToUsername: to,
-				Content:    fmt.Sprintf("m %d", i),
+			err := writeFrame(conn, codec, protocol.Frame{
+				ID: protocol.NewID(),
+				Payload: &protocol.Send{
+					ToUsername: to,
+					Content:    fmt.Sprintf("m %d", i),
+				},
 			})
 			if err != nil {
 				atomic.AddUint64(&stats.Errors, 1)
@@ -129,3 +160,14 @@ func runClient(
 		}
 	}
 }
+
+func writeFrame(conn *websocket.Conn, codec protocol.Codec, frame protocol.Frame) error {
+	data, err := codec.Encode(frame)
+	if err != nil {
+		return err
+	}
+	if codec.Binary() {
+		return conn.WriteMessage(websocket.BinaryMessage, data)
+	}
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
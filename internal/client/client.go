@@ -2,25 +2,41 @@ package client
 
 import (
 	"net/url"
+	"os"
 
 	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
+	"golang.org/x/term"
 )
 
-func Start(username string, url url.URL) error {
-	conn, err := connect(username, url)
+func Start(username string, url url.URL, transport string, split bool) error {
+	store, persistedState, err := OpenStore(username)
 	if err != nil {
 		return err
 	}
+	conn, welcome, err := connect(username, url, transport)
+	if err != nil {
+		store.Close(persistedState)
+		return err
+	}
 	defer conn.Close()
 
 	keyEvents := make(chan EventKeyPress)
-	wsEvents := make(chan protocol.Message)
-	resizeEvents := make(chan int)
-	go listenKeyEvents(keyEvents)
+	wsEvents := make(chan protocol.Frame)
+	resizeEvents := make(chan EventResize)
+	go listenKeyEvents(stdin, keyEvents)
 	go listenWSEvents(conn, wsEvents)
 	go listenResizeEvents(resizeEvents)
 
-	state := NewUIState(username, conn)
+	width, height, _ := term.GetSize(int(os.Stdin.Fd()))
+	state := NewUIState(username, conn, welcome.Capabilities, store, persistedState, os.Stdout, width, height)
+	state.split = split
+	defer store.Close(PersistedState{
+		Username: username, Chats: state.chats,
+	})
+	defer closeTransfers(state)
+	if err := publishKeys(state); err != nil {
+		return err
+	}
 	requireRender := true
 	for {
 		if requireRender {
@@ -34,18 +50,21 @@ func Start(username string, url url.URL) error {
 			}
 			requireRender = handleKeypress(state, event)
 			if state.exit {
-				return nil
+				return state.storeErr
 			}
 		case event, ok := <-wsEvents:
 			if !ok {
 				return nil
 			}
 			requireRender = handleWSMessage(state, event)
-		case newHeight, ok := <-resizeEvents:
+			if state.exit {
+				return state.storeErr
+			}
+		case event, ok := <-resizeEvents:
 			if !ok {
 				return nil
 			}
-			requireRender = handleResize(state, newHeight)
+			requireRender = handleResize(state, event)
 		}
 	}
 }
@@ -0,0 +1,185 @@
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+
+	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
+)
+
+const E2E_INFO = "GoChatTUI e2e v1"
+
+// Identity is the long term keypair of the local user, its public half is
+// published to the server key directory.
+type Identity struct {
+	signingKey  ed25519.PrivateKey
+	exchangeKey *ecdh.PrivateKey
+	Bundle      protocol.KeyBundle
+}
+
+type persistedIdentity struct {
+	SigningKey  []byte `json:"signingKey"`
+	ExchangeKey []byte `json:"exchangeKey"`
+}
+
+func identityPath(username string) string {
+	return storagePath(username) + ".identity"
+}
+
+// loadIdentity reads the identity stored next to the history, creating one
+// on first use.
+func loadIdentity(username string) (*Identity, error) {
+	filePath := identityPath(username)
+	if fileExists(filePath) {
+		content, err := readStorageFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+		var persisted persistedIdentity
+		if err := json.Unmarshal(content, &persisted); err != nil {
+			return nil, err
+		}
+		exchangeKey, err := ecdh.X25519().NewPrivateKey(persisted.ExchangeKey)
+		if err != nil {
+			return nil, err
+		}
+		return newIdentity(ed25519.NewKeyFromSeed(persisted.SigningKey), exchangeKey), nil
+	}
+
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	exchangeKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	content, err := json.Marshal(&persistedIdentity{
+		SigningKey:  signingKey.Seed(),
+		ExchangeKey: exchangeKey.Bytes(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := writeStorageFile(filePath, content); err != nil {
+		return nil, err
+	}
+	return newIdentity(signingKey, exchangeKey), nil
+}
+
+func newIdentity(signingKey ed25519.PrivateKey, exchangeKey *ecdh.PrivateKey) *Identity {
+	exchangePublic := exchangeKey.PublicKey().Bytes()
+	return &Identity{
+		signingKey:  signingKey,
+		exchangeKey: exchangeKey,
+		Bundle: protocol.KeyBundle{
+			IdentityKey: signingKey.Public().(ed25519.PublicKey),
+			ExchangeKey: exchangePublic,
+			Signature:   ed25519.Sign(signingKey, exchangePublic),
+		},
+	}
+}
+
+/*
+Every message gets a fresh ephemeral x25519 key. The message key is derived
+from two exchanges:
+
+	ephemeral  x recipient exchange key, a different key for every message
+	sender     x recipient exchange key, which authenticates the sender
+
+Only the sender and the recipient can compute the second one, and the sender
+exchange key is signed by the identity key shown on the fingerprint screen.
+Sender, recipient and message id are bound as additional data.
+
+Both exchanges use the long-term exchange key of the recipient, so there is
+no forward secrecy: whoever obtains it can read every message sent to it.
+*/
+func messageKey(ephemeralSecret, staticSecret, ephemeralPublic []byte) ([]byte, error) {
+	secret := append(append([]byte{}, ephemeralSecret...), staticSecret...)
+	return hkdf.Key(sha256.New, secret, ephemeralPublic, E2E_INFO, 32)
+}
+
+func additionalData(from, to, id string) []byte {
+	return []byte(from + "\x00" + to + "\x00" + id)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(identity *Identity, recipient protocol.KeyBundle, from, to, id, content string) (*protocol.Sealed, error) {
+	recipientKey, err := ecdh.X25519().NewPublicKey(recipient.ExchangeKey)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	ephemeralSecret, err := ephemeral.ECDH(recipientKey)
+	if err != nil {
+		return nil, err
+	}
+	staticSecret, err := identity.exchangeKey.ECDH(recipientKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := messageKey(ephemeralSecret, staticSecret, ephemeral.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	return &protocol.Sealed{
+		Sender:       identity.Bundle,
+		EphemeralKey: ephemeral.PublicKey().Bytes(),
+		Nonce:        nonce,
+		Ciphertext:   aead.Seal(nil, nonce, []byte(content), additionalData(from, to, id)),
+	}, nil
+}
+
+func unseal(identity *Identity, from, to, id string, sealed *protocol.Sealed) (string, error) {
+	ephemeralKey, err := ecdh.X25519().NewPublicKey(sealed.EphemeralKey)
+	if err != nil {
+		return "", err
+	}
+	senderKey, err := ecdh.X25519().NewPublicKey(sealed.Sender.ExchangeKey)
+	if err != nil {
+		return "", err
+	}
+	ephemeralSecret, err := identity.exchangeKey.ECDH(ephemeralKey)
+	if err != nil {
+		return "", err
+	}
+	staticSecret, err := identity.exchangeKey.ECDH(senderKey)
+	if err != nil {
+		return "", err
+	}
+	key, err := messageKey(ephemeralSecret, staticSecret, sealed.EphemeralKey)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	content, err := aead.Open(nil, sealed.Nonce, sealed.Ciphertext, additionalData(from, to, id))
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
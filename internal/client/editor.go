@@ -0,0 +1,194 @@
+package client
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
+)
+
+/*
+The compose box is currentText with a cursor, a byte offset that is always
+at a grapheme boundary. Bindings follow readline, start and end are those of
+the line the cursor is on:
+
+	← →  Ctrl+A  Ctrl+E  Home  End    move by character, to start and end
+	Alt+B  Alt+F                      move by word
+	Backspace  Delete                 delete a character
+	Ctrl+W  Alt+Backspace             kill the word before the cursor
+	Ctrl+U  Ctrl+K                    kill to the start, to the end
+	Ctrl+Y                            yank the last killed text
+	Shift+Enter  Alt+Enter  Ctrl+J    start a new line
+*/
+
+// MAX_COMPOSE_ROWS is how tall the compose box grows, longer text scrolls.
+const MAX_COMPOSE_ROWS = 6
+
+func composeRows(text string) int {
+	return min(strings.Count(text, "\n")+1, MAX_COMPOSE_ROWS)
+}
+
+// setText replaces the compose box and puts the cursor at its end.
+func setText(state *UIState, text string) {
+	state.currentText = text
+	state.cursor = len(text)
+}
+
+func insertText(state *UIState, text string) {
+	state.currentText = state.currentText[:state.cursor] + text + state.currentText[state.cursor:]
+	state.cursor += len(text)
+}
+
+// deleteRange removes currentText[from:to] and leaves the cursor at from.
+func deleteRange(state *UIState, from, to int) bool {
+	if from >= to {
+		return false
+	}
+	state.currentText = state.currentText[:from] + state.currentText[to:]
+	state.cursor = from
+	return true
+}
+
+// killRange deletes currentText[from:to] and keeps it for Ctrl+Y.
+func killRange(state *UIState, from, to int) bool {
+	if from >= to {
+		return false
+	}
+	state.killed = state.currentText[from:to]
+	return deleteRange(state, from, to)
+}
+
+func moveCursorTo(state *UIState, cursor int) bool {
+	if cursor == state.cursor {
+		return false
+	}
+	state.cursor = cursor
+	return true
+}
+
+// previousGrapheme is the boundary before cursor.
+func previousGrapheme(text string, cursor int) int {
+	graphemes := splitGraphemes(text[:cursor])
+	if len(graphemes) == 0 {
+		return 0
+	}
+	return cursor - len(graphemes[len(graphemes)-1])
+}
+
+// nextGrapheme is the boundary after cursor.
+func nextGrapheme(text string, cursor int) int {
+	graphemes := splitGraphemes(text[cursor:])
+	if len(graphemes) == 0 {
+		return cursor
+	}
+	return cursor + len(graphemes[0])
+}
+
+func isSpaceAt(text string, offset int) bool {
+	r, _ := utf8.DecodeRuneInString(text[offset:])
+	return unicode.IsSpace(r)
+}
+
+func lineStart(text string, cursor int) int {
+	return strings.LastIndexByte(text[:cursor], '\n') + 1
+}
+
+func lineEnd(text string, cursor int) int {
+	if end := strings.IndexByte(text[cursor:], '\n'); end >= 0 {
+		return cursor + end
+	}
+	return len(text)
+}
+
+// previousWord is the start of the word before cursor, words are separated
+// by white space.
+func previousWord(text string, cursor int) int {
+	for cursor > 0 {
+		previous := previousGrapheme(text, cursor)
+		if !isSpaceAt(text, previous) {
+			break
+		}
+		cursor = previous
+	}
+	for cursor > 0 {
+		previous := previousGrapheme(text, cursor)
+		if isSpaceAt(text, previous) {
+			break
+		}
+		cursor = previous
+	}
+	return cursor
+}
+
+// nextWord is the end of the word after cursor.
+func nextWord(text string, cursor int) int {
+	for cursor < len(text) && isSpaceAt(text, cursor) {
+		cursor = nextGrapheme(text, cursor)
+	}
+	for cursor < len(text) && !isSpaceAt(text, cursor) {
+		cursor = nextGrapheme(text, cursor)
+	}
+	return cursor
+}
+
+// handleEditorKey applies an editing key to the compose box, it reports
+// false for keys that are not editing keys. The chat stays scrolled to the
+// bottom while the box grows or shrinks.
+func handleEditorKey(state *UIState, event EventKeyPress) (bool, bool) {
+	rows := composeRows(state.currentText)
+	atBottom := chatAtBottom(state)
+	requireRender, handled := editText(state, event)
+	if composeRows(state.currentText) != rows {
+		keepChatScroll(state, atBottom)
+	}
+	return requireRender, handled
+}
+
+func editText(state *UIState, event EventKeyPress) (bool, bool) {
+	text, cursor := state.currentText, state.cursor
+	switch event.KeyType {
+	case KEY_TYPE_PRINTABLE:
+		insertText(state, string(event.Char))
+		return true, true
+	case KEY_TYPE_NEWLINE:
+		insertText(state, "\n")
+		return true, true
+	case KEY_TYPE_PASTE:
+		if len(text)+len(event.Text) > protocol.MAX_CONTENT_SIZE {
+			state.status = "pasted text is too long"
+			return true, true
+		}
+		insertText(state, event.Text)
+		return true, true
+	case KEY_TYPE_BACKSPACE:
+		return deleteRange(state, previousGrapheme(text, cursor), cursor), true
+	case KEY_TYPE_DELETE:
+		return deleteRange(state, cursor, nextGrapheme(text, cursor)), true
+	case KEY_TYPE_LEFT_ARROW:
+		return moveCursorTo(state, previousGrapheme(text, cursor)), true
+	case KEY_TYPE_RIGHT_ARROW:
+		return moveCursorTo(state, nextGrapheme(text, cursor)), true
+	case KEY_TYPE_HOME, KEY_TYPE_CTRL_A:
+		return moveCursorTo(state, lineStart(text, cursor)), true
+	case KEY_TYPE_END, KEY_TYPE_CTRL_E:
+		return moveCursorTo(state, lineEnd(text, cursor)), true
+	case KEY_TYPE_ALT_B:
+		return moveCursorTo(state, previousWord(text, cursor)), true
+	case KEY_TYPE_ALT_F:
+		return moveCursorTo(state, nextWord(text, cursor)), true
+	case KEY_TYPE_CTRL_W, KEY_TYPE_ALT_BACKSPACE:
+		return killRange(state, previousWord(text, cursor), cursor), true
+	case KEY_TYPE_CTRL_U:
+		return killRange(state, lineStart(text, cursor), cursor), true
+	case KEY_TYPE_CTRL_K:
+		return killRange(state, cursor, lineEnd(text, cursor)), true
+	case KEY_TYPE_CTRL_Y:
+		if state.killed == "" || len(text)+len(state.killed) > protocol.MAX_CONTENT_SIZE {
+			return false, true
+		}
+		insertText(state, state.killed)
+		return true, true
+	}
+	return false, false
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"strings"
+	"testing"
+)
+
+// editorState is a compose box holding text, with the cursor at the "|" in
+// it.
+func editorState(text string) *UIState {
+	cursor := strings.Index(text, "|")
+	return &UIState{currentText: text[:cursor] + text[cursor+1:], cursor: cursor}
+}
+
+func editorText(state *UIState) string {
+	return state.currentText[:state.cursor] + "|" + state.currentText[state.cursor:]
+}
+
+func TestEditorKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		keys []KeyType
+		want string
+	}{
+		{"left", "ab|", []KeyType{KEY_TYPE_LEFT_ARROW}, "a|b"},
+		{"left at start", "|ab", []KeyType{KEY_TYPE_LEFT_ARROW}, "|ab"},
+		{"right", "|ab", []KeyType{KEY_TYPE_RIGHT_ARROW}, "a|b"},
+		{"right at end", "ab|", []KeyType{KEY_TYPE_RIGHT_ARROW}, "ab|"},
+		{"left over a wide character", "日本|", []KeyType{KEY_TYPE_LEFT_ARROW}, "日|本"},
+		{"left over a combining mark", "xé|", []KeyType{KEY_TYPE_LEFT_ARROW}, "x|é"},
+		{"right over an emoji sequence", "|👩‍💻!", []KeyType{KEY_TYPE_RIGHT_ARROW}, "👩‍💻|!"},
+		{"home", "one\ntw|o", []KeyType{KEY_TYPE_HOME}, "one\n|two"},
+		{"ctrl a", "one\ntw|o", []KeyType{KEY_TYPE_CTRL_A}, "one\n|two"},
+		{"end", "o|ne\ntwo", []KeyType{KEY_TYPE_END}, "one|\ntwo"},
+		{"ctrl e", "one\nt|wo", []KeyType{KEY_TYPE_CTRL_E}, "one\ntwo|"},
+		{"word back", "hello big  wor|ld", []KeyType{KEY_TYPE_ALT_B}, "hello big  |world"},
+		{"word back over spaces", "hello big  |world", []KeyType{KEY_TYPE_ALT_B}, "hello |big  world"},
+		{"word forward", "he|llo big", []KeyType{KEY_TYPE_ALT_F}, "hello| big"},
+		{"word forward over spaces", "hello|  big end", []KeyType{KEY_TYPE_ALT_F}, "hello  big| end"},
+		{"backspace", "ab|c", []KeyType{KEY_TYPE_BACKSPACE}, "a|c"},
+		{"backspace a grapheme", "a👍🏽|", []KeyType{KEY_TYPE_BACKSPACE}, "a|"},
+		{"backspace at start", "|ab", []KeyType{KEY_TYPE_BACKSPACE}, "|ab"},
+		{"delete", "a|bc", []KeyType{KEY_TYPE_DELETE}, "a|c"},
+		{"delete a grapheme", "|🇩🇪x", []KeyType{KEY_TYPE_DELETE}, "|x"},
+		{"delete at end", "ab|", []KeyType{KEY_TYPE_DELETE}, "ab|"},
+		{"newline", "a|b", []KeyType{KEY_TYPE_NEWLINE}, "a\n|b"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state := editorState(test.text)
+			for _, key := range test.keys {
+				if _, handled := editText(state, Key(key)); !handled {
+					t.Fatalf("key %d not handled", key)
+				}
+			}
+			if got := editorText(state); got != test.want {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEditorKillAndYank(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		keys   []KeyType
+		want   string
+		killed string
+	}{
+		{"word", "hello wor|ld", []KeyType{KEY_TYPE_CTRL_W}, "hello |ld", "wor"},
+		{"word and spaces", "hello  |world", []KeyType{KEY_TYPE_ALT_BACKSPACE}, "|world", "hello  "},
+		{"to the start of the line", "one\ntw|o", []KeyType{KEY_TYPE_CTRL_U}, "one\n|o", "tw"},
+		{"to the end of the line", "o|ne\ntwo", []KeyType{KEY_TYPE_CTRL_K}, "o|\ntwo", "ne"},
+		{"nothing to kill", "one|\ntwo", []KeyType{KEY_TYPE_CTRL_K}, "one|\ntwo", ""},
+		{"yank at the cursor", "hello |world", []KeyType{KEY_TYPE_CTRL_W, KEY_TYPE_END, KEY_TYPE_CTRL_Y}, "worldhello |", "hello "},
+		{"yank twice", "ab|c", []KeyType{KEY_TYPE_CTRL_U, KEY_TYPE_CTRL_Y, KEY_TYPE_CTRL_Y}, "abab|c", "ab"},
+		// the last kill replaces earlier ones
+		{"last kill", "one two|", []KeyType{KEY_TYPE_CTRL_W, KEY_TYPE_CTRL_W, KEY_TYPE_CTRL_Y}, "one |", "one "},
+		{"yank without a kill", "a|b", []KeyType{KEY_TYPE_CTRL_Y}, "a|b", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state := editorState(test.text)
+			for _, key := range test.keys {
+				editText(state, Key(key))
+			}
+			if got := editorText(state); got != test.want || state.killed != test.killed {
+				t.Fatalf("got %q killed %q, want %q killed %q", got, state.killed, test.want, test.killed)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package client
+
+import (
+	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
+)
+
+// handleTab toggles message selection in the chat view. While selecting,
+// the arrows move selectedMessage instead of scrolling.
+func handleTab(state *UIState) bool {
+	if state.isMainScreen || len(visibleMessages(state)) == 0 {
+		return false
+	}
+	state.isSelecting = !state.isSelecting
+	if state.isSelecting {
+		state.selectedMessage = len(visibleMessages(state)) - 1
+		scrollToSelected(state)
+	}
+	return true
+}
+
+func handleSelectionKeypress(state *UIState, event EventKeyPress) bool {
+	switch event.KeyType {
+	case KEY_TYPE_UP_ARROW:
+		return moveSelection(state, -1)
+	case KEY_TYPE_DOWN_ARROW:
+		return moveSelection(state, 1)
+	case KEY_TYPE_TAB, KEY_TYPE_ESC, KEY_TYPE_CTRL_C:
+		state.isSelecting = false
+		return true
+	case KEY_TYPE_PRINTABLE:
+		switch event.Char {
+		case 'e':
+			return startEdit(state)
+		case 'd':
+			return deleteSelected(state)
+		case 'r':
+			return startReply(state)
+		case 't':
+			return openThread(state)
+		case '+':
+			return toggleReaction(state, QUICK_REACTION)
+		case 'p':
+			state.isPicking = true
+			return true
+		}
+	}
+	return false
+}
+
+func moveSelection(state *UIState, delta int) bool {
+	selected := state.selectedMessage + delta
+	if selected < 0 || selected >= len(visibleMessages(state)) {
+		return false
+	}
+	state.selectedMessage = selected
+	scrollToSelected(state)
+	return true
+}
+
+func scrollToSelected(state *UIState) {
+	messages := visibleMessages(state)
+	if state.selectedMessage < state.messageScroll {
+		state.messageScroll = state.selectedMessage
+	}
+	state.messageScroll = max(state.messageScroll, layoutFor(state).lastPageStart(messages[:state.selectedMessage+1], messageListHeight(state)))
+}
+
+// selectedOwnMessage returns the selected message if the local user sent it
+// and it can still be changed.
+func selectedOwnMessage(state *UIState) (ChatMessage, bool) {
+	message, ok := selectedMessage(state)
+	if !ok {
+		return message, false
+	}
+	if message.FromUsername != state.username || message.Deleted {
+		state.status = "only your own messages can be changed"
+		return message, false
+	}
+	if !protocol.HasCapability(state.capabilities, protocol.CAPABILITY_EDIT) {
+		state.status = "the server does not support editing"
+		return message, false
+	}
+	return message, true
+}
+
+func startEdit(state *UIState) bool {
+	message, ok := selectedOwnMessage(state)
+	if !ok {
+		return true
+	}
+	if message.File != nil {
+		state.status = "files can not be edited"
+		return true
+	}
+	state.isSelecting = false
+	state.replyingTo = messageRef{}
+	state.editingID = message.ID
+	setText(state, message.Content)
+	return true
+}
+
+func deleteSelected(state *UIState) bool {
+	message, ok := selectedOwnMessage(state)
+	if !ok {
+		return true
+	}
+	if _, active := state.transfers[message.ID]; active {
+		state.status = "the file is still being transferred"
+		return true
+	}
+	frame := protocol.NewFrame(&protocol.DeleteMessage{
+		ToUsername: state.chosenUser,
+		MessageID:  message.ID,
+	})
+	if !sendFrame(state, frame) {
+		return true
+	}
+	state.isSelecting = false
+	markDeleted(state, state.chosenUser, message)
+	return true
+}
+
+// sendEdit sends currentText as the new body of the message being edited,
+// sealed again when the message was encrypted.
+func sendEdit(state *UIState) bool {
+	message, has := findMessage(state, state.chosenUser, state.username, state.editingID)
+	if !has {
+		state.editingID = ""
+		return true
+	}
+	if !checkContentSize(state) {
+		return true
+	}
+	edit := &protocol.EditMessage{
+		ToUsername: state.chosenUser,
+		MessageID:  message.ID,
+		Content:    state.currentText,
+	}
+	if message.Encrypted {
+		bundle, ok := trustedPeerKey(state, state.chosenUser)
+		if !ok {
+			state.status = "no trusted key for " + state.chosenUser + ", Ctrl+F to review"
+			requestKeys(state, state.chosenUser)
+			return true
+		}
+		sealed, err := seal(state.identity, bundle, state.username, state.chosenUser, message.ID, state.currentText)
+		if err != nil {
+			state.status = "encryption failed: " + err.Error()
+			return true
+		}
+		edit.Content = ""
+		edit.Sealed = sealed
+	}
+	if !sendFrame(state, protocol.NewFrame(edit)) {
+		return true
+	}
+	message.Content = state.currentText
+	message.Edited = true
+	replaceMessage(state, state.chosenUser, message)
+	state.editingID = ""
+	setText(state, "")
+	state.status = ""
+	return true
+}
+
+func markDeleted(state *UIState, chat string, message ChatMessage) {
+	message.Content = ""
+	message.Sealed = nil
+	message.File = nil
+	message.Edited = false
+	message.Deleted = true
+	replaceMessage(state, chat, message)
+}
+
+// handleEditMessage applies an edit from the peer, only to messages the
+// peer sent.
+func handleEditMessage(state *UIState, edit *protocol.EditMessage) bool {
+	message, has := findMessage(state, edit.FromUsername, edit.FromUsername, edit.MessageID)
+	if !has || message.Deleted || message.File != nil {
+		return false
+	}
+	if edit.Sealed != nil {
+		opened := message
+		opened.Sealed = edit.Sealed
+		state.chats[edit.FromUsername] = openSealedMessage(state, state.chats[edit.FromUsername], &opened)
+		message = opened
+	} else {
+		message.Content = edit.Content
+		message.Sealed = nil
+		message.Encrypted = false
+		message.KeyChanged = false
+		message.SenderFingerprint = ""
+		message.Withheld = ""
+	}
+	message.Edited = true
+	replaceMessage(state, edit.FromUsername, message)
+	return chatShown(state, edit.FromUsername)
+}
+
+func handleDeleteMessage(state *UIState, event *protocol.DeleteMessage) bool {
+	message, has := findMessage(state, event.FromUsername, event.FromUsername, event.MessageID)
+	if !has {
+		return false
+	}
+	if t, active := state.transfers[message.ID]; active && t.peer == event.FromUsername && !t.outgoing {
+		failTransfer(state, t, event.FromUsername+" retracted the file", false)
+		message, _ = findMessage(state, event.FromUsername, event.FromUsername, event.MessageID)
+	}
+	markDeleted(state, event.FromUsername, message)
+	return chatShown(state, event.FromUsername)
+}
@@ -0,0 +1,209 @@
+package client
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+)
+
+const (
+	// Encrypted files start with STORAGE_MAGIC, then the nonce and the
+	// AES-GCM ciphertext. Files without it are legacy plaintext.
+	STORAGE_MAGIC        = "GOCHATTUI-ENC1\n"
+	STORAGE_KDF          = "pbkdf2-sha256"
+	STORAGE_KDF_ROUNDS   = 600000
+	STORAGE_CHECK_STRING = "GoChatTUI storage key"
+)
+
+var (
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+	ErrStorageLocked   = errors.New("history is encrypted, a passphrase is required")
+)
+
+// storageAEAD encrypts everything written under storagePath once
+// UnlockStorage succeeded, it stays nil for plaintext storage.
+var storageAEAD cipher.AEAD
+
+// storageKeyFile holds what is needed to derive and check the storage key,
+// never the key itself.
+type storageKeyFile struct {
+	KDF    string `json:"kdf"`
+	Rounds int    `json:"rounds"`
+	Salt   []byte `json:"salt"`
+	Check  []byte `json:"check"`
+}
+
+func storageKeyPath(username string) string {
+	return storagePath(username) + ".key"
+}
+
+// StorageEncrypted reports whether the history of username is encrypted and
+// UnlockStorage has to be called before Start.
+func StorageEncrypted(username string) bool {
+	return fileExists(storageKeyPath(username))
+}
+
+// UnlockStorage derives the storage key from passphrase. The first call for
+// a username turns encryption on and migrates the existing plaintext files.
+func UnlockStorage(username, passphrase string) error {
+	keyPath := storageKeyPath(username)
+	if fileExists(keyPath) {
+		content, err := os.ReadFile(keyPath)
+		if err != nil {
+			return err
+		}
+		var keyFile storageKeyFile
+		if err := json.Unmarshal(content, &keyFile); err != nil {
+			return err
+		}
+		aead, err := deriveStorageAEAD(passphrase, keyFile.Salt, keyFile.Rounds)
+		if err != nil {
+			return err
+		}
+		check, err := openStorage(aead, keyFile.Check)
+		if err != nil || string(check) != STORAGE_CHECK_STRING {
+			return ErrWrongPassphrase
+		}
+		// finishes a migration that was interrupted
+		return migrateStorage(username, aead)
+	}
+
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	aead, err := deriveStorageAEAD(passphrase, salt, STORAGE_KDF_ROUNDS)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(&storageKeyFile{
+		KDF:    STORAGE_KDF,
+		Rounds: STORAGE_KDF_ROUNDS,
+		Salt:   salt,
+		Check:  sealStorage(aead, []byte(STORAGE_CHECK_STRING)),
+	})
+	if err != nil {
+		return err
+	}
+	// fold the plaintext journal into the snapshot, records appended from
+	// now on are sealed
+	if err := compactStore(username); err != nil {
+		return err
+	}
+	// the salt is saved before anything is encrypted with the key, a crash
+	// in between leaves plaintext files that are still readable
+	if err := writeFileAtomic(keyPath, content); err != nil {
+		return err
+	}
+	return migrateStorage(username, aead)
+}
+
+// migrateStorage encrypts the files of username still in plaintext and
+// unlocks the storage. On error it stays locked so nothing is written with a
+// key that may not be usable.
+func migrateStorage(username string, aead cipher.AEAD) error {
+	storageAEAD = aead
+	for _, filePath := range []string{storagePath(username), identityPath(username)} {
+		if err := migrateToEncrypted(filePath); err != nil {
+			storageAEAD = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateToEncrypted rewrites a plaintext file with the storage key.
+func migrateToEncrypted(filePath string) error {
+	if !fileExists(filePath) {
+		return nil
+	}
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	if bytes.HasPrefix(content, []byte(STORAGE_MAGIC)) {
+		return nil
+	}
+	return writeStorageFile(filePath, content)
+}
+
+func deriveStorageAEAD(passphrase string, salt []byte, rounds int) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, rounds, 32)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(key)
+}
+
+func sealStorage(aead cipher.AEAD, plaintext []byte) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	return aead.Seal(nonce, nonce, plaintext, []byte(STORAGE_MAGIC))
+}
+
+func openStorage(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrWrongPassphrase
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(STORAGE_MAGIC))
+}
+
+// readStorageFile reads a file under storagePath, decrypting it if needed.
+func readStorageFile(filePath string) ([]byte, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(content, []byte(STORAGE_MAGIC)) {
+		return content, nil
+	}
+	if storageAEAD == nil {
+		return nil, ErrStorageLocked
+	}
+	return openStorage(storageAEAD, content[len(STORAGE_MAGIC):])
+}
+
+// writeStorageFile atomically writes a file under storagePath readable only
+// by the owner, encrypted when the storage is unlocked.
+func writeStorageFile(filePath string, content []byte) error {
+	if storageAEAD != nil {
+		content = append([]byte(STORAGE_MAGIC), sealStorage(storageAEAD, content)...)
+	}
+	return writeFileAtomic(filePath, content)
+}
+
+// writeFileAtomic replaces filePath with a fully written temporary file, a
+// crash leaves either the old or the new content.
+func writeFileAtomic(filePath string, content []byte) error {
+	os.MkdirAll(path.Dir(filePath), 0700)
+	tempPath := filePath + ".tmp"
+	os.Remove(tempPath)
+	file, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, filePath); err != nil {
+		return err
+	}
+	if dir, err := os.Open(path.Dir(filePath)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
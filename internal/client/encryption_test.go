@@ -0,0 +1,80 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+// lockStorage forgets the storage key, as a new process starts.
+func lockStorage() {
+	storageAEAD = nil
+}
+
+func fileContains(t *testing.T, filePath, text string) bool {
+	t.Helper()
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Contains(content, []byte(text))
+}
+
+func TestEncryptedHistoryRoundTrip(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Cleanup(lockStorage)
+	store, state := openTestStore(t)
+	state.Chats["bob"] = ChatData{Messages: []ChatMessage{storeMessage("m1", "plaintext before")}}
+	if err := store.Close(state); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadIdentity("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UnlockStorage("alice", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	for _, filePath := range []string{storagePath("alice"), identityPath("alice")} {
+		content, _ := os.ReadFile(filePath)
+		if !bytes.HasPrefix(content, []byte(STORAGE_MAGIC)) || bytes.Contains(content, []byte("plaintext before")) {
+			t.Fatalf("%s left in plaintext", filePath)
+		}
+	}
+	store, state = openTestStore(t)
+	put(t, store, storeMessage("m2", "sealed record"))
+	store.crash()
+	if fileContains(t, journalPath("alice"), "sealed record") {
+		t.Fatal("journal record in plaintext")
+	}
+	for _, filePath := range []string{storagePath("alice"), journalPath("alice"), identityPath("alice"), storageKeyPath("alice")} {
+		stat, err := os.Stat(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := stat.Mode().Perm(); mode != 0600 {
+			t.Fatalf("%s has mode %v", filePath, mode)
+		}
+	}
+
+	lockStorage()
+	if _, _, err := OpenStore("alice"); !errors.Is(err, ErrStorageLocked) {
+		t.Fatalf("opened locked history: %v", err)
+	}
+	if _, err := loadIdentity("alice"); !errors.Is(err, ErrStorageLocked) {
+		t.Fatalf("read locked identity: %v", err)
+	}
+	if err := UnlockStorage("alice", "wrong horse"); !errors.Is(err, ErrWrongPassphrase) || storageAEAD != nil {
+		t.Fatalf("wrong passphrase: %v", err)
+	}
+	if err := UnlockStorage("alice", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	store, state = openTestStore(t)
+	defer store.crash()
+	messages := state.Chats["bob"].Messages
+	if len(messages) != 2 || messages[0].Content != "plaintext before" || messages[1].Content != "sealed record" {
+		t.Fatalf("messages %#v", messages)
+	}
+}
@@ -0,0 +1,464 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
+)
+
+// FILE_WINDOW is the number of chunks a sender keeps unacknowledged.
+const FILE_WINDOW = 8
+
+const (
+	FILE_STATUS_OFFERED  = "offered"
+	FILE_STATUS_ACCEPTED = "accepted"
+	FILE_STATUS_DECLINED = "declined"
+	FILE_STATUS_DONE     = "done"
+	FILE_STATUS_FAILED   = "failed"
+)
+
+// FileInfo describes the file of a ChatMessage. Path is where the file was
+// sent from or saved to.
+type FileInfo struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+	Status   string `json:"status"`
+	Path     string `json:"path,omitempty"`
+}
+
+// transfer is a file transfer in progress, keyed by its id which is also the
+// id of its ChatMessage.
+type transfer struct {
+	id       string
+	peer     string
+	outgoing bool
+	file     *os.File
+	// tempPath is written by incoming transfers and renamed to path once
+	// the checksum matched.
+	path     string
+	tempPath string
+	size     int64
+	checksum string
+	hash     hash.Hash
+	sent     int64
+	done     int64
+}
+
+func formatSize(size int64) string {
+	switch {
+	case size >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1024*1024))
+	case size >= 1024:
+		return fmt.Sprintf("%.1f KB", float64(size)/1024)
+	default:
+		return fmt.Sprintf("%d B", size)
+	}
+}
+
+func expandHome(filePath string) string {
+	if filePath == "~" || strings.HasPrefix(filePath, "~/") {
+		homeDir, _ := os.UserHomeDir()
+		return filepath.Join(homeDir, filePath[1:])
+	}
+	return filePath
+}
+
+// handleCommand runs a chat view command, reporting whether text was one.
+//
+//	/send <path>     offer a file to the chosen user
+//	/accept [path]   save the last offered file, to ~/Downloads by default
+//	/decline         decline the last offered file
+func handleCommand(state *UIState, text string) bool {
+	command, argument, _ := strings.Cut(text, " ")
+	argument = strings.TrimSpace(argument)
+	switch command {
+	case "/send":
+		if argument == "" {
+			state.status = "usage: /send <path>"
+		} else {
+			sendFile(state, expandHome(argument))
+		}
+	case "/accept":
+		acceptFile(state, expandHome(argument))
+	case "/decline":
+		declineFile(state)
+	default:
+		return false
+	}
+	setText(state, "")
+	return true
+}
+
+func sendFile(state *UIState, filePath string) {
+	// chunks go through the server as they are, unlike sealed messages
+	if state.chats[state.chosenUser].Encrypted {
+		state.status = "files are not end-to-end encrypted, turn encryption off with Ctrl+T to send one"
+		return
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		state.status = err.Error()
+		return
+	}
+	stat, err := file.Stat()
+	if err != nil || !stat.Mode().IsRegular() {
+		file.Close()
+		state.status = "not a regular file: " + filePath
+		return
+	}
+	if stat.Size() > protocol.MAX_FILE_SIZE {
+		file.Close()
+		state.status = "file is larger than " + formatSize(protocol.MAX_FILE_SIZE)
+		return
+	}
+	digest := sha256.New()
+	if _, err := io.Copy(digest, file); err != nil {
+		file.Close()
+		state.status = err.Error()
+		return
+	}
+	t := &transfer{
+		id:       protocol.NewID(),
+		peer:     state.chosenUser,
+		outgoing: true,
+		file:     file,
+		path:     filePath,
+		size:     stat.Size(),
+		checksum: hex.EncodeToString(digest.Sum(nil)),
+	}
+	offer := &protocol.FileOffer{
+		FileTransfer: protocol.FileTransfer{ToUsername: t.peer, TransferID: t.id},
+		Name:         filepath.Base(filePath),
+		Size:         t.size,
+		Checksum:     t.checksum,
+	}
+	if err := writeFrame(state.conn, protocol.NewFrame(offer)); err != nil {
+		file.Close()
+		state.status = err.Error()
+		return
+	}
+	state.transfers[t.id] = t
+	message := newFileMessage(state.username, t.peer, t.id, FileInfo{
+		Name:     offer.Name,
+		Size:     offer.Size,
+		Checksum: offer.Checksum,
+		Status:   FILE_STATUS_OFFERED,
+		Path:     filePath,
+	})
+	addMessage(state, t.peer, message)
+	state.status = "waiting for " + t.peer + " to accept " + offer.Name
+}
+
+func newFileMessage(from, to, id string, info FileInfo) ChatMessage {
+	message := ChatMessage{
+		ID:   id,
+		File: &info,
+	}
+	message.FromUsername = from
+	message.ToUsername = to
+	message.Timestamp = time.Now()
+	return message
+}
+
+// pendingOffer returns the last file offered by the chosen user that was
+// not answered yet.
+func pendingOffer(state *UIState) *transfer {
+	messages := state.chats[state.chosenUser].Messages
+	for i := len(messages) - 1; i >= 0; i-- {
+		message := messages[i]
+		if message.File == nil || message.FromUsername != state.chosenUser {
+			continue
+		}
+		if t, has := state.transfers[message.ID]; has && message.File.Status == FILE_STATUS_OFFERED {
+			return t
+		}
+	}
+	return nil
+}
+
+func acceptFile(state *UIState, savePath string) {
+	t := pendingOffer(state)
+	if t == nil {
+		state.status = "no file offered by " + state.chosenUser
+		return
+	}
+	message, _ := fileMessage(state, t)
+	if savePath == "" {
+		savePath = expandHome("~/Downloads")
+	}
+	if stat, err := os.Stat(savePath); err == nil && stat.IsDir() {
+		savePath = filepath.Join(savePath, message.File.Name)
+	}
+	if fileExists(savePath) {
+		state.status = savePath + " already exists"
+		return
+	}
+	os.MkdirAll(filepath.Dir(savePath), 0700)
+	tempPath := savePath + ".part"
+	file, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		state.status = err.Error()
+		return
+	}
+	t.file = file
+	t.path = savePath
+	t.tempPath = tempPath
+	t.hash = sha256.New()
+	answer := &protocol.FileAnswer{
+		FileTransfer: protocol.FileTransfer{ToUsername: t.peer, TransferID: t.id},
+		Accept:       true,
+	}
+	if err := writeFrame(state.conn, protocol.NewFrame(answer)); err != nil {
+		failTransfer(state, t, err.Error(), false)
+		return
+	}
+	updateFileMessage(state, t, FILE_STATUS_ACCEPTED, savePath)
+	state.status = "receiving " + message.File.Name
+	if t.size == 0 {
+		finishIncoming(state, t)
+	}
+}
+
+func declineFile(state *UIState) {
+	t := pendingOffer(state)
+	if t == nil {
+		state.status = "no file offered by " + state.chosenUser
+		return
+	}
+	sendDecline(state, t)
+	delete(state.transfers, t.id)
+	updateFileMessage(state, t, FILE_STATUS_DECLINED, "")
+	state.status = ""
+}
+
+func sendDecline(state *UIState, t *transfer) {
+	writeFrame(state.conn, protocol.NewFrame(&protocol.FileAnswer{
+		FileTransfer: protocol.FileTransfer{ToUsername: t.peer, TransferID: t.id},
+	}))
+}
+
+// failTransfer ends t, telling the peer unless it gave up first.
+func failTransfer(state *UIState, t *transfer, reason string, notifyPeer bool) {
+	if notifyPeer {
+		sendDecline(state, t)
+	}
+	if t.file != nil {
+		t.file.Close()
+	}
+	if t.tempPath != "" {
+		os.Remove(t.tempPath)
+	}
+	delete(state.transfers, t.id)
+	updateFileMessage(state, t, FILE_STATUS_FAILED, "")
+	state.status = reason
+}
+
+// closeTransfers drops unfinished transfers when the client exits.
+func closeTransfers(state *UIState) {
+	for _, t := range state.transfers {
+		if t.file != nil {
+			sendDecline(state, t)
+			t.file.Close()
+		}
+		if t.tempPath != "" {
+			os.Remove(t.tempPath)
+		}
+	}
+}
+
+// fileMessage is the message that shows transfer t in the chat.
+func fileMessage(state *UIState, t *transfer) (ChatMessage, bool) {
+	from := t.peer
+	if t.outgoing {
+		from = state.username
+	}
+	return findMessage(state, t.peer, from, t.id)
+}
+
+func updateFileMessage(state *UIState, t *transfer, status, filePath string) {
+	message, has := fileMessage(state, t)
+	if !has {
+		return
+	}
+	info := *message.File
+	info.Status = status
+	if filePath != "" {
+		info.Path = filePath
+	}
+	message.File = &info
+	replaceMessage(state, t.peer, message)
+}
+
+func handleFileOffer(state *UIState, id string, offer *protocol.FileOffer) bool {
+	if _, has := state.transfers[offer.TransferID]; has {
+		return false
+	}
+	if _, has := findMessage(state, offer.FromUsername, offer.FromUsername, offer.TransferID); has {
+		return false
+	}
+	state.transfers[offer.TransferID] = &transfer{
+		id:       offer.TransferID,
+		peer:     offer.FromUsername,
+		size:     offer.Size,
+		checksum: offer.Checksum,
+	}
+	message := newFileMessage(offer.FromUsername, offer.ToUsername, offer.TransferID, FileInfo{
+		Name:     offer.Name,
+		Size:     offer.Size,
+		Checksum: offer.Checksum,
+		Status:   FILE_STATUS_OFFERED,
+	})
+	if chatShown(state, offer.FromUsername) {
+		state.status = offer.FromUsername + " offers " + offer.Name + ", /accept [path] or /decline"
+	}
+	return receiveMessage(state, offer.FromUsername, message)
+}
+
+func handleFileAnswer(state *UIState, answer *protocol.FileAnswer) bool {
+	t, has := state.transfers[answer.TransferID]
+	if !has || t.peer != answer.FromUsername {
+		return false
+	}
+	if !t.outgoing {
+		failTransfer(state, t, t.peer+" cancelled the transfer", false)
+		return true
+	}
+	if !answer.Accept {
+		t.file.Close()
+		delete(state.transfers, t.id)
+		message, _ := fileMessage(state, t)
+		if message.File != nil && message.File.Status == FILE_STATUS_OFFERED {
+			updateFileMessage(state, t, FILE_STATUS_DECLINED, "")
+			state.status = t.peer + " declined the file"
+		} else {
+			updateFileMessage(state, t, FILE_STATUS_FAILED, "")
+			state.status = "transfer to " + t.peer + " failed"
+		}
+		return true
+	}
+	if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+		failTransfer(state, t, err.Error(), true)
+		return true
+	}
+	updateFileMessage(state, t, FILE_STATUS_ACCEPTED, "")
+	if t.size == 0 {
+		return true
+	}
+	sendChunks(state, t)
+	return true
+}
+
+// sendChunks fills the window of unacknowledged chunks.
+func sendChunks(state *UIState, t *transfer) {
+	buffer := make([]byte, protocol.FILE_CHUNK_SIZE)
+	for t.sent < t.size && t.sent-t.done < FILE_WINDOW*protocol.FILE_CHUNK_SIZE {
+		n, err := io.ReadFull(t.file, buffer[:min(int64(len(buffer)), t.size-t.sent)])
+		if err != nil {
+			failTransfer(state, t, "reading "+t.path+": "+err.Error(), true)
+			return
+		}
+		chunk := &protocol.FileChunk{
+			FileTransfer: protocol.FileTransfer{ToUsername: t.peer, TransferID: t.id},
+			Offset:       t.sent,
+			Data:         buffer[:n],
+		}
+		if err := writeFrame(state.conn, protocol.NewFrame(chunk)); err != nil {
+			failTransfer(state, t, err.Error(), false)
+			return
+		}
+		t.sent += int64(n)
+	}
+}
+
+func handleFileAck(state *UIState, ack *protocol.FileAck) bool {
+	t, has := state.transfers[ack.TransferID]
+	if !has || !t.outgoing || t.peer != ack.FromUsername || ack.Received > t.sent {
+		return false
+	}
+	t.done = ack.Received
+	if t.done == t.size {
+		t.file.Close()
+		delete(state.transfers, t.id)
+		updateFileMessage(state, t, FILE_STATUS_DONE, "")
+		if chatShown(state, t.peer) {
+			state.status = "sent " + filepath.Base(t.path)
+		}
+	} else {
+		sendChunks(state, t)
+	}
+	return chatShown(state, t.peer)
+}
+
+func handleFileChunk(state *UIState, chunk *protocol.FileChunk) bool {
+	t, has := state.transfers[chunk.TransferID]
+	if !has || t.outgoing || t.file == nil || t.peer != chunk.FromUsername {
+		return false
+	}
+	if chunk.Offset != t.done || t.done+int64(len(chunk.Data)) > t.size {
+		failTransfer(state, t, "unexpected chunk from "+t.peer, true)
+		return true
+	}
+	if _, err := t.file.Write(chunk.Data); err != nil {
+		failTransfer(state, t, err.Error(), true)
+		return true
+	}
+	t.hash.Write(chunk.Data)
+	t.done += int64(len(chunk.Data))
+	if t.done == t.size {
+		finishIncoming(state, t)
+		return true
+	}
+	ack := &protocol.FileAck{
+		FileTransfer: protocol.FileTransfer{ToUsername: t.peer, TransferID: t.id},
+		Received:     t.done,
+	}
+	if err := writeFrame(state.conn, protocol.NewFrame(ack)); err != nil {
+		failTransfer(state, t, err.Error(), false)
+		return true
+	}
+	return chatShown(state, t.peer)
+}
+
+// finishIncoming verifies the checksum before moving the file into place,
+// only then the last chunk is acknowledged.
+func finishIncoming(state *UIState, t *transfer) {
+	if hex.EncodeToString(t.hash.Sum(nil)) != t.checksum {
+		failTransfer(state, t, "checksum mismatch, file discarded", true)
+		return
+	}
+	if err := t.file.Close(); err != nil {
+		failTransfer(state, t, err.Error(), true)
+		return
+	}
+	t.file = nil
+	if err := os.Rename(t.tempPath, t.path); err != nil {
+		failTransfer(state, t, err.Error(), true)
+		return
+	}
+	t.tempPath = ""
+	writeFrame(state.conn, protocol.NewFrame(&protocol.FileAck{
+		FileTransfer: protocol.FileTransfer{ToUsername: t.peer, TransferID: t.id},
+		Received:     t.done,
+	}))
+	delete(state.transfers, t.id)
+	updateFileMessage(state, t, FILE_STATUS_DONE, "")
+	state.status = "saved " + t.path
+}
+
+// fileProgress is the transferred share of an active transfer in percent.
+func fileProgress(transfers map[string]*transfer, id string) (int, bool) {
+	t, has := transfers[id]
+	if !has || t.size == 0 {
+		return 0, has
+	}
+	return int(t.done * 100 / t.size), true
+}
@@ -0,0 +1,314 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
+	"github.com/0ya-sh0/GoChatTUI/internal/server"
+)
+
+// File transfers run between two clients connected to a broker over local
+// TCP sockets, frames are handled on the test goroutine as the event loop of
+// each client would.
+
+const TRANSFER_TIMEOUT = 5 * time.Second
+
+type transferPeer struct {
+	t      *testing.T
+	state  *UIState
+	conn   server.Conn
+	frames chan protocol.Frame
+}
+
+func startTransferBroker(t *testing.T) *server.Broker {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	t.Setenv("HOME", t.TempDir())
+	b := server.NewBrokerWithBackplane(server.NewLocalBackplane(), 2)
+	b.Start()
+	t.Cleanup(b.Stop)
+	return b
+}
+
+// serveLoopback serves newline delimited JSON for b on a loopback port and
+// returns its address.
+func serveLoopback(t *testing.T, b *server.Broker) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go b.ServeListener(listener)
+	return listener.Addr().String()
+}
+
+// joinBroker connects username as connect would and opens the chat with
+// peer.
+func joinBroker(t *testing.T, addr, username, peer string) *transferPeer {
+	t.Helper()
+	socket, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the server side framing is the same on both ends
+	conn := server.NewStreamConn(socket)
+	t.Cleanup(func() { conn.Close() })
+	welcome, err := handshake(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFrame(conn, protocol.NewFrame(&protocol.ClaimUsername{Username: username})); err != nil {
+		t.Fatal(err)
+	}
+	p := &transferPeer{t: t, conn: conn, frames: make(chan protocol.Frame, 1024)}
+	p.state = NewUIState(username, conn, welcome.Capabilities, nil, PersistedState{}, io.Discard, 80, 24)
+	openChat(p.state, peer)
+	go func() {
+		defer close(p.frames)
+		for {
+			frame, err := readFrame(conn)
+			if err != nil {
+				return
+			}
+			p.frames <- frame
+		}
+	}()
+	return p
+}
+
+// transferPeers connects alice and bob and waits until both are online.
+func transferPeers(t *testing.T) (*transferPeer, *transferPeer) {
+	addr := serveLoopback(t, startTransferBroker(t))
+	alice := joinBroker(t, addr, "alice", "bob")
+	bob := joinBroker(t, addr, "bob", "alice")
+	online := func(p *transferPeer, username string) func() bool {
+		return func() bool { return p.state.activeUsers[username] }
+	}
+	deliver(t, online(alice, "bob"), alice, bob)
+	deliver(t, online(bob, "alice"), alice, bob)
+	return alice, bob
+}
+
+// deliver handles the frames received by peers until done holds.
+func deliver(t *testing.T, done func() bool, peers ...*transferPeer) {
+	t.Helper()
+	timeout := time.After(TRANSFER_TIMEOUT)
+	for !done() {
+		handled := false
+		for _, p := range peers {
+			select {
+			case frame, ok := <-p.frames:
+				if !ok {
+					t.Fatalf("%s: connection closed", p.state.username)
+				}
+				handleWSMessage(p.state, frame)
+				handled = true
+			default:
+			}
+		}
+		if handled {
+			continue
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("not done after %v", TRANSFER_TIMEOUT)
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func (p *transferPeer) command(text string) {
+	p.t.Helper()
+	if !handleCommand(p.state, text) {
+		p.t.Fatalf("%s is not a command", text)
+	}
+}
+
+// lastFile is the last file in the chat with the peer.
+func (p *transferPeer) lastFile() FileInfo {
+	messages := p.state.chats[p.state.chosenUser].Messages
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].File != nil {
+			return *messages[i].File
+		}
+	}
+	return FileInfo{}
+}
+
+func (p *transferPeer) fileStatus() string {
+	return p.lastFile().Status
+}
+
+func (p *transferPeer) hasStatus(status string) func() bool {
+	return func() bool { return p.fileStatus() == status }
+}
+
+func writeRandomFile(t *testing.T, filePath string, size int) []byte {
+	t.Helper()
+	content := make([]byte, size)
+	rand.Read(content)
+	if err := os.WriteFile(filePath, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestFileTransfer(t *testing.T) {
+	alice, bob := transferPeers(t)
+	dir := t.TempDir()
+	// more chunks than fit in the window, the last one partial
+	size := (FILE_WINDOW+3)*protocol.FILE_CHUNK_SIZE + 100
+	content := writeRandomFile(t, filepath.Join(dir, "notes.bin"), size)
+
+	alice.command("/send " + filepath.Join(dir, "notes.bin"))
+	deliver(t, bob.hasStatus(FILE_STATUS_OFFERED), alice, bob)
+	saved := filepath.Join(dir, "saved.bin")
+	bob.command("/accept " + saved)
+	deliver(t, func() bool {
+		return alice.fileStatus() == FILE_STATUS_DONE && bob.fileStatus() == FILE_STATUS_DONE
+	}, alice, bob)
+
+	received, err := os.ReadFile(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, content) {
+		t.Fatalf("received %d bytes that differ from the %d sent", len(received), len(content))
+	}
+	sum := sha256.Sum256(received)
+	if checksum := bob.lastFile().Checksum; checksum != hex.EncodeToString(sum[:]) {
+		t.Fatalf("checksum %s, file has %x", checksum, sum)
+	}
+	if fileExists(saved+".part") || len(alice.state.transfers) != 0 || len(bob.state.transfers) != 0 {
+		t.Fatal("transfer not cleaned up")
+	}
+}
+
+func TestFileTooLarge(t *testing.T) {
+	alice, bob := transferPeers(t)
+	large := filepath.Join(t.TempDir(), "large.bin")
+	if err := os.WriteFile(large, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(large, protocol.MAX_FILE_SIZE+1); err != nil {
+		t.Fatal(err)
+	}
+	alice.command("/send " + large)
+	if len(alice.state.transfers) != 0 || alice.fileStatus() != "" {
+		t.Fatalf("offered a file over the limit: %s", alice.state.status)
+	}
+
+	// an offer over the limit from a client that does not check is refused
+	// by the server and never reaches bob
+	offer, _ := json.Marshal(map[string]any{
+		"type": protocol.MESSAGE_TYPE_FILE_OFFER,
+		"payload": map[string]any{
+			"toUsername": "bob",
+			"transferId": "t1",
+			"name":       "large.bin",
+			"size":       protocol.MAX_FILE_SIZE + 1,
+			"checksum":   hex.EncodeToString(make([]byte, 32)),
+		},
+	})
+	if err := alice.conn.WriteMessage(offer); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case frame := <-alice.frames:
+		if _, ok := frame.Payload.(*protocol.Error); !ok {
+			t.Fatalf("expected ERROR, got %#v", frame.Payload)
+		}
+	case <-time.After(TRANSFER_TIMEOUT):
+		t.Fatal("offer not refused")
+	}
+	if err := writeFrame(alice.conn, protocol.NewFrame(&protocol.Send{ToUsername: "bob", Content: "after"})); err != nil {
+		t.Fatal(err)
+	}
+	deliver(t, func() bool { return len(bob.state.chats["alice"].Messages) > 0 }, alice, bob)
+	if messages := bob.state.chats["alice"].Messages; len(messages) != 1 || messages[0].File != nil {
+		t.Fatalf("bob got %#v", messages)
+	}
+}
+
+func TestCorruptFileDiscarded(t *testing.T) {
+	alice, bob := transferPeers(t)
+	dir := t.TempDir()
+	sendPath := filepath.Join(dir, "notes.bin")
+	size := 3 * protocol.FILE_CHUNK_SIZE
+	writeRandomFile(t, sendPath, size)
+	alice.command("/send " + sendPath)
+	deliver(t, bob.hasStatus(FILE_STATUS_OFFERED), alice, bob)
+	// the file changes after it was offered, the chunks no longer match the
+	// checksum
+	writeRandomFile(t, sendPath, size)
+
+	saved := filepath.Join(dir, "saved.bin")
+	bob.command("/accept " + saved)
+	if !fileExists(saved + ".part") {
+		t.Fatal("no .part file while receiving")
+	}
+	deliver(t, func() bool {
+		return alice.fileStatus() == FILE_STATUS_FAILED && bob.fileStatus() == FILE_STATUS_FAILED
+	}, alice, bob)
+	if fileExists(saved) || fileExists(saved+".part") {
+		t.Fatal("corrupt file kept")
+	}
+}
+
+func TestUnexpectedChunkAborts(t *testing.T) {
+	alice, bob := transferPeers(t)
+	dir := t.TempDir()
+	sendPath := filepath.Join(dir, "notes.bin")
+	writeRandomFile(t, sendPath, 3*protocol.FILE_CHUNK_SIZE)
+	alice.command("/send " + sendPath)
+	deliver(t, bob.hasStatus(FILE_STATUS_OFFERED), alice, bob)
+	var transferID string
+	for id := range alice.state.transfers {
+		transferID = id
+	}
+
+	saved := filepath.Join(dir, "saved.bin")
+	bob.command("/accept " + saved)
+	// a chunk past the data received so far, sent before alice sees the
+	// answer
+	chunk := &protocol.FileChunk{
+		FileTransfer: protocol.FileTransfer{ToUsername: "bob", TransferID: transferID},
+		Offset:       protocol.FILE_CHUNK_SIZE,
+		Data:         []byte("out of order"),
+	}
+	if err := writeFrame(alice.conn, protocol.NewFrame(chunk)); err != nil {
+		t.Fatal(err)
+	}
+	deliver(t, bob.hasStatus(FILE_STATUS_FAILED), bob)
+	if fileExists(saved) || fileExists(saved+".part") {
+		t.Fatal("aborted file kept")
+	}
+	deliver(t, alice.hasStatus(FILE_STATUS_FAILED), alice, bob)
+	if len(alice.state.transfers) != 0 || len(bob.state.transfers) != 0 {
+		t.Fatal("transfer not cleaned up")
+	}
+}
+
+func TestNoFilesInEncryptedChat(t *testing.T) {
+	alice, _ := transferPeers(t)
+	data := alice.state.chats["bob"]
+	data.Encrypted = true
+	alice.state.chats["bob"] = data
+	sendPath := filepath.Join(t.TempDir(), "notes.bin")
+	writeRandomFile(t, sendPath, 100)
+	alice.command("/send " + sendPath)
+	if len(alice.state.transfers) != 0 || alice.fileStatus() != "" {
+		t.Fatal("offered a file in plaintext in an encrypted chat")
+	}
+}
@@ -0,0 +1,482 @@
+package client
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+/*
+Harness runs the client UI without a terminal or a server:
+
+	h := NewHarness(t, "alice", nil, 80, 24)
+	h.Receive(&protocol.Presence{Users: []string{"alice", "bob"}})
+	h.Press(Key(KEY_TYPE_RIGHT_ARROW), Key(KEY_TYPE_ENTER))
+	h.Type("hello")
+	h.Press(Key(KEY_TYPE_ENTER))
+	h.MatchGolden("chat")
+
+Frames are rendered as Start renders them and what Screen writes goes to a
+VirtualTerminal, so snapshots show what a real terminal would. History stays in
+memory and HOME is a temporary directory, frames the client sends are kept
+in Sent and messages are stamped with HARNESS_TIME so snapshots do not
+change from run to run.
+*/
+var HARNESS_TIME = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+type Harness struct {
+	t        *testing.T
+	State    *UIState
+	Terminal *VirtualTerminal
+	Sent     []protocol.Frame
+	// received numbers the ids of received frames
+	received int
+}
+
+// harnessConn records what the client sends and never receives anything.
+type harnessConn struct {
+	harness *Harness
+}
+
+func (c harnessConn) ReadMessage() ([]byte, error) {
+	return nil, errors.New("harness connection can not be read")
+}
+
+func (c harnessConn) WriteMessage(data []byte) error {
+	frame, err := protocol.Decode(data)
+	if err != nil {
+		return err
+	}
+	c.harness.Sent = append(c.harness.Sent, frame)
+	return nil
+}
+
+func (c harnessConn) Close() error {
+	return nil
+}
+
+func NewHarness(t *testing.T, username string, capabilities []string, width, height int) *Harness {
+	// the identity of e2e is kept under HOME
+	t.Setenv("HOME", t.TempDir())
+	h := &Harness{t: t, Terminal: NewVirtualTerminal(width, height)}
+	h.State = NewUIState(username, harnessConn{h}, capabilities, nil, PersistedState{}, h.Terminal, width, height)
+	h.State.now = func() time.Time { return HARNESS_TIME }
+	render(h.State)
+	return h
+}
+
+// Key is a key press without a character.
+func Key(keyType KeyType) EventKeyPress {
+	return EventKeyPress{KeyType: keyType}
+}
+
+// Press handles events in order, rendering after each that needs it.
+func (h *Harness) Press(events ...EventKeyPress) {
+	for _, event := range events {
+		if handleKeypress(h.State, event) {
+			render(h.State)
+		}
+	}
+}
+
+// Type presses a key for each character of text.
+func (h *Harness) Type(text string) {
+	for _, r := range text {
+		h.Press(EventKeyPress{KeyType: KEY_TYPE_PRINTABLE, Char: r})
+	}
+}
+
+// Paste pastes text as bracketed paste would deliver it.
+func (h *Harness) Paste(text string) {
+	h.Press(EventKeyPress{KeyType: KEY_TYPE_PASTE, Text: sanitizeText(text)})
+}
+
+// Receive handles payloads as if the server had sent them, each in a frame
+// with an id of its own.
+func (h *Harness) Receive(payloads ...protocol.Payload) {
+	for _, payload := range payloads {
+		h.received++
+		frame := protocol.NewFrame(payload)
+		frame.ID = fmt.Sprint("r", h.received)
+		if handleWSMessage(h.State, frame) {
+			render(h.State)
+		}
+	}
+}
+
+func (h *Harness) Resize(width, height int) {
+	h.Terminal.Resize(width, height)
+	if handleResize(h.State, EventResize{Width: width, Height: height}) {
+		render(h.State)
+	}
+}
+
+// LastSent is the payload of the last frame the client sent.
+func (h *Harness) LastSent() protocol.Payload {
+	h.t.Helper()
+	if len(h.Sent) == 0 {
+		h.t.Fatal("nothing was sent")
+	}
+	return h.Sent[len(h.Sent)-1].Payload
+}
+
+// Snapshot is the text on the virtual terminal followed by the cursor.
+func (h *Harness) Snapshot() string {
+	row, col, visible := h.Terminal.Cursor()
+	cursor := "hidden"
+	if visible {
+		cursor = fmt.Sprint(row, ",", col)
+	}
+	return h.Terminal.Text() + "cursor: " + cursor + "\n"
+}
+
+// MatchGolden compares Snapshot with testdata/name.golden, or writes the
+// file when the tests run with -update.
+func (h *Harness) MatchGolden(name string) {
+	h.t.Helper()
+	goldenPath := path.Join("testdata", name+".golden")
+	snapshot := h.Snapshot()
+	if *update {
+		os.MkdirAll(path.Dir(goldenPath), 0755)
+		if err := os.WriteFile(goldenPath, []byte(snapshot), 0644); err != nil {
+			h.t.Fatal(err)
+		}
+		return
+	}
+	golden, err := os.ReadFile(goldenPath)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	if string(golden) == snapshot {
+		return
+	}
+	want, got := strings.Split(string(golden), "\n"), strings.Split(snapshot, "\n")
+	for i := 0; i < max(len(want), len(got)); i++ {
+		wantLine, gotLine := "", ""
+		if i < len(want) {
+			wantLine = want[i]
+		}
+		if i < len(got) {
+			gotLine = got[i]
+		}
+		if wantLine != gotLine {
+			h.t.Fatalf("%s differs at line %d\nwant: %q\n got: %q\n\n%s", goldenPath, i+1, wantLine, gotLine, snapshot)
+		}
+	}
+}
+
+/*
+VirtualTerminal interprets what the client writes to the terminal into a
+grid of cells, independently of Screen so that snapshots check the escape
+sequences Screen writes rather than its own idea of them. It follows xterm
+with auto-wrap on:
+
+	ESC [ row ; col H/f     cursor position
+	ESC [ n A/B/C/D         cursor movement
+	ESC [ n J, ESC [ n K    erase screen, erase line
+	ESC [ ? 25 h/l          show and hide the cursor
+	ESC 7, ESC 8            save and restore the cursor position
+	\r \n \b               carriage return, line feed, backspace
+
+Other sequences, like styles, are read and ignored. Printing in the last
+column leaves the cursor there and the next character wraps to the next row,
+scrolling at the bottom, a wide character that does not fit wraps first.
+*/
+type VirtualTerminal struct {
+	width, height int
+	// cells hold the text of each cell, the right half of a wide character
+	// is empty
+	cells              [][]string
+	row, col           int
+	savedRow, savedCol int
+	wrapNext           bool
+	cursorVisible      bool
+	// the cell written last, marks and joined emoji are added to it
+	lastRow, lastCol int
+	hasLast          bool
+	joinNext         bool
+	loneIndicator    bool
+	pending          []byte
+}
+
+const VT_ZERO_WIDTH_JOINER = 0x200D
+const VT_EMOJI_PRESENTATION = 0xFE0F
+
+func NewVirtualTerminal(width, height int) *VirtualTerminal {
+	vt := &VirtualTerminal{}
+	vt.Resize(width, height)
+	return vt
+}
+
+// Resize starts over with a blank grid, the client redraws everything after
+// a resize.
+func (vt *VirtualTerminal) Resize(width, height int) {
+	vt.width, vt.height = width, height
+	vt.cells = make([][]string, height)
+	for row := range vt.cells {
+		vt.cells[row] = vt.blankRow()
+	}
+	vt.row, vt.col = min(vt.row, height-1), min(vt.col, width-1)
+	vt.wrapNext, vt.hasLast = false, false
+}
+
+func (vt *VirtualTerminal) blankRow() []string {
+	row := make([]string, vt.width)
+	for col := range row {
+		row[col] = " "
+	}
+	return row
+}
+
+func (vt *VirtualTerminal) Write(p []byte) (int, error) {
+	data := append(vt.pending, p...)
+	vt.pending = nil
+	for len(data) > 0 {
+		n := vt.next(data)
+		if n == 0 {
+			vt.pending = append([]byte{}, data...)
+			break
+		}
+		data = data[n:]
+	}
+	return len(p), nil
+}
+
+// next interprets the character or sequence data starts with and returns
+// its length, 0 when data ends in the middle of it.
+func (vt *VirtualTerminal) next(data []byte) int {
+	switch data[0] {
+	case 0x1b:
+		return vt.escape(data)
+	case '\r':
+		vt.moveTo(vt.row, 0)
+		return 1
+	case '\n':
+		vt.lineFeed()
+		vt.wrapNext = false
+		return 1
+	case '\b':
+		vt.moveTo(vt.row, vt.col-1)
+		return 1
+	}
+	if data[0] < 0x20 || data[0] == 0x7f {
+		return 1
+	}
+	if !utf8.FullRune(data) {
+		return 0
+	}
+	r, size := utf8.DecodeRune(data)
+	vt.print(r)
+	return size
+}
+
+func (vt *VirtualTerminal) escape(data []byte) int {
+	if len(data) < 2 {
+		return 0
+	}
+	switch data[1] {
+	case '7':
+		vt.savedRow, vt.savedCol = vt.row, vt.col
+		return 2
+	case '8':
+		vt.moveTo(vt.savedRow, vt.savedCol)
+		return 2
+	case '[':
+	default:
+		return 2
+	}
+	end := 2
+	for end < len(data) && (data[end] < 0x40 || data[end] > 0x7e) {
+		end++
+	}
+	if end == len(data) {
+		return 0
+	}
+	body := string(data[2:end])
+	private := strings.HasPrefix(body, "?")
+	if strings.HasPrefix(body, ">") {
+		return end + 1
+	}
+	var params []int
+	for _, field := range strings.Split(strings.TrimPrefix(body, "?"), ";") {
+		n, _ := strconv.Atoi(field)
+		params = append(params, n)
+	}
+	// a missing or zero parameter is the default
+	param := func(i, fallback int) int {
+		if i < len(params) && params[i] != 0 {
+			return params[i]
+		}
+		return fallback
+	}
+	switch data[end] {
+	case 'H', 'f':
+		vt.moveTo(param(0, 1)-1, param(1, 1)-1)
+	case 'A':
+		vt.moveTo(vt.row-param(0, 1), vt.col)
+	case 'B':
+		vt.moveTo(vt.row+param(0, 1), vt.col)
+	case 'C':
+		vt.moveTo(vt.row, vt.col+param(0, 1))
+	case 'D':
+		vt.moveTo(vt.row, vt.col-param(0, 1))
+	case 'J':
+		switch param(0, 0) {
+		case 0:
+			vt.erase(vt.row, vt.col, vt.width)
+			for row := vt.row + 1; row < vt.height; row++ {
+				vt.erase(row, 0, vt.width)
+			}
+		case 1:
+			for row := 0; row < vt.row; row++ {
+				vt.erase(row, 0, vt.width)
+			}
+			vt.erase(vt.row, 0, vt.col+1)
+		default:
+			for row := 0; row < vt.height; row++ {
+				vt.erase(row, 0, vt.width)
+			}
+		}
+	case 'K':
+		switch param(0, 0) {
+		case 0:
+			vt.erase(vt.row, vt.col, vt.width)
+		case 1:
+			vt.erase(vt.row, 0, vt.col+1)
+		default:
+			vt.erase(vt.row, 0, vt.width)
+		}
+	case 'h', 'l':
+		if private && param(0, 0) == 25 {
+			vt.cursorVisible = data[end] == 'h'
+		}
+	}
+	return end + 1
+}
+
+func (vt *VirtualTerminal) moveTo(row, col int) {
+	vt.row = max(0, min(row, vt.height-1))
+	vt.col = max(0, min(col, vt.width-1))
+	vt.wrapNext = false
+}
+
+// erase blanks the columns from to to of row, with both halves of the wide
+// characters it cuts.
+func (vt *VirtualTerminal) erase(row, from, to int) {
+	cells := vt.cells[row]
+	from, to = max(from, 0), min(to, vt.width)
+	if from > 0 && from < vt.width && cells[from] == "" {
+		from--
+	}
+	if to < vt.width && cells[to] == "" {
+		to++
+	}
+	for col := from; col < to; col++ {
+		cells[col] = " "
+	}
+	vt.hasLast = false
+}
+
+func (vt *VirtualTerminal) lineFeed() {
+	if vt.row < vt.height-1 {
+		vt.row++
+		return
+	}
+	vt.cells = append(vt.cells[1:], vt.blankRow())
+	vt.lastRow--
+}
+
+// print puts r at the cursor. Marks, emoji joined by a zero width joiner,
+// skin tones and the second of a pair of regional indicators are added to
+// the cell before.
+func (vt *VirtualTerminal) print(r rune) {
+	width := vtWidth(r)
+	indicator := r >= 0x1F1E6 && r <= 0x1F1FF
+	joins := width == 0 || vt.joinNext || (r >= 0x1F3FB && r <= 0x1F3FF) || (indicator && vt.loneIndicator)
+	vt.joinNext = r == VT_ZERO_WIDTH_JOINER
+	vt.loneIndicator = indicator && !vt.loneIndicator
+	if joins {
+		if !vt.hasLast || vt.lastRow < 0 {
+			return
+		}
+		cells := vt.cells[vt.lastRow]
+		cells[vt.lastCol] += string(r)
+		// emoji presentation widens a narrow character right before the
+		// cursor
+		if r == VT_EMOJI_PRESENTATION && vt.lastRow == vt.row && vt.lastCol+1 == vt.col && !vt.wrapNext {
+			cells[vt.col] = ""
+			vt.advance(1)
+		}
+		return
+	}
+	if vt.wrapNext || (width == 2 && vt.col == vt.width-1) {
+		vt.col = 0
+		vt.lineFeed()
+		vt.wrapNext = false
+	}
+	cells := vt.cells[vt.row]
+	vt.erase(vt.row, vt.col, vt.col+width)
+	cells[vt.col] = string(r)
+	if width == 2 {
+		cells[vt.col+1] = ""
+	}
+	vt.lastRow, vt.lastCol, vt.hasLast = vt.row, vt.col, true
+	vt.advance(width)
+}
+
+// advance moves the cursor past width printed cells, stopping in the last
+// column with the next character to wrap.
+func (vt *VirtualTerminal) advance(width int) {
+	vt.col += width
+	if vt.col >= vt.width {
+		vt.col = vt.width - 1
+		vt.wrapNext = true
+	}
+}
+
+// vtWidth is the number of cells xterm gives r: none for marks and format
+// characters, two for East Asian wide characters and emoji.
+func vtWidth(r rune) int {
+	switch {
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf):
+		return 0
+	case unicode.In(r, unicode.Han, unicode.Hangul, unicode.Hiragana, unicode.Katakana),
+		r >= 0x1100 && r <= 0x115F,
+		r >= 0x3000 && r <= 0x303E,
+		r >= 0xFF00 && r <= 0xFF60,
+		r >= 0xFFE0 && r <= 0xFFE6,
+		r >= 0x1F300 && r <= 0x1F64F,
+		r >= 0x1F680 && r <= 0x1F6FF,
+		r >= 0x1F900 && r <= 0x1FAFF:
+		return 2
+	}
+	return 1
+}
+
+// Text is the grid as text, one line per row without trailing spaces.
+func (vt *VirtualTerminal) Text() string {
+	var b strings.Builder
+	for _, cells := range vt.cells {
+		b.WriteString(strings.TrimRight(strings.Join(cells, ""), " "))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// Cursor is where the cursor is and whether it is shown, rows and columns
+// counting from 1.
+func (vt *VirtualTerminal) Cursor() (int, int, bool) {
+	return vt.row + 1, vt.col + 1, vt.cursorVisible
+}
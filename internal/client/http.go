@@ -0,0 +1,256 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
+)
+
+var (
+	errConnClosed  = errors.New("connection closed")
+	errSessionGone = errors.New("session closed by the server")
+)
+
+const (
+	// a failed events or poll request is retried HTTP_RETRIES times with
+	// the same cursor before the connection is given up
+	HTTP_RETRIES     = 3
+	HTTP_RETRY_DELAY = time.Second
+	// HTTP_ACK_INTERVAL is how often events received are acknowledged
+	HTTP_ACK_INTERVAL = time.Second
+)
+
+// httpConn talks to the server's HTTP fallback transport, receiving with
+// server sent events or long polling and sending with POST requests.
+type httpConn struct {
+	baseURL  string
+	token    string
+	messages chan []byte
+	ctx      context.Context
+	cancel   context.CancelFunc
+	// cursor is the number of messages received
+	cursor atomic.Uint64
+}
+
+func dialHTTP(wsURL url.URL, transport string) (Conn, error) {
+	base := url.URL{Scheme: "http", Host: wsURL.Host, Path: "/http"}
+	if wsURL.Scheme == "wss" {
+		base.Scheme = "https"
+	}
+	log.Printf("connecting to %s (%s)", base.String(), transport)
+	resp, err := http.Post(base.String()+"/session", "application/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("open session: %s", resp.Status)
+	}
+	var session protocol.HTTPSessionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &httpConn{
+		baseURL:  base.String(),
+		token:    session.Token,
+		messages: make(chan []byte, 1024),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	if transport == TRANSPORT_SSE {
+		go c.listenEvents()
+		go c.acknowledgeEvents()
+	} else {
+		go c.poll()
+	}
+	return c, nil
+}
+
+func (c *httpConn) endpoint(name string) string {
+	return c.baseURL + "/" + name + "?token=" + url.QueryEscape(c.token)
+}
+
+func (c *httpConn) cursorEndpoint(name string) string {
+	return c.endpoint(name) + "&cursor=" + strconv.FormatUint(c.cursor.Load(), 10)
+}
+
+func (c *httpConn) get(name string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodGet, c.cursorEndpoint(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+			return nil, errSessionGone
+		}
+		return nil, fmt.Errorf("%s: %s", name, resp.Status)
+	}
+	return resp, nil
+}
+
+// retry runs receive until the session is gone or it failed HTTP_RETRIES
+// times in a row, the server sends again what was not acknowledged.
+func (c *httpConn) retry(receive func() (bool, error)) {
+	defer close(c.messages)
+	for failures := 0; failures <= HTTP_RETRIES; {
+		received, err := receive()
+		if received {
+			failures = 0
+		}
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, errSessionGone) || c.ctx.Err() != nil {
+			return
+		}
+		log.Print("err http transport:", err)
+		failures++
+		select {
+		case <-time.After(HTTP_RETRY_DELAY):
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *httpConn) listenEvents() {
+	c.retry(c.receiveEvents)
+}
+
+// receiveEvents reads one event stream, the id of each event is the cursor
+// after it.
+func (c *httpConn) receiveEvents() (bool, error) {
+	resp, err := c.get("events")
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	received := false
+	var cursor uint64
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 4096), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if id, has := strings.CutPrefix(line, "id: "); has {
+			cursor, _ = strconv.ParseUint(id, 10, 64)
+			continue
+		}
+		data, has := strings.CutPrefix(line, "data: ")
+		if !has {
+			continue
+		}
+		c.messages <- []byte(data)
+		c.cursor.Store(cursor)
+		received = true
+	}
+	if err := scanner.Err(); err != nil {
+		return received, err
+	}
+	return received, errors.New("events: stream ended")
+}
+
+// acknowledgeEvents tells the server which events arrived, so it can stop
+// keeping them.
+func (c *httpConn) acknowledgeEvents() {
+	ticker := time.NewTicker(HTTP_ACK_INTERVAL)
+	defer ticker.Stop()
+	acked := uint64(0)
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.ctx.Done():
+			return
+		}
+		cursor := c.cursor.Load()
+		if cursor == acked {
+			continue
+		}
+		if err := c.post("ack", c.cursorEndpoint("ack"), nil); err != nil {
+			log.Print("err http ack:", err)
+			continue
+		}
+		acked = cursor
+	}
+}
+
+func (c *httpConn) poll() {
+	c.retry(c.receivePoll)
+}
+
+func (c *httpConn) receivePoll() (bool, error) {
+	resp, err := c.get("poll")
+	if err != nil {
+		return false, err
+	}
+	var response protocol.HTTPPollResponse
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	resp.Body.Close()
+	if err != nil {
+		return false, err
+	}
+	for _, message := range response.Messages {
+		c.messages <- message
+	}
+	c.cursor.Store(response.Cursor)
+	return len(response.Messages) > 0, nil
+}
+
+func (c *httpConn) ReadMessage() ([]byte, error) {
+	data, ok := <-c.messages
+	if !ok {
+		return nil, errConnClosed
+	}
+	return data, nil
+}
+
+func (c *httpConn) WriteMessage(data []byte) error {
+	return c.post("send", c.endpoint("send"), data)
+}
+
+func (c *httpConn) post(name, endpoint string, data []byte) error {
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("%s: %s", name, resp.Status)
+	}
+	return nil
+}
+
+func (c *httpConn) Close() error {
+	select {
+	case <-c.ctx.Done():
+		return nil
+	default:
+	}
+	resp, err := http.Post(c.endpoint("close"), "application/json", nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+	c.cancel()
+	return nil
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
+	"github.com/0ya-sh0/GoChatTUI/internal/server"
+)
+
+// dialHTTPUser connects username over the HTTP transport as connect would,
+// frames received are passed on in order.
+func dialHTTPUser(t *testing.T, srv *httptest.Server, transport, username string) (Conn, chan protocol.Frame) {
+	t.Helper()
+	serverURL, _ := url.Parse(srv.URL)
+	conn, err := dialHTTP(url.URL{Scheme: "ws", Host: serverURL.Host, Path: "/ws"}, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if _, err := handshake(conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFrame(conn, protocol.NewFrame(&protocol.ClaimUsername{Username: username})); err != nil {
+		t.Fatal(err)
+	}
+	frames := make(chan protocol.Frame, 1024)
+	go listenWSEvents(conn, frames)
+	return conn, frames
+}
+
+// nextFrame is the next frame matching, others are skipped.
+func nextFrame(t *testing.T, frames chan protocol.Frame, matching func(protocol.Frame) bool) protocol.Frame {
+	t.Helper()
+	timeout := time.After(TRANSFER_TIMEOUT)
+	for {
+		select {
+		case frame, ok := <-frames:
+			if !ok {
+				t.Fatal("connection closed")
+			}
+			if matching(frame) {
+				return frame
+			}
+		case <-timeout:
+			t.Fatal("no frame in ", TRANSFER_TIMEOUT)
+		}
+	}
+}
+
+func TestHTTPTransports(t *testing.T) {
+	b := startTransferBroker(t)
+	mux := http.NewServeMux()
+	server.NewHTTPTransport(b).Register(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	alice, aliceFrames := dialHTTPUser(t, srv, TRANSPORT_SSE, "alice")
+	bob, bobFrames := dialHTTPUser(t, srv, TRANSPORT_POLL, "bob")
+	nextFrame(t, bobFrames, func(frame protocol.Frame) bool {
+		presence, ok := frame.Payload.(*protocol.Presence)
+		return ok && slices.Equal(presence.Users, []string{"alice", "bob"})
+	})
+
+	isChat := func(frame protocol.Frame) bool { return frame.Type() == protocol.MESSAGE_TYPE_CHAT }
+	for _, content := range []string{"one", "two", "three"} {
+		if err := writeFrame(bob, protocol.NewFrame(&protocol.Send{ToUsername: "alice", Content: content})); err != nil {
+			t.Fatal(err)
+		}
+		if chat := nextFrame(t, aliceFrames, isChat).Payload.(*protocol.Chat); chat.Content != content {
+			t.Fatalf("alice got %q, want %q", chat.Content, content)
+		}
+		if err := writeFrame(alice, protocol.NewFrame(&protocol.Send{ToUsername: "bob", Content: content})); err != nil {
+			t.Fatal(err)
+		}
+		if chat := nextFrame(t, bobFrames, isChat).Payload.(*protocol.Chat); chat.Content != content {
+			t.Fatalf("bob got %q, want %q", chat.Content, content)
+		}
+	}
+}
@@ -1,8 +1,15 @@
 package client
 
 import (
-	"os"
+	"bytes"
+	"errors"
+	"io"
+	"slices"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
 )
 
 const (
@@ -15,6 +22,15 @@ const (
 	KEY_CTRL_E byte = 0x05
 	KEY_CTRL_F byte = 0x06
 	KEY_CTRL_G byte = 0x07 // bell
+	KEY_CTRL_H byte = 0x08 // backspace on some terminals
+	KEY_CTRL_J byte = 0x0A // line feed
+	KEY_CTRL_K byte = 0x0B
+	KEY_CTRL_N byte = 0x0E
+	KEY_CTRL_O byte = 0x0F
+	KEY_CTRL_T byte = 0x14
+	KEY_CTRL_U byte = 0x15
+	KEY_CTRL_W byte = 0x17
+	KEY_CTRL_Y byte = 0x19
 
 	KEY_BACKSPACE byte = 0x7F // DEL (most terminals)
 
@@ -41,6 +57,29 @@ var (
 	KEY_DELETE    = []byte{0x1B, 0x5B, '3', '~'}
 	KEY_PAGE_UP   = []byte{0x1B, 0x5B, '5', '~'}
 	KEY_PAGE_DOWN = []byte{0x1B, 0x5B, '6', '~'}
+
+	// application cursor mode and the vt220 variants of Home and End
+	KEY_HOME_SS3 = []byte{0x1B, 'O', 'H'}
+	KEY_END_SS3  = []byte{0x1B, 'O', 'F'}
+	KEY_HOME_VT  = []byte{0x1B, 0x5B, '1', '~'}
+	KEY_END_VT   = []byte{0x1B, 0x5B, '4', '~'}
+
+	// Alt is sent as ESC before the key
+	KEY_ALT_B         = []byte{0x1B, 'b'}
+	KEY_ALT_F         = []byte{0x1B, 'f'}
+	KEY_ALT_BACKSPACE = []byte{0x1B, KEY_BACKSPACE}
+	KEY_ALT_ENTER     = []byte{0x1B, KEY_ENTER}
+
+	// Shift+Enter, only sent by terminals with kitty keyboard or xterm
+	// modifyOtherKeys reporting on
+	KEY_SHIFT_ENTER_CSI_U = []byte("\x1b[13;2u")
+	KEY_SHIFT_ENTER_XTERM = []byte("\x1b[27;2;13~")
+	KEY_ALT_ENTER_CSI_U   = []byte("\x1b[13;3u")
+	KEY_ALT_ENTER_XTERM   = []byte("\x1b[27;3;13~")
+
+	// bracketed paste wraps pasted text in these
+	KEY_PASTE_START = []byte("\x1b[200~")
+	KEY_PASTE_END   = []byte("\x1b[201~")
 )
 
 const (
@@ -53,19 +92,150 @@ const (
 	KEY_TYPE_RIGHT_ARROW
 	KEY_TYPE_ENTER
 	KEY_TYPE_BACKSPACE
+	KEY_TYPE_CTRL_E
+	KEY_TYPE_CTRL_F
+	KEY_TYPE_TAB
+	KEY_TYPE_HOME
+	KEY_TYPE_END
+	KEY_TYPE_DELETE
+	KEY_TYPE_CTRL_A
+	KEY_TYPE_CTRL_K
+	KEY_TYPE_CTRL_N
+	KEY_TYPE_CTRL_O
+	KEY_TYPE_CTRL_T
+	KEY_TYPE_CTRL_U
+	KEY_TYPE_CTRL_W
+	KEY_TYPE_CTRL_Y
+	KEY_TYPE_ALT_B
+	KEY_TYPE_ALT_F
+	KEY_TYPE_ALT_BACKSPACE
+	KEY_TYPE_NEWLINE
+	KEY_TYPE_PASTE
 	KEY_TYPE_UNKNOWN
 )
 
 type KeyType int
 
+var controlKeys = map[byte]KeyType{
+	KEY_CTRL_A:    KEY_TYPE_CTRL_A,
+	KEY_CTRL_C:    KEY_TYPE_CTRL_C,
+	KEY_CTRL_E:    KEY_TYPE_CTRL_E,
+	KEY_CTRL_F:    KEY_TYPE_CTRL_F,
+	KEY_CTRL_K:    KEY_TYPE_CTRL_K,
+	KEY_CTRL_N:    KEY_TYPE_CTRL_N,
+	KEY_CTRL_O:    KEY_TYPE_CTRL_O,
+	KEY_CTRL_T:    KEY_TYPE_CTRL_T,
+	KEY_CTRL_U:    KEY_TYPE_CTRL_U,
+	KEY_CTRL_W:    KEY_TYPE_CTRL_W,
+	KEY_CTRL_Y:    KEY_TYPE_CTRL_Y,
+	KEY_TAB:       KEY_TYPE_TAB,
+	KEY_ENTER:     KEY_TYPE_ENTER,
+	KEY_BACKSPACE: KEY_TYPE_BACKSPACE,
+	KEY_CTRL_H:    KEY_TYPE_BACKSPACE,
+	KEY_CTRL_J:    KEY_TYPE_NEWLINE,
+}
+
+var escapeKeys = map[string]KeyType{
+	string(KEY_UP):            KEY_TYPE_UP_ARROW,
+	string(KEY_DOWN):          KEY_TYPE_DOWN_ARROW,
+	string(KEY_LEFT):          KEY_TYPE_LEFT_ARROW,
+	string(KEY_RIGHT):         KEY_TYPE_RIGHT_ARROW,
+	string(KEY_HOME):          KEY_TYPE_HOME,
+	string(KEY_END):           KEY_TYPE_END,
+	string(KEY_HOME_SS3):      KEY_TYPE_HOME,
+	string(KEY_END_SS3):       KEY_TYPE_END,
+	string(KEY_HOME_VT):       KEY_TYPE_HOME,
+	string(KEY_END_VT):        KEY_TYPE_END,
+	string(KEY_DELETE):        KEY_TYPE_DELETE,
+	string(KEY_ALT_B):         KEY_TYPE_ALT_B,
+	string(KEY_ALT_F):         KEY_TYPE_ALT_F,
+	string(KEY_ALT_BACKSPACE): KEY_TYPE_ALT_BACKSPACE,
+	string(KEY_ALT_ENTER):     KEY_TYPE_NEWLINE,
+
+	string(KEY_SHIFT_ENTER_CSI_U): KEY_TYPE_NEWLINE,
+	string(KEY_SHIFT_ENTER_XTERM): KEY_TYPE_NEWLINE,
+	string(KEY_ALT_ENTER_CSI_U):   KEY_TYPE_NEWLINE,
+	string(KEY_ALT_ENTER_XTERM):   KEY_TYPE_NEWLINE,
+}
+
+// EventKeyPress is a decoded key, Char is the typed character of
+// KEY_TYPE_PRINTABLE keys and Text the pasted text of KEY_TYPE_PASTE.
 type EventKeyPress struct {
 	KeyType KeyType
-	Char    byte
+	Char    rune
+	Text    string
+}
+
+// ESCAPE_TIMEOUT is how long the bytes after ESC may take to arrive before
+// it is taken for the Esc key.
+const ESCAPE_TIMEOUT = 25 * time.Millisecond
+
+var errInputTimeout = errors.New("no input before the deadline")
+
+// stdin is set up by SetupTerminal, keys and replies to terminal queries are
+// read from it.
+var stdin *inputReader
+
+// inputReader reads on a goroutine of its own so reads can time out, read
+// deadlines do not work on a terminal.
+type inputReader struct {
+	chunks chan []byte
+	// pending was received and not read yet
+	pending []byte
+}
+
+func newInputReader(r io.Reader) *inputReader {
+	in := &inputReader{chunks: make(chan []byte)}
+	go func() {
+		defer close(in.chunks)
+		for {
+			buffer := make([]byte, 256)
+			n, err := r.Read(buffer)
+			if n > 0 {
+				in.chunks <- buffer[:n]
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return in
+}
+
+// readByte returns the next byte, waiting until deadline unless it is zero.
+// errInputTimeout is returned when nothing arrived in time and io.EOF once
+// the input ended.
+func (in *inputReader) readByte(deadline time.Time) (byte, error) {
+	if len(in.pending) == 0 {
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			expired = timer.C
+		}
+		select {
+		case chunk, ok := <-in.chunks:
+			if !ok {
+				return 0, io.EOF
+			}
+			in.pending = chunk
+		case <-expired:
+			return 0, errInputTimeout
+		}
+	}
+	b := in.pending[0]
+	in.pending = in.pending[1:]
+	return b, nil
 }
 
-func listenKeyEvents(events chan EventKeyPress) {
+// unread puts data back in front of what is still to be read.
+func (in *inputReader) unread(data []byte) {
+	in.pending = append(slices.Clone(data), in.pending...)
+}
+
+func listenKeyEvents(in *inputReader, events chan EventKeyPress) {
 	for {
-		event, err := readKey()
+		event, err := in.readKey()
 		if err != nil {
 			close(events)
 			break
@@ -74,89 +244,144 @@ func listenKeyEvents(events chan EventKeyPress) {
 	}
 }
 
-func readKey() (EventKeyPress, error) {
-	bt := make([]byte, 1)
-	_, err := os.Stdin.Read(bt)
+func (in *inputReader) readKey() (EventKeyPress, error) {
+	b, err := in.readByte(time.Time{})
 	if err != nil {
 		return EventKeyPress{}, err
 	}
 
-	if isPrintable(bt[0]) {
+	if isPrintable(b) {
 		return EventKeyPress{
 			KeyType: KEY_TYPE_PRINTABLE,
-			Char:    bt[0],
+			Char:    rune(b),
 		}, nil
 	}
 
-	if bt[0] == KEY_CTRL_C {
-		return EventKeyPress{
-			KeyType: KEY_TYPE_CTRL_C,
-			Char:    bt[0],
-		}, nil
+	if b >= utf8.RuneSelf {
+		return in.readRune(b)
 	}
 
-	if bt[0] == KEY_ENTER {
+	if keyType, ok := controlKeys[b]; ok {
 		return EventKeyPress{
-			KeyType: KEY_TYPE_ENTER,
-			Char:    bt[0],
+			KeyType: keyType,
+			Char:    rune(b),
 		}, nil
 	}
 
-	if bt[0] == KEY_BACKSPACE {
-		return EventKeyPress{
-			KeyType: KEY_TYPE_BACKSPACE,
-			Char:    bt[0],
-		}, nil
+	if b == KEY_ESC {
+		return in.readEscape()
 	}
 
-	if bt[0] == KEY_ESC {
-		os.Stdin.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
-		defer os.Stdin.SetReadDeadline(time.Time{})
-
-		seq := []byte{KEY_ESC}
+	return EventKeyPress{
+		KeyType: KEY_TYPE_UNKNOWN,
+		Char:    rune(b),
+	}, nil
+}
 
-		for {
-			_, err := os.Stdin.Read(bt)
-			if err != nil {
+// readEscape reads what follows ESC. A lone ESC is the Esc key, ESC [ and
+// ESC O start a sequence that ends with a byte in 0x40-0x7E, anything else
+// is the next key pressed with Alt.
+func (in *inputReader) readEscape() (EventKeyPress, error) {
+	seq := []byte{KEY_ESC}
+	for {
+		b, err := in.readByte(time.Now().Add(ESCAPE_TIMEOUT))
+		if err == errInputTimeout {
+			if len(seq) == 1 {
 				return EventKeyPress{
 					KeyType: KEY_TYPE_ESC,
-					Char:    KEY_ESC,
-				}, nil
-			}
-			seq = append(seq, bt[0])
-			if len(seq) >= 3 {
-				if string(seq) == string(KEY_UP) {
-					return EventKeyPress{
-						KeyType: KEY_TYPE_UP_ARROW,
-					}, nil
-				}
-
-				if string(seq) == string(KEY_DOWN) {
-					return EventKeyPress{
-						KeyType: KEY_TYPE_DOWN_ARROW,
-					}, nil
-				}
-
-				if string(seq) == string(KEY_LEFT) {
-					return EventKeyPress{
-						KeyType: KEY_TYPE_LEFT_ARROW,
-					}, nil
-				}
-
-				if string(seq) == string(KEY_RIGHT) {
-					return EventKeyPress{
-						KeyType: KEY_TYPE_RIGHT_ARROW,
-					}, nil
-				}
-				return EventKeyPress{
-					KeyType: KEY_TYPE_UNKNOWN,
+					Char:    rune(KEY_ESC),
 				}, nil
 			}
+			break
+		}
+		if err != nil {
+			return EventKeyPress{}, err
 		}
+		seq = append(seq, b)
+		if len(seq) == 2 && b != '[' && b != 'O' {
+			break
+		}
+		if len(seq) > 2 && b >= 0x40 && b <= 0x7E {
+			break
+		}
+		if len(seq) > 16 {
+			break
+		}
+	}
+	if string(seq) == string(KEY_PASTE_START) {
+		return in.readPaste()
 	}
+	if keyType, ok := escapeKeys[string(seq)]; ok {
+		return EventKeyPress{KeyType: keyType}, nil
+	}
+	return EventKeyPress{KeyType: KEY_TYPE_UNKNOWN}, nil
+}
 
+// readPaste reads pasted text up to KEY_PASTE_END, keeping at most
+// MAX_CONTENT_SIZE bytes of it.
+func (in *inputReader) readPaste() (EventKeyPress, error) {
+	pasted := []byte{}
+	tail := []byte{}
+	for !bytes.Equal(tail, KEY_PASTE_END) {
+		b, err := in.readByte(time.Time{})
+		if err != nil {
+			return EventKeyPress{}, err
+		}
+		tail = append(tail, b)
+		if bytes.HasPrefix(KEY_PASTE_END, tail) {
+			continue
+		}
+		keep := 0
+		if b == KEY_ESC {
+			// may start the end marker
+			keep = 1
+		}
+		if len(pasted) < protocol.MAX_CONTENT_SIZE {
+			pasted = append(pasted, tail[:len(tail)-keep]...)
+		}
+		tail = append(tail[:0], tail[len(tail)-keep:]...)
+	}
 	return EventKeyPress{
-		KeyType: KEY_TYPE_UNKNOWN,
-		Char:    bt[0],
+		KeyType: KEY_TYPE_PASTE,
+		Text:    sanitizeText(string(pasted)),
+	}, nil
+}
+
+// readRune reads the rest of a UTF-8 sequence started by lead. Invalid
+// sequences are reported as KEY_TYPE_UNKNOWN.
+func (in *inputReader) readRune(lead byte) (EventKeyPress, error) {
+	length := 0
+	switch {
+	case lead&0xE0 == 0xC0:
+		length = 2
+	case lead&0xF0 == 0xE0:
+		length = 3
+	case lead&0xF8 == 0xF0:
+		length = 4
+	default:
+		return EventKeyPress{KeyType: KEY_TYPE_UNKNOWN}, nil
+	}
+	sequence := make([]byte, length)
+	sequence[0] = lead
+	for i := 1; i < length; i++ {
+		b, err := in.readByte(time.Time{})
+		if err != nil {
+			return EventKeyPress{}, err
+		}
+		sequence[i] = b
+	}
+	r, _ := utf8.DecodeRune(sequence)
+	if r == utf8.RuneError || !isPrintableRune(r) {
+		return EventKeyPress{KeyType: KEY_TYPE_UNKNOWN}, nil
+	}
+	return EventKeyPress{
+		KeyType: KEY_TYPE_PRINTABLE,
+		Char:    r,
 	}, nil
 }
+
+// isPrintableRune accepts what can be part of typed text, including the
+// joiners and selectors inside emoji sequences.
+func isPrintableRune(r rune) bool {
+	return unicode.IsPrint(r) || unicode.IsMark(r) || r == ZERO_WIDTH_JOINER
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+// pipeInput is an input that is written to while it is read, as a terminal
+// is typed on.
+func pipeInput(t *testing.T) (*inputReader, *io.PipeWriter) {
+	r, w := io.Pipe()
+	t.Cleanup(func() { w.Close() })
+	return newInputReader(r), w
+}
+
+func TestLoneEscDoesNotWait(t *testing.T) {
+	in, w := pipeInput(t)
+	go w.Write([]byte{KEY_ESC})
+	start := time.Now()
+	event, err := in.readKey()
+	if err != nil || event.KeyType != KEY_TYPE_ESC {
+		t.Fatalf("got %#v, %v", event, err)
+	}
+	if waited := time.Since(start); waited > 10*ESCAPE_TIMEOUT {
+		t.Fatalf("Esc took %v", waited)
+	}
+
+	// the next key is read on its own
+	go w.Write([]byte("\x1b[A"))
+	if event, err := in.readKey(); err != nil || event.KeyType != KEY_TYPE_UP_ARROW {
+		t.Fatalf("got %#v, %v", event, err)
+	}
+}
+
+func TestQueryPassesKeysOn(t *testing.T) {
+	in, w := pipeInput(t)
+	go w.Write([]byte("hi\x1b[?2026;2$y!\x1b[?62;22c"))
+	if !querySynchronizedUpdates(in, io.Discard) {
+		t.Fatal("mode 2026 reported but not detected")
+	}
+	for _, want := range "hi!" {
+		event, err := in.readKey()
+		if err != nil || event.Char != want {
+			t.Fatalf("got %#v, %v, want %q", event, err, want)
+		}
+	}
+}
+
+func TestQueryTimesOut(t *testing.T) {
+	in, w := pipeInput(t)
+	start := time.Now()
+	if querySynchronizedUpdates(in, io.Discard) {
+		t.Fatal("detected without a reply")
+	}
+	if waited := time.Since(start); waited > 5*SYNC_QUERY_TIMEOUT {
+		t.Fatalf("query took %v", waited)
+	}
+	// a key typed late still reaches the key reader
+	go w.Write([]byte("x"))
+	if event, err := in.readKey(); err != nil || event.Char != 'x' {
+		t.Fatalf("got %#v, %v", event, err)
+	}
+}
+
+func TestUTF8KeysSplitAcrossReads(t *testing.T) {
+	in, w := pipeInput(t)
+	go func() {
+		// one byte per read, as a slow terminal may deliver them
+		for _, b := range []byte("é日👍a") {
+			w.Write([]byte{b})
+		}
+		w.Write([]byte{0xFF, 0xC3, 'x'})
+	}()
+	for _, want := range "é日👍a" {
+		event, err := in.readKey()
+		if err != nil || event.KeyType != KEY_TYPE_PRINTABLE || event.Char != want {
+			t.Fatalf("got %#v, %v, want %q", event, err, want)
+		}
+	}
+	// invalid sequences are not typed
+	for range 2 {
+		if event, err := in.readKey(); err != nil || event.KeyType != KEY_TYPE_UNKNOWN {
+			t.Fatalf("got %#v, %v", event, err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+const KEYRING_SERVICE = "gochattui"
+
+// KeyringPassphrase returns the storage passphrase of username kept in the
+// OS keyring, generating and storing a random one on first use. It uses
+// secret-tool (libsecret) on Linux and security on macOS.
+func KeyringPassphrase(username string) (string, error) {
+	passphrase, err := keyringLookup(username)
+	if err == nil && passphrase != "" {
+		return passphrase, nil
+	}
+	if StorageEncrypted(username) {
+		// a new passphrase would replace the one the history is encrypted
+		// with
+		if err == nil {
+			err = errors.New("empty secret")
+		}
+		return "", fmt.Errorf("keyring: no passphrase for the encrypted history of %s: %v", username, err)
+	}
+	bytes := make([]byte, 32)
+	rand.Read(bytes)
+	passphrase = hex.EncodeToString(bytes)
+	if err := keyringStore(username, passphrase); err != nil {
+		return "", err
+	}
+	return passphrase, nil
+}
+
+func keyringLookup(username string) (string, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "linux":
+		cmd = exec.Command("secret-tool", "lookup", "service", KEYRING_SERVICE, "account", username)
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", KEYRING_SERVICE, "-a", username, "-w")
+	default:
+		return "", errors.New("no keyring support on " + runtime.GOOS)
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func keyringStore(username, passphrase string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "linux":
+		cmd = exec.Command("secret-tool", "store", "--label", "GoChatTUI history of "+username,
+			"service", KEYRING_SERVICE, "account", username)
+		cmd.Stdin = strings.NewReader(passphrase)
+	case "darwin":
+		// the command is read from stdin so the secret is not in the
+		// argument list other users can see
+		cmd = exec.Command("security", "-i")
+		cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s %s -a %s -w %s\n",
+			KEYRING_SERVICE, securityQuote(username), passphrase))
+	default:
+		return errors.New("no keyring support on " + runtime.GOOS)
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("keyring: %v %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// securityQuote quotes an argument for the interactive mode of security,
+// usernames have no whitespace but may have quotes.
+func securityQuote(arg string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
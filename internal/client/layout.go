@@ -0,0 +1,116 @@
+package client
+
+import (
+	"strconv"
+	"time"
+)
+
+// MIN_BODY_WIDTH is the narrowest message bodies get, on narrow terminals
+// continued lines start left of the first.
+const MIN_BODY_WIDTH = 20
+
+const (
+	KEY_CHANGED_MARK = "[key changed] "
+	WITHHELD_TEXT    = "not shown until the new key is verified, Ctrl+F to compare"
+	ENCRYPTED_MARK   = "🔒 "
+	EDITED_MARK      = " (edited)"
+)
+
+/*
+chatLayout lays the messages of the open chat out for the terminal width:
+
+	2024-05-01 10:00:00 alice: a message long enough to be wrapped at the
+	                           width of the terminal, with continued lines
+	                           indented to the body
+*/
+type chatLayout struct {
+	width     int
+	nameWidth int
+	// column is where bodies start, firstColumn where their first line does
+	column      int
+	firstColumn int
+	// all is the whole chat, for quotes and reply counts
+	all []ChatMessage
+}
+
+func layoutFor(state *UIState) chatLayout {
+	// names are padded by display width so the colons line up
+	nameWidth := max(stringWidth("you"), stringWidth(state.chosenUser))
+	firstColumn := len(time.DateTime) + nameWidth + 4
+	return chatLayout{
+		width:       chatWidth(state),
+		nameWidth:   nameWidth,
+		column:      max(1, min(firstColumn, chatWidth(state)-MIN_BODY_WIDTH+1)),
+		firstColumn: firstColumn,
+		all:         state.currentChatData.Messages,
+	}
+}
+
+func (l chatLayout) bodyWidth() int {
+	return max(1, l.width-l.column+1)
+}
+
+// suffix is what follows the body of message on its last line.
+func (l chatLayout) suffix(message ChatMessage) string {
+	suffix := ""
+	if message.Edited && !message.Deleted && message.File == nil {
+		suffix += EDITED_MARK
+	}
+	if replies := replyCount(l.all, message); replies > 0 {
+		suffix += " [" + strconv.Itoa(replies) + " replies]"
+	}
+	return suffix
+}
+
+// bodyLines are the wrapped lines of the body of message, the last one is
+// empty when the suffix does not fit after the text. Deleted messages and
+// files take one line.
+func (l chatLayout) bodyLines(message ChatMessage) []string {
+	if message.Deleted || message.File != nil {
+		return []string{""}
+	}
+	offset := l.firstColumn - l.column
+	if message.KeyChanged {
+		offset += stringWidth(KEY_CHANGED_MARK)
+	}
+	if message.Encrypted {
+		offset += stringWidth(ENCRYPTED_MARK)
+	}
+	lines := wrapText(sanitizeText(message.Content), l.bodyWidth(), offset)
+	used := stringWidth(lines[len(lines)-1])
+	if len(lines) == 1 {
+		used += offset
+	}
+	if suffix := l.suffix(message); suffix != "" && used+stringWidth(suffix) > l.bodyWidth() {
+		lines = append(lines, "")
+	}
+	return lines
+}
+
+// rows is the number of screen rows message takes, with the quote of its
+// parent and its reactions.
+func (l chatLayout) rows(message ChatMessage) int {
+	rows := len(l.bodyLines(message))
+	if message.ReplyTo != "" {
+		rows++
+	}
+	if len(message.Reactions) > 0 {
+		rows++
+	}
+	return rows
+}
+
+// lastPageStart is the first message of the last page of rows rows. The
+// last message is on it even when it does not fit.
+func (l chatLayout) lastPageStart(messages []ChatMessage, rows int) int {
+	start := len(messages)
+	used := 0
+	for start > 0 && used+l.rows(messages[start-1]) <= rows {
+		used += l.rows(messages[start-1])
+		start--
+	}
+	if start == len(messages) && start > 0 {
+		start--
+	}
+	return start
+}
@@ -0,0 +1,157 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
+)
+
+/*
+Ctrl+N on the main screen asks for a username and opens the chat with it,
+whether or not the user was ever seen:
+
+	 bob  carol  charlie
+	 New chat with: c_
+	Tab: Complete     Enter: Open     Esc: Cancel
+
+Names of online users, then of everyone with a chat, that start with what
+was typed are suggested above the prompt, Tab completes them.
+*/
+
+func startNewChat(state *UIState) bool {
+	if !state.isMainScreen {
+		return false
+	}
+	state.isNewChat = true
+	state.newChatText = ""
+	state.newChatError = ""
+	return true
+}
+
+func handleNewChatKeypress(state *UIState, event EventKeyPress) bool {
+	state.newChatError = ""
+	switch event.KeyType {
+	case KEY_TYPE_ESC, KEY_TYPE_CTRL_C:
+		state.isNewChat = false
+	case KEY_TYPE_PRINTABLE:
+		appendToNewChat(state, string(event.Char))
+	case KEY_TYPE_PASTE:
+		appendToNewChat(state, strings.TrimSpace(sanitizeText(event.Text)))
+	case KEY_TYPE_BACKSPACE:
+		state.newChatText = trimLastGrapheme(state.newChatText)
+	case KEY_TYPE_TAB:
+		state.newChatText = completeUsername(state.newChatText, usernameSuggestions(state, state.newChatText))
+	case KEY_TYPE_ENTER:
+		return openNewChat(state)
+	}
+	return true
+}
+
+// appendToNewChat adds text to the prompt as far as a username can be long.
+func appendToNewChat(state *UIState, text string) {
+	for _, r := range text {
+		if len(state.newChatText)+utf8.RuneLen(r) > protocol.MAX_USERNAME_LENGTH {
+			return
+		}
+		state.newChatText += string(r)
+	}
+}
+
+func openNewChat(state *UIState) bool {
+	username := state.newChatText
+	if err := protocol.ValidateUsername(username); err != nil {
+		state.newChatError = err.Error()
+		return true
+	}
+	if username == state.username {
+		state.newChatError = "that is you"
+		return true
+	}
+	state.isNewChat = false
+	if _, ok := state.chats[username]; !ok {
+		state.chats[username] = ChatData{}
+		saveChat(state, username)
+	}
+	openChat(state, username)
+	updateTabLists(state)
+	updateUserPos(state, 0)
+	return true
+}
+
+// usernameSuggestions are the online and then the known users whose names
+// start with prefix.
+func usernameSuggestions(state *UIState, prefix string) []string {
+	online := []string{}
+	known := []string{}
+	for username := range state.chats {
+		if username == state.username || !strings.HasPrefix(username, prefix) {
+			continue
+		}
+		if state.activeUsers[username] {
+			online = append(online, username)
+		} else {
+			known = append(known, username)
+		}
+	}
+	for username := range state.activeUsers {
+		if _, ok := state.chats[username]; !ok && username != state.username && strings.HasPrefix(username, prefix) {
+			online = append(online, username)
+		}
+	}
+	sort.Strings(online)
+	sort.Strings(known)
+	return slices.Concat(online, known)
+}
+
+// completeUsername extends text to the longest prefix the suggestions share,
+// to the whole name when there is only one.
+func completeUsername(text string, suggestions []string) string {
+	if len(suggestions) == 0 {
+		return text
+	}
+	common := suggestions[0]
+	for _, username := range suggestions[1:] {
+		n := 0
+		for n < len(common) && n < len(username) && common[n] == username[n] {
+			n++
+		}
+		common = common[:n]
+	}
+	// do not stop in the middle of a rune
+	for !utf8.ValidString(common) {
+		common = common[:len(common)-1]
+	}
+	return common
+}
+
+// printNewChat draws the prompt over the bottom of the list and leaves the
+// cursor after the name.
+func printNewChat(w io.Writer, state *UIState, width, height int) {
+	fmt.Fprintf(w, CursorPos, height-2, 1)
+	fmt.Fprint(w, Reset, EraseLine)
+	if state.newChatError != "" {
+		fmt.Fprint(w, " ", FgRed, truncateToWidth(state.newChatError, width-1), Reset)
+	} else {
+		line := ""
+		for _, username := range usernameSuggestions(state, state.newChatText) {
+			line += " " + username + " "
+		}
+		fmt.Fprint(w, Dim, truncateToWidth(line, width), Reset)
+	}
+	prompt := " New chat with: "
+	fmt.Fprintf(w, CursorPos, height-1, 1)
+	fmt.Fprint(w, Reset, EraseLine, Bold, prompt, Reset, truncateToWidth(state.newChatText, width-stringWidth(prompt)-1))
+	fmt.Fprintf(w, CursorPos, height, 1)
+	fmt.Fprint(w, Reset, EraseLine, truncateToWidth(newChatHint(), width))
+	fmt.Fprintf(w, CursorPos, height-1, min(width, stringWidth(prompt)+stringWidth(state.newChatText)+1))
+	fmt.Fprint(w, CursorShow)
+}
+
+func newChatHint() string {
+	return "Tab: Complete     Enter: Open     Esc: Cancel"
+}
@@ -0,0 +1,86 @@
+package client
+
+import "fmt"
+
+/*
+With the split layout the contact list stays on the left while a chat is
+open on the right:
+
+	 [ Unread 2 ]   Online   │ Chat with -  ● bob
+	▶ bob                    │ 2024-01-01 12:00:00 bob: hi
+	  carol                  │  > _
+
+Enter in the list opens a chat and focuses it, Ctrl+O switches the focus
+between the panes. Terminals narrower than SPLIT_MIN_WIDTH get the modal
+view instead, isMainScreen is then the list screen.
+*/
+const (
+	LIST_PANE_WIDTH = 38
+	SPLIT_MIN_WIDTH = 100
+)
+
+// splitPane reports whether the split layout is in use.
+func splitPane(state *UIState) bool {
+	return state.split && state.width >= SPLIT_MIN_WIDTH
+}
+
+// chatShown reports whether the chat with username is on screen, in the
+// chat view or in the right pane.
+func chatShown(state *UIState, username string) bool {
+	return username != "" && state.chosenUser == username && (!state.isMainScreen || splitPane(state))
+}
+
+// chatWidth is the width of the chat view or pane.
+func chatWidth(state *UIState) int {
+	if splitPane(state) {
+		return state.width - LIST_PANE_WIDTH - 1
+	}
+	return state.width
+}
+
+// handleCtrlO moves the focus to the other pane, keeping what was typed.
+func handleCtrlO(state *UIState) bool {
+	if !splitPane(state) || state.chosenUser == "" {
+		return false
+	}
+	state.isMainScreen = !state.isMainScreen
+	return true
+}
+
+// renderSplit draws the list and the chat side by side, the hint of the
+// focused pane takes the whole last row.
+func renderSplit(w *Screen, state *UIState) {
+	w.SetRegion(0, LIST_PANE_WIDTH)
+	printUsers(w, state.unreadUsers, state.onlineUsers, state.offlineUsers, state.userPos, state.chats, state.chosenTab, LIST_PANE_WIDTH, state.height)
+	w.ResetRegion()
+	for line := 4; line < state.height; line++ {
+		fmt.Fprintf(w, CursorPos, line, LIST_PANE_WIDTH+1)
+		fmt.Fprint(w, Reset, Dim, "│", Reset)
+	}
+	w.SetRegion(LIST_PANE_WIDTH+1, chatWidth(state))
+	if state.chosenUser == "" {
+		fmt.Fprintf(w, CursorPos, 6, 2)
+		fmt.Fprint(w, Dim, "Choose a chat and press Enter", Reset)
+	} else {
+		renderChat(w, state)
+	}
+	if state.isNewChat {
+		w.SetRegion(0, LIST_PANE_WIDTH)
+		printNewChat(w, state, LIST_PANE_WIDTH, state.height)
+	}
+	w.ResetRegion()
+	hint := "← → Switch tabs   ↑ ↓ Move   Enter: Open   Ctrl+N: New chat   Ctrl+O: Chat   Ctrl+C: Quit"
+	switch {
+	case state.isNewChat:
+		hint = newChatHint()
+	case !state.isMainScreen:
+		hint = chatHint(state) + "   Ctrl+O: List"
+	}
+	fmt.Fprint(w, CursorSave)
+	fmt.Fprintf(w, CursorPos, state.height, 1)
+	fmt.Fprint(w, Reset, EraseLine, truncateToWidth(hint, state.width), Reset)
+	fmt.Fprint(w, CursorRestore)
+	if state.isMainScreen && !state.isNewChat {
+		fmt.Fprint(w, CursorHide)
+	}
+}
@@ -1,21 +1,48 @@
 package client
 
 import (
-	"encoding/json"
 	"os"
 	"path"
 
 	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
 )
 
+// ChatMessage is a chat message kept in the history, ID is the id of the
+// frame that carried it. Sealed messages are stored decrypted, or sealed
+// while they can not be decrypted.
+type ChatMessage struct {
+	ID        string `json:"id"`
+	Encrypted bool   `json:"encrypted,omitempty"`
+	// KeyChanged is set when the sender key did not match the pinned one,
+	// the content is kept in Withheld until SenderFingerprint is verified.
+	KeyChanged        bool      `json:"keyChanged,omitempty"`
+	SenderFingerprint string    `json:"senderFingerprint,omitempty"`
+	Withheld          string    `json:"withheld,omitempty"`
+	File              *FileInfo `json:"file,omitempty"`
+	Edited            bool      `json:"edited,omitempty"`
+	// Deleted messages keep their id so later edits can not revive them.
+	Deleted bool `json:"deleted,omitempty"`
+	// Reactions maps each emoji to the users who reacted with it.
+	Reactions map[string][]string `json:"reactions,omitempty"`
+	protocol.Chat
+}
+
+// ChatData is the history of one chat. PeerFingerprint is pinned the first
+// time a key of the peer is seen, Verified once the user compared it.
 type ChatData struct {
-	Unread   int                `json:"unread"`
-	Messages []protocol.Message `json:"messages"`
+	Unread          int           `json:"unread"`
+	Messages        []ChatMessage `json:"messages"`
+	Encrypted       bool          `json:"encrypted,omitempty"`
+	PeerFingerprint string        `json:"peerFingerprint,omitempty"`
+	Verified        bool          `json:"verified,omitempty"`
 }
 
+// PersistedState is the snapshot of the store, Seq is the last journal
+// record it contains.
 type PersistedState struct {
 	Username string              `json:"username"`
 	Chats    map[string]ChatData `json:"chats"`
+	Seq      uint64              `json:"seq,omitempty"`
 }
 
 func storagePath(username string) string {
@@ -23,29 +50,6 @@ func storagePath(username string) string {
 	return path.Join(homeDir, ".goChatTUIClient", username)
 }
 
-func loadState(username string) PersistedState {
-	filePath := storagePath(username)
-	state := PersistedState{
-		Username: username,
-		Chats:    make(map[string]ChatData),
-	}
-	if fileExists(filePath) {
-		content, err := os.ReadFile(filePath)
-		if err != nil {
-			writeState(state)
-			return state
-		}
-		if err = json.Unmarshal(content, &state); err != nil {
-			writeState(state)
-			return state
-		}
-		return state
-	} else {
-		writeState(state)
-		return state
-	}
-}
-
 func fileExists(filePath string) bool {
 	_, err := os.Stat(filePath)
 	if err != nil {
@@ -54,9 +58,29 @@ func fileExists(filePath string) bool {
 	return true
 }
 
-func writeState(state PersistedState) {
-	bytes, _ := json.Marshal(&state)
-	filePath := storagePath(state.Username)
-	os.MkdirAll(path.Dir(filePath), 0755)
-	os.WriteFile(filePath, bytes, 0644)
+// saveMessage and saveChat record changes of the UI state in the store,
+// compacting it once the journal grew long. A failing store ends the
+// session rather than silently losing history.
+func saveMessage(state *UIState, chat string, message ChatMessage) {
+	if state.store != nil {
+		saveWith(state, state.store.PutMessage(chat, message))
+	}
+}
+
+func saveChat(state *UIState, chat string) {
+	if state.store != nil {
+		saveWith(state, state.store.PutChat(chat, state.chats[chat]))
+	}
+}
+
+func saveWith(state *UIState, err error) {
+	if err == nil && state.store.NeedsCompaction() {
+		err = state.store.Compact(PersistedState{
+			Username: state.username, Chats: state.chats,
+		})
+	}
+	if err != nil {
+		state.storeErr = err
+		state.exit = true
+	}
 }
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
+)
+
+// QUICK_REACTION is toggled with '+' on the selected message, the picker
+// offers REACTIONS by number.
+const QUICK_REACTION = "👍"
+
+var REACTIONS = []string{"👍", "❤️", "😂", "😮", "😢", "🎉", "👀", "🙏"}
+
+// toggleReaction adds emoji to the selected message, or takes it back if the
+// local user already reacted with it.
+func toggleReaction(state *UIState, emoji string) bool {
+	message, ok := selectedMessage(state)
+	if !ok || message.Deleted {
+		return false
+	}
+	if !protocol.HasCapability(state.capabilities, protocol.CAPABILITY_REACTIONS) {
+		state.status = "the server does not support reactions"
+		return true
+	}
+	remove := slices.Contains(message.Reactions[emoji], state.username)
+	frame := protocol.NewFrame(&protocol.Reaction{
+		ToUsername:  state.chosenUser,
+		MessageFrom: message.FromUsername,
+		MessageID:   message.ID,
+		Emoji:       emoji,
+		Remove:      remove,
+	})
+	if !sendFrame(state, frame) {
+		return true
+	}
+	replaceMessage(state, state.chosenUser, applyReaction(message, state.username, emoji, remove))
+	return true
+}
+
+func handlePickerKeypress(state *UIState, event EventKeyPress) bool {
+	state.isPicking = false
+	if event.KeyType == KEY_TYPE_PRINTABLE && event.Char >= '1' && int(event.Char-'1') < len(REACTIONS) {
+		return toggleReaction(state, REACTIONS[event.Char-'1'])
+	}
+	return true
+}
+
+// applyReaction returns message with the reaction of username added or
+// removed, each user reacts at most once with the same emoji.
+func applyReaction(message ChatMessage, username, emoji string, remove bool) ChatMessage {
+	reactions := make(map[string][]string, len(message.Reactions)+1)
+	for k, v := range message.Reactions {
+		reactions[k] = v
+	}
+	users := slices.DeleteFunc(slices.Clone(reactions[emoji]), func(user string) bool {
+		return user == username
+	})
+	if !remove {
+		users = append(users, username)
+	}
+	if len(users) == 0 {
+		delete(reactions, emoji)
+	} else {
+		reactions[emoji] = users
+	}
+	if len(reactions) == 0 {
+		reactions = nil
+	}
+	message.Reactions = reactions
+	return message
+}
+
+func handleReaction(state *UIState, event *protocol.Reaction) bool {
+	message, has := findMessage(state, event.FromUsername, event.MessageFrom, event.MessageID)
+	if !has || message.Deleted {
+		return false
+	}
+	replaceMessage(state, event.FromUsername, applyReaction(message, event.FromUsername, event.Emoji, event.Remove))
+	return chatShown(state, event.FromUsername)
+}
+
+// reactionSummary lists each emoji with its count, marking the ones the
+// local user reacted with.
+func reactionSummary(reactions map[string][]string, username string) string {
+	emojis := make([]string, 0, len(reactions))
+	for emoji := range reactions {
+		emojis = append(emojis, emoji)
+	}
+	sort.Strings(emojis)
+	parts := make([]string, 0, len(emojis))
+	for _, emoji := range emojis {
+		part := emoji + " " + strconv.Itoa(len(reactions[emoji]))
+		if slices.Contains(reactions[emoji], username) {
+			part = "[" + part + "]"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, "  ")
+}
@@ -2,163 +2,389 @@ package client
 
 import (
 	"fmt"
+	"io"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// render draws the screen for state into its frame buffer and flushes the
+// changes to the terminal.
 func render(state *UIState) {
-	fmt.Print(ClearScreen, CursorHome, CursorHide)
-	printHeader(state.username)
-	if state.isMainScreen {
-		printUsers(state.unreadUsers, state.onlineUsers, state.offlineUsers, state.userPos, state.chats, state.chosenTab, state.height)
-	} else {
-		printUserName(state.chosenUser, state.activeUsers)
-		printMessages(state.username, state.chosenUser, state.currentChatData, state.height, state.messageScroll)
-		printCurrentText(state.currentText, state.height)
+	w := state.screen
+	fmt.Fprint(w, Reset, ClearScreen, CursorHome, CursorHide)
+	defer state.screen.Flush()
+	printHeader(w, state.username, state.width)
+	switch {
+	case splitPane(state):
+		renderSplit(w, state)
+	case state.isMainScreen:
+		printUsers(w, state.unreadUsers, state.onlineUsers, state.offlineUsers, state.userPos, state.chats, state.chosenTab, state.width, state.height)
+		if state.isNewChat {
+			printNewChat(w, state, state.width, state.height)
+		}
+	default:
+		renderChat(w, state)
 	}
 }
 
-const SEP = "──────────────────────────────────────────────────────"
+// renderChat draws the open chat, or its fingerprints, below the header.
+func renderChat(w io.Writer, state *UIState) {
+	width := chatWidth(state)
+	printUserName(w, state.chosenUser, state.activeUsers, state.currentChatData, state.status, width)
+	if state.isFingerprintScreen {
+		printFingerprints(w, state)
+		return
+	}
+	selected := -1
+	if state.isSelecting {
+		selected = state.selectedMessage
+	}
+	printMessages(w, state.username, layoutFor(state), visibleMessages(state), messageListHeight(state), state.messageScroll, selected, state.transfers)
+	prompt := " > "
+	switch {
+	case state.editingID != "":
+		prompt = " edit > "
+	case state.replyingTo.id != "" || state.threadRoot.id != "":
+		prompt = " reply > "
+	}
+	printCurrentText(w, state.currentText, state.cursor, width, state.height, prompt, chatHint(state))
+}
 
-func printHeader(userName string) {
-	fmt.Print(Reset, SEP)
-	fmt.Printf(CursorPos, 2, 1)
-	fmt.Print(" GoChatTUI (v1.0) - Logged in as: ", userName, Reset)
-	fmt.Printf(CursorPos, 3, 1)
-	fmt.Print(Reset, SEP)
-	fmt.Print(Reset)
+func pickerHint() string {
+	hint := ""
+	for i, emoji := range REACTIONS {
+		hint += fmt.Sprint(i+1, ": ", emoji, "  ")
+	}
+	return hint + " Esc: Cancel"
 }
 
-func printUserName(userName string, activeUsers map[string]bool) {
-	fmt.Printf(CursorPos, 4, 1)
-	fmt.Print(" Chat with - ")
+func chatHint(state *UIState) string {
+	switch {
+	case state.isPicking:
+		return pickerHint()
+	case state.isSelecting:
+		return "↑ ↓ Select   r: Reply   t: Thread   +: 👍   p: React   e: Edit   d: Delete   Esc: Back"
+	case state.editingID != "":
+		return "Enter: Save edit     Esc: Cancel"
+	case state.replyingTo.id != "":
+		return "Enter: Send reply     Esc: Cancel"
+	case state.threadRoot.id != "":
+		return "↑ ↓ Scroll   Tab: Select   Enter: Reply in thread   Esc: Back to chat"
+	case state.identity != nil:
+		return "↑ ↓ Scroll   Tab: Select   Enter: Send   Ctrl+T: Encryption   Ctrl+F: Fingerprints   Ctrl+C: Back"
+	default:
+		return "↑ ↓ Scroll chat     Tab: Select     Enter: Send     Ctrl+C: Back"
+	}
+}
+
+// separator is a line across the terminal.
+func separator(width int) string {
+	return strings.Repeat("─", max(width, 1))
+}
+
+func printHeader(w io.Writer, userName string, width int) {
+	fmt.Fprint(w, Reset, separator(width))
+	fmt.Fprintf(w, CursorPos, 2, 1)
+	fmt.Fprint(w, truncateToWidth(fmt.Sprint(" ", CLIENT_NAME, " (v", CLIENT_VERSION, ") - Logged in as: ", userName), width), Reset)
+	fmt.Fprintf(w, CursorPos, 3, 1)
+	fmt.Fprint(w, Reset, separator(width))
+	fmt.Fprint(w, Reset)
+}
+
+func printUserName(w io.Writer, userName string, activeUsers map[string]bool, data ChatData, status string, width int) {
+	fmt.Fprintf(w, CursorPos, 4, 1)
+	title := " Chat with -  ○ " + userName
 	if _, ok := activeUsers[userName]; ok {
-		fmt.Print(FgGreen, " ● ", userName)
+		fmt.Fprint(w, " Chat with - ", FgGreen, " ● ", userName)
 	} else {
-		fmt.Print(Reset, " ○ ", userName)
+		fmt.Fprint(w, " Chat with - ", Reset, " ○ ", userName)
+	}
+	if data.Encrypted {
+		tag := "  [encrypted]"
+		if data.Verified {
+			tag = "  [encrypted, verified]"
+		}
+		title += tag
+		fmt.Fprint(w, Reset, tag)
+	}
+	if status != "" {
+		fmt.Fprint(w, Reset, "  ", truncateToWidth(status, width-stringWidth(title)-2))
 	}
-	fmt.Printf(CursorPos, 5, 1)
-	fmt.Print(Reset, SEP)
+	fmt.Fprintf(w, CursorPos, 5, 1)
+	fmt.Fprint(w, Reset, separator(width))
 }
 
-func printCurrentText(currentText string, height int) {
-	fmt.Printf(CursorPos, height-3, 1)
-	fmt.Print(Reset, SEP)
-	fmt.Printf(CursorPos, height-2, 1)
+// printCurrentText prints the compose box, growing up from the bottom to at
+// most MAX_COMPOSE_ROWS rows, and leaves the terminal cursor shown at cursor.
+// Lines wider than the terminal scroll sideways with the cursor.
+func printCurrentText(w io.Writer, currentText string, cursor, width, height int, prompt, hint string) {
+	rows := composeRows(currentText)
+	top := height - 1 - rows
+	fmt.Fprintf(w, CursorPos, top-1, 1)
+	fmt.Fprint(w, Reset, separator(width))
+	fmt.Fprintf(w, CursorPos, top, 1)
 	if currentText == "" {
-		fmt.Print(" > enter message... ")
+		fmt.Fprint(w, prompt, Dim, truncateToWidth("enter message, Alt+Enter for a new line, or /send <path>... ", width-stringWidth(prompt)), Reset)
+	}
+	lines := strings.Split(currentText, "\n")
+	cursorLine := strings.Count(currentText[:cursor], "\n")
+	beforeCursor := currentText[lineStart(currentText, cursor):cursor]
+	// scroll so that the line with the cursor is shown
+	first := max(0, cursorLine-rows+1)
+	indent := strings.Repeat(" ", stringWidth(prompt))
+	available := max(1, width-stringWidth(prompt)-1)
+	for i := first; i < len(lines) && i < first+rows && currentText != ""; i++ {
+		fmt.Fprintf(w, CursorPos, top+i-first, 1)
+		if i == 0 {
+			fmt.Fprint(w, prompt)
+		} else {
+			fmt.Fprint(w, indent)
+		}
+		text := lines[i]
+		if i == cursorLine {
+			hidden := scrolledOff(beforeCursor, available)
+			text = text[len(hidden):]
+			beforeCursor = beforeCursor[len(hidden):]
+		}
+		fmt.Fprint(w, cutToWidth(text, available))
+	}
+	fmt.Fprintf(w, CursorPos, height-1, 1)
+	fmt.Fprint(w, Reset, separator(width))
+	fmt.Fprintf(w, CursorPos, height, 1)
+	fmt.Fprint(w, truncateToWidth(hint, width))
+	fmt.Fprint(w, Reset)
+	column := stringWidth(prompt) + stringWidth(beforeCursor) + 1
+	fmt.Fprintf(w, CursorPos, top+cursorLine-first, column)
+	fmt.Fprint(w, CursorShow)
+}
+
+// scrolledOff is the start of beforeCursor that is scrolled out of view to
+// keep the cursor within width cells.
+func scrolledOff(beforeCursor string, width int) string {
+	graphemes := splitGraphemes(beforeCursor)
+	shown := 0
+	for _, grapheme := range graphemes {
+		shown += graphemeWidth(grapheme)
+	}
+	hidden := 0
+	for _, grapheme := range graphemes {
+		if shown < width {
+			break
+		}
+		shown -= graphemeWidth(grapheme)
+		hidden += len(grapheme)
+	}
+	return beforeCursor[:hidden]
+}
+
+// printFingerprints shows both fingerprints so the users can compare them
+// over another channel.
+func printFingerprints(w io.Writer, state *UIState) {
+	data := state.currentChatData
+	fmt.Fprintf(w, CursorPos, 6, 1)
+	fmt.Fprint(w, Reset, " Your fingerprint:")
+	fmt.Fprintf(w, CursorPos, 7, 1)
+	fmt.Fprint(w, Bold, "   ", state.identity.Bundle.Fingerprint(), Reset)
+	fmt.Fprintf(w, CursorPos, 9, 1)
+	fmt.Fprint(w, " Fingerprint of ", state.chosenUser, ":")
+	fmt.Fprintf(w, CursorPos, 10, 1)
+	if data.PeerFingerprint == "" {
+		fmt.Fprint(w, "   unknown")
 	} else {
-		fmt.Print(" > ", currentText)
+		fmt.Fprint(w, Bold, "   ", data.PeerFingerprint, Reset)
+	}
+	if bundle, has := state.peerKeys[state.chosenUser]; has {
+		if current := bundle.Fingerprint(); current != data.PeerFingerprint {
+			fmt.Fprintf(w, CursorPos, 12, 1)
+			fmt.Fprint(w, FgRed, " The server now has a different key:", Reset)
+			fmt.Fprintf(w, CursorPos, 13, 1)
+			fmt.Fprint(w, Bold, "   ", current, Reset)
+		}
 	}
-	fmt.Printf(CursorPos, height-1, 1)
-	fmt.Print(Reset, SEP)
-	fmt.Printf(CursorPos, height, 1)
-	fmt.Print("↑ ↓ Scroll chat     Enter: Send     Ctrl+C: Back")
-	fmt.Print(Reset)
+	fmt.Fprintf(w, CursorPos, 15, 1)
+	if data.Verified {
+		fmt.Fprint(w, FgGreen, " Verified", Reset)
+	} else {
+		fmt.Fprint(w, " Not verified, compare the fingerprints with ", state.chosenUser, " in person or over a call.")
+	}
+	fmt.Fprintf(w, CursorPos, state.height, 1)
+	fmt.Fprint(w, Reset, "Enter: Mark verified     Ctrl+C: Back")
 }
 
 const FIXED = 9
 
-func printUsers(unreadUsers, onlineUsers, offlineUsers []string, userPos int, messages map[string]ChatData, chosenTab, height int) {
+func printUsers(w io.Writer, unreadUsers, onlineUsers, offlineUsers []string, userPos int, messages map[string]ChatData, chosenTab, width, height int) {
 	line := 4
-	fmt.Printf(CursorPos, line, 1)
-	switch chosenTab {
-	case 0:
-		fmt.Print(" [ Unread ]   Online     Offline")
-	case 1:
-		fmt.Print("   Unread   [ Online ]   Offline")
-	default:
-		fmt.Print("   Unread     Online   [ Offline ]")
+	fmt.Fprintf(w, CursorPos, line, 1)
+	// the unread badge counts messages in every chat, whichever tab is open
+	unread := 0
+	for _, v := range unreadUsers {
+		unread += messages[v].Unread
+	}
+	tabs := []string{"Unread", "Online", "Offline"}
+	if unread > 0 {
+		tabs[0] += " " + strconv.Itoa(unread)
+	}
+	for i, tab := range tabs {
+		if i == min(chosenTab, len(tabs)-1) {
+			fmt.Fprint(w, " [ ", tab, " ]")
+		} else {
+			fmt.Fprint(w, "   ", tab, "  ")
+		}
 	}
 	line = 5
-	fmt.Printf(CursorPos, line, 1)
-	fmt.Print(Reset, SEP)
+	fmt.Fprintf(w, CursorPos, line, 1)
+	fmt.Fprint(w, Reset, separator(width))
 	line = 6
-	fmt.Printf(CursorPos, line, 1)
+	fmt.Fprintf(w, CursorPos, line, 1)
 
 	if chosenTab == 0 {
 		for pos, v := range unreadUsers {
-			fmt.Print(Reset)
+			fmt.Fprint(w, Reset)
 			if pos == userPos {
-				fmt.Printf(CursorPos, line, 1)
-				fmt.Print(Bold, "▶ ")
+				fmt.Fprintf(w, CursorPos, line, 1)
+				fmt.Fprint(w, Bold, "▶ ")
 			} else {
-				fmt.Printf(CursorPos, line, 3)
+				fmt.Fprintf(w, CursorPos, line, 3)
 			}
-			fmt.Print(v)
-			fmt.Printf(CursorPos, line, 12)
-			fmt.Print("(", messages[v].Unread, ")")
+			fmt.Fprint(w, v)
+			fmt.Fprintf(w, CursorPos, line, 12)
+			fmt.Fprint(w, "(", messages[v].Unread, ")")
 			line++
 		}
 	}
 
 	if chosenTab == 1 {
 		for pos, v := range onlineUsers {
-			fmt.Print(Reset)
+			fmt.Fprint(w, Reset)
 			if pos == userPos {
-				fmt.Printf(CursorPos, line, 1)
-				fmt.Print(Bold, "▶ ")
+				fmt.Fprintf(w, CursorPos, line, 1)
+				fmt.Fprint(w, Bold, "▶ ")
 			} else {
-				fmt.Printf(CursorPos, line, 3)
+				fmt.Fprintf(w, CursorPos, line, 3)
 			}
 			line++
-			fmt.Print(v)
+			fmt.Fprint(w, v)
 		}
 	}
 
 	if chosenTab == 2 {
 		for pos, v := range offlineUsers {
-			fmt.Print(Reset)
+			fmt.Fprint(w, Reset)
 			if pos == userPos {
-				fmt.Printf(CursorPos, line, 1)
-				fmt.Print(Bold, "▶ ")
+				fmt.Fprintf(w, CursorPos, line, 1)
+				fmt.Fprint(w, Bold, "▶ ")
 			} else {
-				fmt.Printf(CursorPos, line, 3)
+				fmt.Fprintf(w, CursorPos, line, 3)
 			}
 			line++
-			fmt.Print(v)
+			fmt.Fprint(w, v)
 		}
 	}
 
-	fmt.Printf(CursorPos, height, 1)
-	fmt.Print(Reset, "← → Switch tabs     ↑ ↓ Move     Enter: Open     Ctrl+C: Quit")
+	fmt.Fprintf(w, CursorPos, height, 1)
+	fmt.Fprint(w, Reset, truncateToWidth("← → Switch tabs     ↑ ↓ Move     Enter: Open     Ctrl+N: New chat     Ctrl+C: Quit", width))
 }
 
-func printMessages(userName, chosenUser string, data ChatData, height, messageScroll int) {
+// printMessages prints messages, rows rows of the chat starting at
+// messageScroll. A message can take several rows, see chatLayout.
+func printMessages(w io.Writer, userName string, layout chatLayout, messages []ChatMessage, rows, messageScroll, selected int, transfers map[string]*transfer) {
 	line := 6
+	lastLine := line + rows
 	start := messageScroll
-	end := min(len(data.Messages), messageScroll+(height-FIXED))
-	unamePad := max(3, len(chosenUser)) - 3
-	youPad := false
-	if len(chosenUser) <= 3 {
-		youPad = false
-		unamePad = 3 - len(chosenUser)
-	} else {
-		youPad = true
-		unamePad = len(chosenUser) - 3
-	}
-
-	for curr := start; curr < end; curr++ {
-		v := data.Messages[curr]
-		fmt.Print(Reset)
-		fmt.Printf(CursorPos, line, 1)
-		line++
-		v.Timestamp.Format(time.RFC822)
+	// the first message is shown even when it is taller than the view, cut
+	// at the bottom
+	for curr := start; curr < len(messages) && (curr == start || line+layout.rows(messages[curr]) <= lastLine); curr++ {
+		v := messages[curr]
+		fmt.Fprint(w, Reset)
+		if v.ReplyTo != "" {
+			fmt.Fprintf(w, CursorPos, line, 1)
+			fmt.Fprint(w, Dim, "    ┌ ", truncateToWidth(quoteOf(layout.all, parentOf(v)), layout.width-6), Reset)
+			line++
+		}
+		if line >= lastLine {
+			break
+		}
+		fmt.Fprintf(w, CursorPos, line, 1)
+		if curr == selected {
+			fmt.Fprint(w, Reverse)
+		}
 		if v.FromUsername == userName {
-			fmt.Print(FgGreen, v.Timestamp.Format(time.DateOnly+" "+time.TimeOnly), " ", "you")
-			if youPad {
-				for i := 0; i < unamePad; i++ {
-					fmt.Print(" ")
-				}
-			}
-			fmt.Print(": ", Reset, v.Content)
+			fmt.Fprint(w, FgGreen, v.Timestamp.Format(time.DateTime), " ", padToWidth("you", layout.nameWidth))
 		} else {
-			fmt.Print(FgRed, v.Timestamp.Format(time.DateOnly+" "+time.TimeOnly), " ", v.FromUsername)
-			if !youPad {
-				for i := 0; i < unamePad; i++ {
-					fmt.Print(" ")
-				}
-			}
-			fmt.Print(": ", Reset, v.Content)
+			fmt.Fprint(w, FgRed, v.Timestamp.Format(time.DateTime), " ", padToWidth(v.FromUsername, layout.nameWidth))
 		}
+		fmt.Fprint(w, ": ", Reset)
+		lines := layout.bodyLines(v)
+		lines = lines[:min(len(lines), lastLine-line)]
+		printContent(w, v, lines, transfers, line, layout)
+		line += len(lines)
+		if replies := replyCount(layout.all, v); replies > 0 {
+			fmt.Fprint(w, Dim, " [", replies, " replies]", Reset)
+		}
+		if len(v.Reactions) > 0 && line < lastLine {
+			fmt.Fprintf(w, CursorPos, line, 1)
+			fmt.Fprint(w, "      ", truncateToWidth(reactionSummary(v.Reactions, userName), layout.width-6))
+			line++
+		}
+	}
+}
+
+// printContent prints the body of message, laid out in lines. The first
+// line goes where the cursor is, the others below it at the body column.
+func printContent(w io.Writer, message ChatMessage, lines []string, transfers map[string]*transfer, line int, layout chatLayout) {
+	if message.Deleted {
+		fmt.Fprint(w, Dim, "message deleted", Reset)
+		return
+	}
+	if message.File != nil {
+		printFile(w, message, transfers, layout.width-layout.firstColumn+1)
+		return
+	}
+	if message.KeyChanged {
+		fmt.Fprint(w, FgRed, KEY_CHANGED_MARK, Reset)
+	}
+	if message.Encrypted {
+		fmt.Fprint(w, ENCRYPTED_MARK)
+	}
+	for i, text := range lines {
+		if i > 0 {
+			fmt.Fprintf(w, CursorPos, line+i, layout.column)
+		}
+		fmt.Fprint(w, text)
+	}
+	if message.Edited {
+		fmt.Fprint(w, Dim, EDITED_MARK, Reset)
+	}
+}
+
+const PROGRESS_WIDTH = 20
+
+// printFile prints the row of a file transfer, shortening the name and the
+// path to fit in width cells.
+func printFile(w io.Writer, message ChatMessage, transfers map[string]*transfer, width int) {
+	file := message.File
+	name := truncateToWidth(sanitizeText(file.Name), max(8, width-40))
+	fmt.Fprint(w, "📎 ", name, " (", formatSize(file.Size), ") ")
+	progress, active := fileProgress(transfers, message.ID)
+	switch {
+	case file.Status == FILE_STATUS_ACCEPTED && active:
+		filled := progress * PROGRESS_WIDTH / 100
+		fmt.Fprint(w, "[", strings.Repeat("#", filled), strings.Repeat("-", PROGRESS_WIDTH-filled), "] ", progress, "%")
+	case file.Status == FILE_STATUS_DONE:
+		fmt.Fprint(w, FgGreen, "done", Reset)
+		if file.Path != "" {
+			fmt.Fprint(w, " ", truncateToWidth(sanitizeText(file.Path), max(8, width-stringWidth(name)-24)))
+		}
+	case file.Status == FILE_STATUS_DECLINED:
+		fmt.Fprint(w, "declined")
+	case file.Status == FILE_STATUS_FAILED:
+		fmt.Fprint(w, FgRed, "failed", Reset)
+	case !active:
+		// offered or accepted by a previous session
+		fmt.Fprint(w, FgRed, "interrupted", Reset)
+	default:
+		fmt.Fprint(w, "offered")
 	}
 }
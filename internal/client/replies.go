@@ -0,0 +1,128 @@
+package client
+
+import (
+	"slices"
+	"strings"
+)
+
+// QUOTE_LENGTH is how many cells of the parent a reply quotes.
+const QUOTE_LENGTH = 48
+
+// messageRef names a message by its sender and id, ids are chosen by the
+// sender so only both together are unique.
+type messageRef struct {
+	from string
+	id   string
+}
+
+func refOf(message ChatMessage) messageRef {
+	return messageRef{from: message.FromUsername, id: message.ID}
+}
+
+// parentOf is the message replied to. History from before replies named
+// the sender of the parent has no from, it matches a parent from either
+// user.
+func parentOf(message ChatMessage) messageRef {
+	return messageRef{from: message.ReplyToFrom, id: message.ReplyTo}
+}
+
+func (r messageRef) matches(message ChatMessage) bool {
+	return r.id != "" && r.id == message.ID && (r.from == "" || r.from == message.FromUsername)
+}
+
+func selectedMessage(state *UIState) (ChatMessage, bool) {
+	messages := visibleMessages(state)
+	if state.selectedMessage < 0 || state.selectedMessage >= len(messages) {
+		return ChatMessage{}, false
+	}
+	return messages[state.selectedMessage], true
+}
+
+func startReply(state *UIState) bool {
+	message, ok := selectedMessage(state)
+	if !ok || message.Deleted {
+		return false
+	}
+	state.isSelecting = false
+	state.editingID = ""
+	state.replyingTo = refOf(message)
+	return true
+}
+
+// openThread narrows the chat view to the selected message and every reply
+// below it, Enter then replies to the thread.
+func openThread(state *UIState) bool {
+	message, ok := selectedMessage(state)
+	if !ok {
+		return false
+	}
+	state.isSelecting = false
+	state.threadRoot = refOf(message)
+	state.messageScroll = 0
+	updateChatScroll(state, 0)
+	return true
+}
+
+func closeThread(state *UIState) {
+	state.threadRoot = messageRef{}
+	state.isSelecting = false
+	updateChatScroll(state, 0)
+}
+
+// visibleMessages are the messages shown in the chat view, the whole chat
+// or only the open thread.
+func visibleMessages(state *UIState) []ChatMessage {
+	if state.threadRoot.id == "" {
+		return state.currentChatData.Messages
+	}
+	return threadMessages(state.currentChatData.Messages, state.threadRoot)
+}
+
+// threadMessages returns root followed by its direct and indirect replies,
+// in the order they were received.
+func threadMessages(messages []ChatMessage, root messageRef) []ChatMessage {
+	thread := []ChatMessage{}
+	for _, message := range messages {
+		if root.matches(message) || slices.ContainsFunc(thread, parentOf(message).matches) {
+			thread = append(thread, message)
+		}
+	}
+	return thread
+}
+
+// replyCount is the number of direct replies to parent.
+func replyCount(messages []ChatMessage, parent ChatMessage) int {
+	count := 0
+	for _, message := range messages {
+		if parentOf(message).matches(parent) {
+			count++
+		}
+	}
+	return count
+}
+
+func findInMessages(messages []ChatMessage, ref messageRef) (ChatMessage, bool) {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if ref.matches(messages[i]) {
+			return messages[i], true
+		}
+	}
+	return ChatMessage{}, false
+}
+
+// quoteOf is the one line summary of a parent shown above its replies.
+func quoteOf(messages []ChatMessage, ref messageRef) string {
+	parent, has := findInMessages(messages, ref)
+	if !has {
+		return "message not available"
+	}
+	content := parent.Content
+	switch {
+	case parent.Deleted:
+		content = "message deleted"
+	case parent.File != nil:
+		content = "📎 " + parent.File.Name
+	}
+	content = strings.ReplaceAll(sanitizeText(content), "\n", " ")
+	return parent.FromUsername + ": " + truncateToWidth(content, QUOTE_LENGTH)
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package client
+
+import "os"
+
+// notifyResize is not available without SIGWINCH, the size is polled.
+func notifyResize() (<-chan os.Signal, bool) {
+	return nil, false
+}
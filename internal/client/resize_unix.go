@@ -0,0 +1,16 @@
+//go:build unix
+
+package client
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyResize delivers SIGWINCH, sent when the terminal is resized.
+func notifyResize() (<-chan os.Signal, bool) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGWINCH)
+	return signals, true
+}
@@ -0,0 +1,410 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// synchronized updates: the terminal shows what is written between
+	// these at once, see querySynchronizedUpdates
+	SYNC_BEGIN = ESC + "[?2026h"
+	SYNC_END   = ESC + "[?2026l"
+
+	EraseLine = ESC + "[K"
+
+	// MAX_CURSOR_SKIP is how many unchanged cells are written again rather
+	// than moving the cursor past them.
+	MAX_CURSOR_SKIP = 4
+)
+
+// style is what SGR sets for a cell, colors are SGR codes and 0 the default.
+type style struct {
+	fg, bg    int
+	bold      bool
+	dim       bool
+	underline bool
+	reverse   bool
+}
+
+func (s style) sgr() string {
+	params := []string{"0"}
+	if s.bold {
+		params = append(params, "1")
+	}
+	if s.dim {
+		params = append(params, "2")
+	}
+	if s.underline {
+		params = append(params, "4")
+	}
+	if s.reverse {
+		params = append(params, "7")
+	}
+	if s.fg != 0 {
+		params = append(params, strconv.Itoa(s.fg))
+	}
+	if s.bg != 0 {
+		params = append(params, strconv.Itoa(s.bg))
+	}
+	return ESC + "[" + strings.Join(params, ";") + "m"
+}
+
+// apply changes s as the SGR sequence with params would.
+func (s style) apply(params []int) style {
+	if len(params) == 0 {
+		return style{}
+	}
+	for _, param := range params {
+		switch {
+		case param == 0:
+			s = style{}
+		case param == 1:
+			s.bold = true
+		case param == 2:
+			s.dim = true
+		case param == 22:
+			s.bold, s.dim = false, false
+		case param == 4:
+			s.underline = true
+		case param == 24:
+			s.underline = false
+		case param == 7:
+			s.reverse = true
+		case param == 27:
+			s.reverse = false
+		case param >= 30 && param <= 37, param >= 90 && param <= 97:
+			s.fg = param
+		case param == 39:
+			s.fg = 0
+		case param >= 40 && param <= 47, param >= 100 && param <= 107:
+			s.bg = param
+		case param == 49:
+			s.bg = 0
+		}
+	}
+	return s
+}
+
+// cell is one terminal cell. A wide grapheme takes its cell and the next,
+// which is left with width 0.
+type cell struct {
+	text  string
+	width int
+	style style
+}
+
+var blankCell = cell{text: " ", width: 1}
+
+/*
+Screen is the frame buffer between the renderer and the terminal. The
+renderer writes a frame into it with the escape codes of terminal.go, Flush
+then compares the frame with the one before, cell by cell, and writes out
+only what changed. It understands:
+
+	ESC [ row ; col H     cursor position
+	ESC [ n A/B/C/D       cursor movement
+	ESC [ n J, ESC [ n K  erase screen, erase line
+	ESC [ ... m           text styles and colors
+	ESC [ ? 25 h/l        show and hide the cursor
+	ESC 7, ESC 8          save and restore the cursor position
+	\r \n                 carriage return, line feed
+
+Text past the right edge is clipped, never wrapped. A pane is drawn by
+setting a region first, columns are then counted from its left edge and
+nothing is drawn outside of it.
+*/
+type Screen struct {
+	out           io.Writer
+	width, height int
+	front, back   []cell
+	// where the renderer is writing, left and right bound the region
+	row, col    int
+	left, right int
+	// saved by ESC 7, restored by ESC 8
+	savedRow, savedCol int
+	pen                style
+	cursorVisible      bool
+	// an escape sequence or a rune cut in two by Write
+	pending []byte
+	// synchronized is set when the terminal supports synchronized updates,
+	// invalid when it has to be redrawn from scratch
+	synchronized bool
+	invalid      bool
+}
+
+func NewScreen(out io.Writer, width, height int, synchronized bool) *Screen {
+	screen := &Screen{out: out, synchronized: synchronized}
+	screen.Resize(width, height)
+	return screen
+}
+
+// Resize changes the size of the frame, the next Flush redraws everything.
+func (s *Screen) Resize(width, height int) {
+	s.width, s.height = max(width, 1), max(height, 1)
+	s.front = make([]cell, s.width*s.height)
+	s.back = make([]cell, s.width*s.height)
+	s.erase(s.back, 0, len(s.back))
+	s.row, s.col = 0, 0
+	s.ResetRegion()
+	s.invalid = true
+}
+
+// SetRegion limits drawing to width columns from left, counting from 0.
+func (s *Screen) SetRegion(left, width int) {
+	s.left = max(0, min(left, s.width-1))
+	s.right = max(s.left+1, min(left+width, s.width))
+}
+
+func (s *Screen) ResetRegion() {
+	s.SetRegion(0, s.width)
+}
+
+// eraseRow erases the region of row from column from to column to.
+func (s *Screen) eraseRow(row, from, to int) {
+	start := row * s.width
+	s.erase(s.back, start+max(from, s.left), start+min(to, s.right))
+}
+
+func (s *Screen) erase(cells []cell, from, to int) {
+	for i := from; i < to; i++ {
+		cells[i] = cell{text: " ", width: 1, style: style{bg: s.pen.bg}}
+	}
+}
+
+func (s *Screen) Write(p []byte) (int, error) {
+	data := append(s.pending, p...)
+	s.pending = nil
+	for len(data) > 0 {
+		switch {
+		case data[0] == KEY_ESC:
+			n := s.escape(data)
+			if n == 0 {
+				s.pending = append([]byte{}, data...)
+				return len(p), nil
+			}
+			data = data[n:]
+		case data[0] == '\r':
+			s.col = s.left
+			data = data[1:]
+		case data[0] == '\n':
+			s.row = min(s.row+1, s.height-1)
+			data = data[1:]
+		case data[0] < 0x20 || data[0] == 0x7F:
+			data = data[1:]
+		default:
+			end := 0
+			for end < len(data) && data[end] >= 0x20 && data[end] != 0x7F {
+				end++
+			}
+			text := data[:end]
+			// keep a rune cut by the end of p for the next Write
+			if end == len(data) {
+				for cut := len(text) - 1; cut >= 0 && cut >= len(text)-utf8.UTFMax; cut-- {
+					if utf8.RuneStart(text[cut]) {
+						if !utf8.FullRune(text[cut:]) {
+							s.pending = append([]byte{}, text[cut:]...)
+							text = text[:cut]
+						}
+						break
+					}
+				}
+			}
+			s.text(string(text))
+			data = data[end:]
+		}
+	}
+	return len(p), nil
+}
+
+// escape interprets the escape sequence data starts with and returns its
+// length, 0 when data ends before the sequence does.
+func (s *Screen) escape(data []byte) int {
+	if len(data) < 2 {
+		return 0
+	}
+	if data[1] != '[' {
+		switch data[1] {
+		case '7':
+			s.savedRow, s.savedCol = s.row, s.col
+		case '8':
+			s.row, s.col = s.savedRow, s.savedCol
+		}
+		return 2
+	}
+	end := 2
+	for end < len(data) && (data[end] < 0x40 || data[end] > 0x7E) {
+		end++
+	}
+	if end == len(data) {
+		return 0
+	}
+	body := string(data[2:end])
+	private := strings.HasPrefix(body, "?")
+	params := []int{}
+	for _, param := range strings.Split(strings.TrimPrefix(body, "?"), ";") {
+		if param == "" {
+			continue
+		}
+		n, _ := strconv.Atoi(param)
+		params = append(params, n)
+	}
+	param := func(i, fallback int) int {
+		if i < len(params) && params[i] > 0 {
+			return params[i]
+		}
+		return fallback
+	}
+	switch data[end] {
+	case 'H', 'f':
+		s.row = min(param(0, 1), s.height) - 1
+		s.col = s.left + min(param(1, 1), s.right-s.left) - 1
+	case 'A':
+		s.row = max(s.row-param(0, 1), 0)
+	case 'B':
+		s.row = min(s.row+param(0, 1), s.height-1)
+	case 'C':
+		s.col = min(s.col+param(0, 1), s.right-1)
+	case 'D':
+		s.col = max(s.col-param(0, 1), s.left)
+	case 'J':
+		mode := param(0, 0)
+		for row := 0; row < s.height; row++ {
+			switch {
+			case mode == 0 && row == s.row:
+				s.eraseRow(row, s.col, s.width)
+			case mode == 1 && row == s.row:
+				s.eraseRow(row, 0, s.col+1)
+			case mode == 2, mode == 0 && row > s.row, mode == 1 && row < s.row:
+				s.eraseRow(row, 0, s.width)
+			}
+		}
+	case 'K':
+		switch param(0, 0) {
+		case 0:
+			s.eraseRow(s.row, s.col, s.width)
+		case 1:
+			s.eraseRow(s.row, 0, s.col+1)
+		default:
+			s.eraseRow(s.row, 0, s.width)
+		}
+	case 'm':
+		s.pen = s.pen.apply(params)
+	case 'h', 'l':
+		if private && param(0, 0) == 25 {
+			s.cursorVisible = data[end] == 'h'
+		}
+	}
+	return end + 1
+}
+
+// text puts text at the cursor, clipping it at the right edge.
+func (s *Screen) text(text string) {
+	for _, grapheme := range splitGraphemes(text) {
+		width := graphemeWidth(grapheme)
+		i := s.row*s.width + s.col
+		if width == 0 {
+			// a mark without a base joins the cell before
+			if s.col > s.left {
+				s.back[i-1].text += grapheme
+			}
+			continue
+		}
+		if s.col+width > s.right {
+			s.col = s.right
+			return
+		}
+		// do not leave half of a wide cell behind
+		if s.back[i].width == 0 && s.col > 0 {
+			s.erase(s.back, i-1, i)
+		}
+		if end := i + width; end < s.row*s.width+s.width && s.back[end].width == 0 {
+			s.erase(s.back, end, end+1)
+		}
+		s.back[i] = cell{text: grapheme, width: width, style: s.pen}
+		if width == 2 {
+			s.back[i+1] = cell{width: 0, style: s.pen}
+		}
+		s.col += width
+	}
+}
+
+func isBlank(c cell) bool {
+	return c == blankCell
+}
+
+// Flush writes the changes since the last Flush to the terminal.
+func (s *Screen) Flush() error {
+	var b bytes.Buffer
+	if s.synchronized {
+		b.WriteString(SYNC_BEGIN)
+	}
+	b.WriteString(CursorHide)
+	if s.invalid {
+		b.WriteString(Reset + ClearScreen)
+		s.erase(s.front, 0, len(s.front))
+		s.invalid = false
+	}
+	pen := style{}
+	cursorRow, cursorCol := -1, -1
+	put := func(i int) {
+		if s.back[i].style != pen {
+			pen = s.back[i].style
+			b.WriteString(pen.sgr())
+		}
+		b.WriteString(s.back[i].text)
+		cursorCol += s.back[i].width
+	}
+	for row := 0; row < s.height; row++ {
+		start := row * s.width
+		// from tail on the row is blank
+		tail := s.width
+		for tail > 0 && isBlank(s.back[start+tail-1]) {
+			tail--
+		}
+		for col := 0; col < tail; col++ {
+			i := start + col
+			if s.back[i] == s.front[i] || s.back[i].width == 0 {
+				continue
+			}
+			if cursorRow == row && col > cursorCol && col-cursorCol <= MAX_CURSOR_SKIP {
+				for cursorCol < col {
+					put(start + cursorCol)
+				}
+			} else if cursorRow != row || cursorCol != col {
+				fmt.Fprintf(&b, CursorPos, row+1, col+1)
+				cursorRow, cursorCol = row, col
+			}
+			put(i)
+		}
+		for col := tail; col < s.width; col++ {
+			if !isBlank(s.front[start+col]) {
+				if cursorRow != row || cursorCol != tail {
+					fmt.Fprintf(&b, CursorPos, row+1, tail+1)
+					cursorRow, cursorCol = row, tail
+				}
+				if pen != (style{}) {
+					pen = style{}
+					b.WriteString(Reset)
+				}
+				b.WriteString(EraseLine)
+				break
+			}
+		}
+	}
+	copy(s.front, s.back)
+	b.WriteString(Reset)
+	if s.cursorVisible {
+		fmt.Fprintf(&b, CursorPos, s.row+1, s.col+1)
+		b.WriteString(CursorShow)
+	}
+	if s.synchronized {
+		b.WriteString(SYNC_END)
+	}
+	_, err := s.out.Write(b.Bytes())
+	return err
+}
@@ -0,0 +1,116 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// flushed draws frame on screen and returns what Flush wrote.
+func flushed(t *testing.T, screen *Screen, out *bytes.Buffer, frame string) string {
+	t.Helper()
+	out.Reset()
+	fmt.Fprint(screen, frame)
+	if err := screen.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func at(row, col int) string {
+	return fmt.Sprintf(CursorPos, row, col)
+}
+
+func TestScreenWritesOnlyChanges(t *testing.T) {
+	var out bytes.Buffer
+	screen := NewScreen(&out, 20, 3, false)
+	frame := ClearScreen + at(1, 1) + "hello world" + at(3, 1) + "status"
+	if first := flushed(t, screen, &out, frame); !strings.Contains(first, ClearScreen) || !strings.Contains(first, "hello world") {
+		t.Fatalf("first frame %q", first)
+	}
+
+	tests := []struct {
+		name  string
+		frame string
+		want  string
+	}{
+		{"unchanged", frame, CursorHide + Reset},
+		{
+			"one cell",
+			ClearScreen + at(1, 1) + "hello World" + at(3, 1) + "status",
+			CursorHide + at(1, 7) + "W" + Reset,
+		},
+		{
+			// the cells between are written again, cheaper than a move
+			"close changes",
+			ClearScreen + at(1, 1) + "Hello World" + at(3, 1) + "status",
+			CursorHide + at(1, 1) + "H" + Reset,
+		},
+		{
+			"changes on one row",
+			ClearScreen + at(1, 1) + "Hallo Wurld" + at(3, 1) + "status",
+			CursorHide + at(1, 2) + "a" + at(1, 8) + "u" + Reset,
+		},
+		{
+			"nearby changes",
+			ClearScreen + at(1, 1) + "Hella Wurld" + at(3, 1) + "status",
+			CursorHide + at(1, 2) + "ella" + Reset,
+		},
+		{
+			"shorter line",
+			ClearScreen + at(1, 1) + "Hella" + at(3, 1) + "status",
+			CursorHide + at(1, 6) + EraseLine + Reset,
+		},
+		{
+			"new row",
+			ClearScreen + at(1, 1) + "Hella" + at(2, 3) + "x" + at(3, 1) + "status",
+			CursorHide + at(2, 3) + "x" + Reset,
+		},
+		{
+			"style",
+			ClearScreen + at(1, 1) + "Hella" + at(2, 3) + "x" + at(3, 1) + Bold + "status" + Reset,
+			CursorHide + at(3, 1) + ESC + "[0;1mstatus" + Reset,
+		},
+		{
+			"cursor shown",
+			ClearScreen + at(1, 1) + "Hella" + at(2, 3) + "x" + at(3, 1) + Bold + "status" + Reset + at(2, 4) + CursorShow,
+			CursorHide + Reset + at(2, 4) + CursorShow,
+		},
+	}
+	for _, test := range tests {
+		if got := flushed(t, screen, &out, test.frame); got != test.want {
+			t.Fatalf("%s: wrote %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestScreenWideCells(t *testing.T) {
+	var out bytes.Buffer
+	screen := NewScreen(&out, 10, 1, false)
+	flushed(t, screen, &out, at(1, 1)+"日本")
+	// writing over the second half of a wide cell blanks its first half
+	got := flushed(t, screen, &out, at(1, 1)+"日本"+at(1, 2)+"x")
+	if got != CursorHide+at(1, 1)+" x"+Reset {
+		t.Fatalf("wrote %q", got)
+	}
+	// clipped at the right edge, never wrapped
+	got = flushed(t, screen, &out, ClearScreen+at(1, 8)+"日本")
+	if got != CursorHide+at(1, 2)+"      日"+Reset {
+		t.Fatalf("wrote %q", got)
+	}
+}
+
+func TestScreenSynchronizedUpdates(t *testing.T) {
+	var out bytes.Buffer
+	for _, synchronized := range []bool{false, true} {
+		screen := NewScreen(&out, 10, 2, synchronized)
+		for _, frame := range []string{at(1, 1) + "one", at(1, 1) + "two", at(1, 1) + "two"} {
+			got := flushed(t, screen, &out, ClearScreen+frame)
+			wrapped := strings.HasPrefix(got, SYNC_BEGIN) && strings.HasSuffix(got, SYNC_END)
+			if wrapped != synchronized || strings.Count(got, "\x1b[?2026") != 2*strings.Count(got, SYNC_BEGIN) {
+				t.Fatalf("synchronized %v: wrote %q", synchronized, got)
+			}
+		}
+	}
+}
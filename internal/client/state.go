@@ -1,18 +1,18 @@
 package client
 
 import (
-	"os"
+	"io"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
-	"github.com/gorilla/websocket"
-	"golang.org/x/term"
 )
 
 type UIState struct {
 	username        string
-	conn            *websocket.Conn
+	conn            Conn
+	capabilities    []string
 	isMainScreen    bool
 	unreadUsers     []string
 	onlineUsers     []string
@@ -20,21 +20,48 @@ type UIState struct {
 	userPos         int
 	chats           map[string]ChatData
 	chosenTab       int
+	screen          *Screen
+	width           int
 	height          int
 	chosenUser      string
 	activeUsers     map[string]bool
 	currentChatData ChatData
 	messageScroll   int
 	currentText     string
+	cursor          int // byte offset into currentText, see editor.go
+	killed          string
 	exit            bool
+	// identity is nil when the server does not support e2e.
+	identity            *Identity
+	peerKeys            map[string]protocol.KeyBundle
+	isFingerprintScreen bool
+	status              string
+	store               *Store
+	storeErr            error
+	transfers           map[string]*transfer
+	isSelecting         bool
+	selectedMessage     int
+	editingID           string
+	replyingTo          messageRef
+	threadRoot          messageRef
+	isPicking           bool
+	// split shows the list next to the open chat on wide terminals
+	split bool
+	// the new chat prompt, see newchat.go
+	isNewChat    bool
+	newChatText  string
+	newChatError string
+	// now stamps sent messages, the harness fixes it
+	now func() time.Time
 }
 
-func NewUIState(username string, conn *websocket.Conn) *UIState {
-	_, h, _ := term.GetSize(int(os.Stdin.Fd()))
-	persistedState := loadState(username)
+// NewUIState returns the state of a client drawing a w by h screen on out.
+// Without a store history is only kept in memory.
+func NewUIState(username string, conn Conn, capabilities []string, store *Store, persistedState PersistedState, out io.Writer, w, h int) *UIState {
 	state := &UIState{
 		username:        username,
 		conn:            conn,
+		capabilities:    capabilities,
 		unreadUsers:     []string{},
 		onlineUsers:     []string{},
 		offlineUsers:    []string{},
@@ -47,28 +74,89 @@ func NewUIState(username string, conn *websocket.Conn) *UIState {
 		currentText:     "",
 		currentChatData: ChatData{},
 		chosenTab:       0,
+		screen:          NewScreen(out, w, h, synchronizedUpdates),
+		width:           w,
 		height:          h,
 		exit:            false,
+		peerKeys:        make(map[string]protocol.KeyBundle),
+		store:           store,
+		transfers:       make(map[string]*transfer),
+		now:             time.Now,
+	}
+	if state.chats == nil {
+		state.chats = make(map[string]ChatData)
+	}
+	if protocol.HasCapability(capabilities, protocol.CAPABILITY_E2E) {
+		identity, err := loadIdentity(username)
+		if err != nil {
+			state.status = "encryption unavailable: " + err.Error()
+		}
+		state.identity = identity
+	}
+	if state.identity != nil {
+		openPendingMessages(state)
 	}
 	return state
 }
 
-func handleResize(state *UIState, newHeight int) bool {
-	state.height = newHeight
+// publishKeys uploads the public half of the identity to the server key
+// directory.
+func publishKeys(state *UIState) error {
+	if state.identity == nil {
+		return nil
+	}
+	return writeFrame(state.conn, protocol.NewFrame(&protocol.PublishKeys{
+		Bundle: state.identity.Bundle,
+	}))
+}
+
+func requestKeys(state *UIState, username string) {
+	if state.identity == nil {
+		return
+	}
+	writeFrame(state.conn, protocol.NewFrame(&protocol.RequestKeys{
+		Username: username,
+	}))
+}
+
+func handleResize(state *UIState, event EventResize) bool {
+	atBottom := chatAtBottom(state)
+	state.width = event.Width
+	state.height = event.Height
+	state.screen.Resize(event.Width, event.Height)
+	keepChatScroll(state, atBottom)
 	return true
 }
 
-func handleWSMessage(state *UIState, event protocol.Message) bool {
+func handleWSMessage(state *UIState, frame protocol.Frame) bool {
 	requireRender := false
-	if event.Type == protocol.MESSAGE_TYPE_BROADCAST {
-		requireRender = handleBroadcastMesasge(state, event)
-	}
-	if event.Type == protocol.MESSAGE_TYPE_CHAT {
-		requireRender = handleChatMesasge(state, event)
+	switch payload := frame.Payload.(type) {
+	case *protocol.Presence:
+		if protocol.HasCapability(state.capabilities, protocol.CAPABILITY_PRESENCE) {
+			requireRender = handleBroadcastMesasge(state, payload)
+		}
+	case *protocol.Chat:
+		requireRender = handleChatMesasge(state, frame.ID, payload)
+	case *protocol.Keys:
+		requireRender = handleKeysMessage(state, payload)
+	case *protocol.Error:
+		state.status = payload.Message
+		requireRender = !state.isMainScreen || splitPane(state)
+	case *protocol.FileOffer:
+		requireRender = handleFileOffer(state, frame.ID, payload)
+	case *protocol.FileAnswer:
+		requireRender = handleFileAnswer(state, payload)
+	case *protocol.FileChunk:
+		requireRender = handleFileChunk(state, payload)
+	case *protocol.FileAck:
+		requireRender = handleFileAck(state, payload)
+	case *protocol.EditMessage:
+		requireRender = handleEditMessage(state, payload)
+	case *protocol.DeleteMessage:
+		requireRender = handleDeleteMessage(state, payload)
+	case *protocol.Reaction:
+		requireRender = handleReaction(state, payload)
 	}
-	writeState(PersistedState{
-		Username: state.username, Chats: state.chats,
-	})
 	return requireRender
 }
 
@@ -112,6 +200,11 @@ func updateUserPos(state *UIState, delta int) bool {
 	return true
 }
 
+// messageListHeight is height - FIXED less the rows the compose box grew by.
+func messageListHeight(state *UIState) int {
+	return state.height - FIXED - (composeRows(state.currentText) - 1)
+}
+
 /*
 available height for messages = height - FIXED
 number of messages = len(messages)
@@ -131,12 +224,15 @@ Upper bound:
 
 If h >= m, upper bound = 0.
 Otherwise, upper bound = m - (h - FIXED).
+
+Messages take a row per wrapped line and extra rows for quotes and
+reactions, so the upper bound is found by counting rows back from the last
+message, see chatLayout.lastPageStart.
 */
 func updateChatScroll(state *UIState, delta int) bool {
-	messageListHeight := state.height - FIXED
-	maximumStart := len(state.currentChatData.Messages) - messageListHeight
+	maximumStart := layoutFor(state).lastPageStart(visibleMessages(state), messageListHeight(state))
 	prevMessageScroll := state.messageScroll
-	if len(state.currentChatData.Messages) > messageListHeight {
+	if maximumStart > 0 {
 		if delta == 0 {
 			state.messageScroll = maximumStart
 		} else {
@@ -144,10 +240,26 @@ func updateChatScroll(state *UIState, delta int) bool {
 			state.messageScroll = max(0, state.messageScroll)
 			state.messageScroll = min(state.messageScroll, maximumStart)
 		}
+	} else {
+		state.messageScroll = 0
 	}
 	return prevMessageScroll != state.messageScroll
 }
 
+func chatAtBottom(state *UIState) bool {
+	return state.messageScroll >= layoutFor(state).lastPageStart(visibleMessages(state), messageListHeight(state))
+}
+
+// keepChatScroll keeps the chat scrolled to the bottom if it was, or within
+// bounds, after the layout changed.
+func keepChatScroll(state *UIState, atBottom bool) {
+	if atBottom {
+		updateChatScroll(state, 0)
+		return
+	}
+	state.messageScroll = min(state.messageScroll, layoutFor(state).lastPageStart(visibleMessages(state), messageListHeight(state)))
+}
+
 func updateChosenTabAndUserPos(state *UIState, delta int) bool {
 	TAB_COUNT := 3
 	if state.isMainScreen {
@@ -157,32 +269,43 @@ func updateChosenTabAndUserPos(state *UIState, delta int) bool {
 	return state.isMainScreen
 }
 
-func handleChatMesasge(state *UIState, event protocol.Message) bool {
-	requireRender := true
-	data := state.chats[event.FromUsername]
-	data.Messages = append(data.Messages, protocol.Message{
-		FromUsername: event.FromUsername,
-		ToUsername:   event.ToUsername,
-		Content:      event.Content,
-		Timestamp:    event.Timestamp,
-	})
-
-	if state.isMainScreen && state.chosenTab != 0 {
-		requireRender = false
+func handleChatMesasge(state *UIState, id string, event *protocol.Chat) bool {
+	if _, has := findMessage(state, event.FromUsername, event.FromUsername, id); has {
+		return false
 	}
-
-	if !state.isMainScreen && state.chosenUser != event.FromUsername {
-		requireRender = false
+	message := ChatMessage{
+		ID:   id,
+		Chat: *event,
+	}
+	if event.Sealed != nil {
+		data := openSealedMessage(state, state.chats[event.FromUsername], &message)
+		state.chats[event.FromUsername] = data
+		saveChat(state, event.FromUsername)
 	}
+	return receiveMessage(state, event.FromUsername, message)
+}
+
+// receiveMessage adds a message from another user to its chat, counting it
+// as unread unless the chat is open.
+func receiveMessage(state *UIState, from string, message ChatMessage) bool {
+	data := state.chats[from]
+	data.Messages = append(data.Messages, message)
 
-	if state.isMainScreen || state.chosenUser != event.FromUsername {
+	// the list shows the unread count in the tab row
+	requireRender := splitPane(state) || chatShown(state, from) || state.isMainScreen
+
+	if !chatShown(state, from) {
 		data.Unread++
-		state.chats[event.FromUsername] = data
+		state.chats[from] = data
 	} else {
-		state.chats[event.FromUsername] = data
+		state.chats[from] = data
 		state.currentChatData = data
 		updateChatScroll(state, 0)
 	}
+	saveMessage(state, from, message)
+	if data.Unread > 0 {
+		saveChat(state, from)
+	}
 
 	updateTabLists(state)
 	updateUserPos(state, 0)
@@ -190,7 +313,208 @@ func handleChatMesasge(state *UIState, event protocol.Message) bool {
 	return requireRender
 }
 
-func handleBroadcastMesasge(state *UIState, event protocol.Message) bool {
+// addMessage adds a message sent by the local user to the chat with peer.
+func addMessage(state *UIState, peer string, message ChatMessage) {
+	data := state.chats[peer]
+	data.Messages = append(data.Messages, message)
+	state.chats[peer] = data
+	saveMessage(state, peer, message)
+	if chatShown(state, peer) {
+		state.currentChatData = data
+		updateChatScroll(state, 0)
+	}
+}
+
+// findMessage looks up a message by its sender and id, ids are chosen by the
+// sender so the same id may come from both users.
+func findMessage(state *UIState, chat, from, id string) (ChatMessage, bool) {
+	messages := state.chats[chat].Messages
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].ID == id && messages[i].FromUsername == from {
+			return messages[i], true
+		}
+	}
+	return ChatMessage{}, false
+}
+
+// replaceMessage stores a changed message in place of the one with the same
+// sender and id.
+func replaceMessage(state *UIState, chat string, message ChatMessage) {
+	data := state.chats[chat]
+	data.Messages = putMessage(data.Messages, message)
+	state.chats[chat] = data
+	saveMessage(state, chat, message)
+	if chatShown(state, chat) {
+		state.currentChatData = data
+	}
+}
+
+// openSealedMessage decrypts message in place. The sender key is pinned on
+// first use, the content of a message from a different key later is withheld
+// until that key is verified. A message that can not be decrypted keeps
+// Sealed, so it is tried again once an identity is loaded.
+func openSealedMessage(state *UIState, data ChatData, message *ChatMessage) ChatData {
+	sealed := message.Sealed
+	message.Encrypted = true
+	message.KeyChanged = false
+	message.SenderFingerprint = ""
+	message.Withheld = ""
+	if state.identity == nil {
+		message.Content = "[encrypted message]"
+		return data
+	}
+	content, err := unseal(state.identity, message.FromUsername, message.ToUsername, message.ID, sealed)
+	if err != nil || sealed.Sender.Verify() != nil {
+		message.Content = "[unable to decrypt message]"
+		return data
+	}
+	message.Sealed = nil
+	message.Content = content
+	fingerprint := sealed.Sender.Fingerprint()
+	if data.PeerFingerprint == "" {
+		data.PeerFingerprint = fingerprint
+	} else if data.PeerFingerprint != fingerprint {
+		message.KeyChanged = true
+		message.SenderFingerprint = fingerprint
+		message.Withheld = content
+		message.Content = WITHHELD_TEXT
+		data.Verified = false
+	}
+	data.Encrypted = true
+	return data
+}
+
+// openPendingMessages decrypts the messages of the history that were
+// received while no identity was available.
+func openPendingMessages(state *UIState) {
+	for chat, data := range state.chats {
+		opened := false
+		for i := range data.Messages {
+			message := data.Messages[i]
+			if message.Sealed == nil {
+				continue
+			}
+			data = openSealedMessage(state, data, &message)
+			if message.Sealed == nil {
+				data.Messages[i] = message
+				state.chats[chat] = data
+				saveMessage(state, chat, message)
+				opened = true
+			}
+		}
+		if opened {
+			saveChat(state, chat)
+		}
+	}
+}
+
+func handleKeysMessage(state *UIState, event *protocol.Keys) bool {
+	isCurrentChat := chatShown(state, event.Username)
+	if event.Bundle == nil {
+		delete(state.peerKeys, event.Username)
+		if isCurrentChat {
+			state.status = event.Username + " has not published encryption keys"
+		}
+		return isCurrentChat
+	}
+	if event.Bundle.Verify() != nil {
+		return false
+	}
+	state.peerKeys[event.Username] = *event.Bundle
+	data := state.chats[event.Username]
+	if data.PeerFingerprint == "" {
+		data.PeerFingerprint = event.Bundle.Fingerprint()
+		state.chats[event.Username] = data
+		saveChat(state, event.Username)
+	} else if data.PeerFingerprint != event.Bundle.Fingerprint() && isCurrentChat {
+		state.status = "key of " + event.Username + " changed, Ctrl+F to review"
+	}
+	if isCurrentChat {
+		state.currentChatData = state.chats[event.Username]
+	}
+	return isCurrentChat
+}
+
+// trustedPeerKey returns the directory key of username if it matches the
+// pinned fingerprint.
+func trustedPeerKey(state *UIState, username string) (protocol.KeyBundle, bool) {
+	bundle, has := state.peerKeys[username]
+	if !has {
+		return bundle, false
+	}
+	return bundle, bundle.Fingerprint() == state.chats[username].PeerFingerprint
+}
+
+func handleCtrlT(state *UIState) bool {
+	if state.isMainScreen || state.identity == nil {
+		return false
+	}
+	data := state.chats[state.chosenUser]
+	data.Encrypted = !data.Encrypted
+	state.chats[state.chosenUser] = data
+	state.currentChatData = data
+	if data.Encrypted {
+		state.status = "end-to-end encryption on"
+		requestKeys(state, state.chosenUser)
+	} else {
+		state.status = "end-to-end encryption off"
+	}
+	saveChat(state, state.chosenUser)
+	return true
+}
+
+func handleCtrlF(state *UIState) bool {
+	if state.isMainScreen || state.identity == nil {
+		return false
+	}
+	state.isFingerprintScreen = true
+	requestKeys(state, state.chosenUser)
+	return true
+}
+
+// handleFingerprintKeypress handles the fingerprint screen, Enter marks the
+// directory key of the peer as verified, pinning it if it changed.
+func handleFingerprintKeypress(state *UIState, event EventKeyPress) bool {
+	switch event.KeyType {
+	case KEY_TYPE_CTRL_C:
+		state.isFingerprintScreen = false
+		return true
+	case KEY_TYPE_ENTER:
+		bundle, has := state.peerKeys[state.chosenUser]
+		if !has {
+			return false
+		}
+		data := state.chats[state.chosenUser]
+		data.PeerFingerprint = bundle.Fingerprint()
+		data.Verified = true
+		state.chats[state.chosenUser] = data
+		state.currentChatData = data
+		state.isFingerprintScreen = false
+		state.status = state.chosenUser + " verified"
+		saveChat(state, state.chosenUser)
+		showWithheld(state, state.chosenUser)
+		return true
+	}
+	return false
+}
+
+// showWithheld shows the messages of username sent with the key that is
+// pinned now.
+func showWithheld(state *UIState, username string) {
+	data := state.chats[username]
+	for _, message := range data.Messages {
+		if !message.KeyChanged || message.SenderFingerprint != data.PeerFingerprint {
+			continue
+		}
+		message.Content = message.Withheld
+		message.KeyChanged = false
+		message.SenderFingerprint = ""
+		message.Withheld = ""
+		replaceMessage(state, username, message)
+	}
+}
+
+func handleBroadcastMesasge(state *UIState, event *protocol.Presence) bool {
 	requireRender := true
 	state.activeUsers = make(map[string]bool)
 	if len(event.Users) > 1 {
@@ -201,6 +525,7 @@ func handleBroadcastMesasge(state *UIState, event protocol.Message) bool {
 			}
 			if _, ok := state.chats[v]; !ok {
 				state.chats[v] = ChatData{}
+				saveChat(state, v)
 			}
 			filtered = append(filtered, v)
 			state.activeUsers[v] = true
@@ -211,24 +536,6 @@ func handleBroadcastMesasge(state *UIState, event protocol.Message) bool {
 	return requireRender
 }
 
-func handlePrintableKey(state *UIState, event EventKeyPress) bool {
-	if !state.isMainScreen {
-		state.currentText = state.currentText + string(event.Char)
-		return true
-	}
-	return false
-}
-
-func handleBackspace(state *UIState) bool {
-	if !state.isMainScreen && len(state.currentText) > 0 {
-		bytes := []byte(state.currentText)
-		bytes = bytes[:len(bytes)-1]
-		state.currentText = string(bytes)
-		return true
-	}
-	return false
-}
-
 func handleCtrlC(state *UIState) bool {
 	if state.isMainScreen {
 		state.exit = true
@@ -236,7 +543,28 @@ func handleCtrlC(state *UIState) bool {
 	}
 	state.isMainScreen = true
 	state.userPos = 0
-	state.currentText = ""
+	setText(state, "")
+	state.status = ""
+	state.editingID = ""
+	state.replyingTo = messageRef{}
+	state.threadRoot = messageRef{}
+	return true
+}
+
+// handleEsc cancels an edit or reply in progress, then leaves the thread
+// view.
+func handleEsc(state *UIState) bool {
+	switch {
+	case state.editingID != "":
+		state.editingID = ""
+		setText(state, "")
+	case state.replyingTo.id != "":
+		state.replyingTo = messageRef{}
+	case state.threadRoot.id != "":
+		closeThread(state)
+	default:
+		return false
+	}
 	return true
 }
 
@@ -265,6 +593,23 @@ func handleDownArrow(state *UIState) bool {
 }
 
 func handleKeypress(state *UIState, event EventKeyPress) bool {
+	if state.isFingerprintScreen {
+		return handleFingerprintKeypress(state, event)
+	}
+	if state.isPicking {
+		return handlePickerKeypress(state, event)
+	}
+	if state.isNewChat {
+		return handleNewChatKeypress(state, event)
+	}
+	if state.isSelecting {
+		return handleSelectionKeypress(state, event)
+	}
+	if !state.isMainScreen {
+		if requireRender, handled := handleEditorKey(state, event); handled {
+			return requireRender
+		}
+	}
 	switch event.KeyType {
 	case KEY_TYPE_CTRL_C:
 		return handleCtrlC(state)
@@ -278,14 +623,54 @@ func handleKeypress(state *UIState, event EventKeyPress) bool {
 		return handleRightArrow(state)
 	case KEY_TYPE_ENTER:
 		return handleEnter(state)
-	case KEY_TYPE_PRINTABLE:
-		return handlePrintableKey(state, event)
-	case KEY_TYPE_BACKSPACE:
-		return handleBackspace(state)
+	case KEY_TYPE_CTRL_T:
+		return handleCtrlT(state)
+	case KEY_TYPE_CTRL_O:
+		return handleCtrlO(state)
+	case KEY_TYPE_CTRL_N:
+		return startNewChat(state)
+	case KEY_TYPE_CTRL_F:
+		return handleCtrlF(state)
+	case KEY_TYPE_TAB:
+		return handleTab(state)
+	case KEY_TYPE_ESC:
+		return handleEsc(state)
 	}
 	return false
 }
 
+// openChat switches to the chat view of username and marks the chat as read.
+func openChat(state *UIState, username string) {
+	if username != state.chosenUser {
+		// a draft left in the right pane belongs to the previous chat
+		setText(state, "")
+		state.status = ""
+		state.editingID = ""
+		state.replyingTo = messageRef{}
+		state.threadRoot = messageRef{}
+	}
+	state.chosenUser = username
+	state.isMainScreen = false
+	data := state.chats[state.chosenUser]
+	data.Unread = 0
+	state.chats[state.chosenUser] = data
+	state.currentChatData = data
+	saveChat(state, state.chosenUser)
+	if data.Encrypted {
+		requestKeys(state, state.chosenUser)
+	}
+}
+
+// checkContentSize reports whether the draft fits in a message, the draft is
+// kept when it does not.
+func checkContentSize(state *UIState) bool {
+	if len(state.currentText) > protocol.MAX_CONTENT_SIZE {
+		state.status = "message is larger than " + formatSize(protocol.MAX_CONTENT_SIZE)
+		return false
+	}
+	return true
+}
+
 func handleEnter(state *UIState) bool {
 	if state.isMainScreen {
 		chosenList := []string{}
@@ -302,12 +687,7 @@ func handleEnter(state *UIState) bool {
 		if len(chosenList) == 0 {
 			return false
 		}
-		state.chosenUser = chosenList[state.userPos]
-		state.isMainScreen = false
-		data := state.chats[state.chosenUser]
-		data.Unread = 0
-		state.chats[state.chosenUser] = data
-		state.currentChatData = data
+		openChat(state, chosenList[state.userPos])
 		if state.chosenTab == 0 {
 			// mark as read
 			newUnread := make([]string, 0, len(state.unreadUsers)-1)
@@ -329,24 +709,70 @@ func handleEnter(state *UIState) bool {
 	if len(state.currentText) == 0 {
 		return false
 	}
+	if state.editingID != "" {
+		return sendEdit(state)
+	}
+	if strings.HasPrefix(state.currentText, "/") && handleCommand(state, state.currentText) {
+		return true
+	}
+	if !checkContentSize(state) {
+		return true
+	}
 	data := state.chats[state.chosenUser]
-	localMessage := protocol.Message{
-		FromUsername: state.username,
-		ToUsername:   state.chosenUser,
-		Content:      state.currentText,
-		Timestamp:    time.Now(),
+	replyTo := state.replyingTo
+	if replyTo.id == "" {
+		replyTo = state.threadRoot
+	}
+	localMessage := ChatMessage{
+		ID:        protocol.NewID(),
+		Encrypted: data.Encrypted,
+		Chat: protocol.Chat{
+			FromUsername: state.username,
+			ToUsername:   state.chosenUser,
+			Content:      state.currentText,
+			ReplyTo:      replyTo.id,
+			ReplyToFrom:  replyTo.from,
+			Timestamp:    state.now(),
+		},
+	}
+	send := &protocol.Send{
+		ToUsername:  localMessage.ToUsername,
+		Content:     localMessage.Content,
+		ReplyTo:     replyTo.id,
+		ReplyToFrom: replyTo.from,
+	}
+	if data.Encrypted {
+		bundle, ok := trustedPeerKey(state, state.chosenUser)
+		if !ok {
+			state.status = "no trusted key for " + state.chosenUser + ", Ctrl+F to review"
+			requestKeys(state, state.chosenUser)
+			return true
+		}
+		sealed, err := seal(state.identity, bundle, localMessage.FromUsername, localMessage.ToUsername, localMessage.ID, localMessage.Content)
+		if err != nil {
+			state.status = "encryption failed: " + err.Error()
+			return true
+		}
+		send = &protocol.Send{
+			ToUsername:  localMessage.ToUsername,
+			Sealed:      sealed,
+			ReplyTo:     replyTo.id,
+			ReplyToFrom: replyTo.from,
+		}
+	}
+	frame := protocol.Frame{
+		ID:      localMessage.ID,
+		Payload: send,
+	}
+	if !sendFrame(state, frame) {
+		return true
 	}
 	data.Messages = append(data.Messages, localMessage)
 	state.chats[state.chosenUser] = data
-	state.currentText = ""
-	if err := writeMessage(state.conn, localMessage); err != nil {
-		state.conn.Close()
-		state.exit = true
-		return false
-	}
-	writeState(PersistedState{
-		Username: state.username, Chats: state.chats,
-	})
+	setText(state, "")
+	state.status = ""
+	state.replyingTo = messageRef{}
+	saveMessage(state, state.chosenUser, localMessage)
 	state.currentChatData = data
 	updateChatScroll(state, 0)
 	return true
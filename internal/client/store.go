@@ -0,0 +1,303 @@
+package client
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+)
+
+const (
+	// The journal is folded into the snapshot after COMPACT_THRESHOLD
+	// records, and whenever the store is closed.
+	COMPACT_THRESHOLD = 1000
+	MAX_RECORD_SIZE   = 16 << 20
+	RECORD_HEADER     = 8
+)
+
+/*
+Store keeps the history as a snapshot plus an append-only journal.
+
+The snapshot is the JSON file at storagePath that older versions rewrote on
+every message, so existing histories are picked up as they are. It is only
+replaced atomically, by renaming a fully written temporary file.
+
+Every change since the snapshot is a journal record:
+
+	length  uint32 big endian
+	crc32   uint32 big endian, of the payload
+	payload journalRecord as JSON, sealed when the storage is encrypted
+
+A crash can only leave a torn record at the end of the journal, it is
+detected by its length or checksum and truncated when the store is opened.
+Records carry increasing sequence numbers and the snapshot remembers the
+last one it contains, so a crash between writing the snapshot and emptying
+the journal does not apply records twice.
+*/
+type Store struct {
+	username string
+	journal  *os.File
+	seq      uint64
+	records  int
+	// size is where the intact records end. A write that fails is cut off
+	// there, if that fails too the store refuses further records with err.
+	size int64
+	err  error
+}
+
+// journalRecord carries either chat metadata, or a message that replaces
+// the message with the same ID or is appended to the chat.
+type journalRecord struct {
+	Seq      uint64       `json:"seq"`
+	Chat     string       `json:"chat"`
+	ChatData *ChatData    `json:"chatData,omitempty"`
+	Message  *ChatMessage `json:"message,omitempty"`
+}
+
+var ErrCorruptHistory = errors.New("history is corrupt")
+
+func journalPath(username string) string {
+	return storagePath(username) + ".journal"
+}
+
+// OpenStore loads the snapshot, replays the journal on top of it and
+// truncates a torn record left by a crash.
+func OpenStore(username string) (*Store, PersistedState, error) {
+	state, err := readSnapshot(username)
+	if err != nil {
+		return nil, state, err
+	}
+	filePath := journalPath(username)
+	os.MkdirAll(path.Dir(filePath), 0700)
+	journal, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, state, err
+	}
+	records, validSize, err := readJournal(journal)
+	if err != nil {
+		journal.Close()
+		return nil, state, err
+	}
+	for _, record := range records {
+		if record.Seq <= state.Seq {
+			continue
+		}
+		applyRecord(&state, record)
+		state.Seq = record.Seq
+	}
+	if err := journal.Truncate(validSize); err != nil {
+		journal.Close()
+		return nil, state, err
+	}
+	if _, err := journal.Seek(validSize, io.SeekStart); err != nil {
+		journal.Close()
+		return nil, state, err
+	}
+	store := &Store{
+		username: username,
+		journal:  journal,
+		seq:      state.Seq,
+		records:  len(records),
+		size:     validSize,
+	}
+	return store, state, nil
+}
+
+func readSnapshot(username string) (PersistedState, error) {
+	state := PersistedState{
+		Username: username,
+		Chats:    make(map[string]ChatData),
+	}
+	filePath := storagePath(username)
+	if !fileExists(filePath) {
+		return state, nil
+	}
+	content, err := readStorageFile(filePath)
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(content, &state); err != nil {
+		return state, fmt.Errorf("%w: %s: %v", ErrCorruptHistory, filePath, err)
+	}
+	if state.Chats == nil {
+		state.Chats = make(map[string]ChatData)
+	}
+	return state, nil
+}
+
+// readJournal returns the intact records and the size they take, everything
+// after the first torn record is dropped.
+func readJournal(journal *os.File) ([]journalRecord, int64, error) {
+	if _, err := journal.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	records := []journalRecord{}
+	validSize := int64(0)
+	header := make([]byte, RECORD_HEADER)
+	for {
+		if _, err := io.ReadFull(journal, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return records, validSize, nil
+			}
+			return nil, 0, err
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		if length > MAX_RECORD_SIZE {
+			return records, validSize, nil
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(journal, payload); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return records, validSize, nil
+			}
+			return nil, 0, err
+		}
+		if crc32.ChecksumIEEE(payload) != checksum {
+			return records, validSize, nil
+		}
+		// an intact record that does not decode is not a torn write,
+		// dropping it would lose history
+		record, err := decodeRecord(payload)
+		if err != nil {
+			return nil, 0, err
+		}
+		records = append(records, record)
+		validSize += int64(RECORD_HEADER) + int64(length)
+	}
+}
+
+func decodeRecord(payload []byte) (journalRecord, error) {
+	var record journalRecord
+	if storageAEAD != nil {
+		plaintext, err := openStorage(storageAEAD, payload)
+		if err != nil {
+			return record, fmt.Errorf("%w: journal record: %v", ErrCorruptHistory, err)
+		}
+		payload = plaintext
+	}
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return record, fmt.Errorf("%w: journal record: %v", ErrCorruptHistory, err)
+	}
+	return record, nil
+}
+
+func applyRecord(state *PersistedState, record journalRecord) {
+	data := state.Chats[record.Chat]
+	if record.ChatData != nil {
+		messages := data.Messages
+		data = *record.ChatData
+		data.Messages = messages
+	}
+	if record.Message != nil {
+		data.Messages = putMessage(data.Messages, *record.Message)
+	}
+	state.Chats[record.Chat] = data
+}
+
+// putMessage replaces the message with the same sender and ID, or appends
+// message.
+func putMessage(messages []ChatMessage, message ChatMessage) []ChatMessage {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].ID == message.ID && messages[i].FromUsername == message.FromUsername {
+			messages[i] = message
+			return messages
+		}
+	}
+	return append(messages, message)
+}
+
+func (s *Store) append(record journalRecord) error {
+	if s.err != nil {
+		return s.err
+	}
+	record.Seq = s.seq + 1
+	payload, err := json.Marshal(&record)
+	if err != nil {
+		return err
+	}
+	if storageAEAD != nil {
+		payload = sealStorage(storageAEAD, payload)
+	}
+	buffer := make([]byte, RECORD_HEADER, RECORD_HEADER+len(payload))
+	binary.BigEndian.PutUint32(buffer[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buffer[4:8], crc32.ChecksumIEEE(payload))
+	buffer = append(buffer, payload...)
+	if _, err := s.journal.Write(buffer); err != nil {
+		// later records must not follow a torn one, reading stops there
+		s.discardTorn()
+		return err
+	}
+	s.seq++
+	s.size += int64(len(buffer))
+	s.records++
+	return s.journal.Sync()
+}
+
+// discardTorn cuts the journal back to its intact records.
+func (s *Store) discardTorn() {
+	if err := s.journal.Truncate(s.size); err != nil {
+		s.err = fmt.Errorf("journal left with a torn record: %w", err)
+		return
+	}
+	if _, err := s.journal.Seek(s.size, io.SeekStart); err != nil {
+		s.err = fmt.Errorf("journal left with a torn record: %w", err)
+	}
+}
+
+// PutMessage records a new or changed message of chat.
+func (s *Store) PutMessage(chat string, message ChatMessage) error {
+	return s.append(journalRecord{Chat: chat, Message: &message})
+}
+
+// PutChat records the metadata of chat, its messages are ignored.
+func (s *Store) PutChat(chat string, data ChatData) error {
+	data.Messages = nil
+	return s.append(journalRecord{Chat: chat, ChatData: &data})
+}
+
+func (s *Store) NeedsCompaction() bool {
+	return s.records >= COMPACT_THRESHOLD
+}
+
+// Compact writes state as the new snapshot and empties the journal.
+func (s *Store) Compact(state PersistedState) error {
+	state.Seq = s.seq
+	content, err := json.Marshal(&state)
+	if err != nil {
+		return err
+	}
+	if err := writeStorageFile(storagePath(s.username), content); err != nil {
+		return err
+	}
+	if err := s.journal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.journal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.size = 0
+	s.records = 0
+	s.err = nil
+	return s.journal.Sync()
+}
+
+// Close compacts the journal into state and closes the store.
+func (s *Store) Close(state PersistedState) error {
+	err := s.Compact(state)
+	s.journal.Close()
+	return err
+}
+
+// compactStore folds the journal of username into its snapshot.
+func compactStore(username string) error {
+	store, state, err := OpenStore(username)
+	if err != nil {
+		return err
+	}
+	return store.Close(state)
+}
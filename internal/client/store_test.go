@@ -0,0 +1,226 @@
+package client
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
+)
+
+func storeMessage(id, content string) ChatMessage {
+	return ChatMessage{ID: id, Chat: protocol.Chat{FromUsername: "bob", ToUsername: "alice", Content: content}}
+}
+
+func openTestStore(t *testing.T) (*Store, PersistedState) {
+	t.Helper()
+	store, state, err := OpenStore("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, state
+}
+
+// crash closes the journal without compacting it, as a killed client would
+// leave it.
+func (s *Store) crash() {
+	s.journal.Close()
+}
+
+func put(t *testing.T, store *Store, message ChatMessage) {
+	t.Helper()
+	if err := store.PutMessage("bob", message); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recordEnds are the offsets where the records of journal end.
+func recordEnds(journal []byte) []int64 {
+	ends := []int64{0}
+	for offset := 0; offset+RECORD_HEADER <= len(journal); {
+		offset += RECORD_HEADER + int(binary.BigEndian.Uint32(journal[offset:]))
+		ends = append(ends, int64(offset))
+	}
+	return ends
+}
+
+// writeCrashedStore leaves a snapshot with m0 and a journal with m1 to m3
+// and the unread count of the chat.
+func writeCrashedStore(t *testing.T) []byte {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	store, state := openTestStore(t)
+	put(t, store, storeMessage("m0", "zero"))
+	state.Chats["bob"] = ChatData{Messages: []ChatMessage{storeMessage("m0", "zero")}}
+	if err := store.Compact(state); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"m1", "m2", "m3"} {
+		put(t, store, storeMessage(id, "text of "+id))
+	}
+	if err := store.PutChat("bob", ChatData{Unread: 3}); err != nil {
+		t.Fatal(err)
+	}
+	store.crash()
+	journal, err := os.ReadFile(journalPath("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return journal
+}
+
+func TestJournalTornAtEveryOffset(t *testing.T) {
+	journal := writeCrashedStore(t)
+	ends := recordEnds(journal)
+	if len(ends) != 5 || ends[4] != int64(len(journal)) {
+		t.Fatalf("records end at %v in %d bytes", ends, len(journal))
+	}
+	for cut := 0; cut <= len(journal); cut++ {
+		if err := os.WriteFile(journalPath("alice"), journal[:cut], 0600); err != nil {
+			t.Fatal(err)
+		}
+		intact := 0
+		for intact+1 < len(ends) && ends[intact+1] <= int64(cut) {
+			intact++
+		}
+		store, state := openTestStore(t)
+		messages := state.Chats["bob"].Messages
+		if len(messages) != 1+min(intact, 3) || (state.Chats["bob"].Unread == 3) != (intact == 4) {
+			t.Fatalf("cut at %d of %d: %d messages, unread %d, %d records intact", cut, len(journal), len(messages), state.Chats["bob"].Unread, intact)
+		}
+		if stat, _ := os.Stat(journalPath("alice")); stat.Size() != ends[intact] {
+			t.Fatalf("cut at %d: journal of %d bytes, intact records end at %d", cut, stat.Size(), ends[intact])
+		}
+		// records written after the recovery are read back
+		put(t, store, storeMessage("new", "after the crash"))
+		store.crash()
+		store, state = openTestStore(t)
+		if _, has := findMessageIn(state.Chats["bob"].Messages, "new"); !has {
+			t.Fatalf("cut at %d: record after recovery lost", cut)
+		}
+		store.crash()
+	}
+}
+
+func findMessageIn(messages []ChatMessage, id string) (ChatMessage, bool) {
+	for _, message := range messages {
+		if message.ID == id {
+			return message, true
+		}
+	}
+	return ChatMessage{}, false
+}
+
+func TestJournalChecksumMismatch(t *testing.T) {
+	journal := writeCrashedStore(t)
+	ends := recordEnds(journal)
+	for record := 0; record < len(ends)-1; record++ {
+		flipped := append([]byte{}, journal...)
+		// the checksum follows the length
+		flipped[ends[record]+4] ^= 0xFF
+		if err := os.WriteFile(journalPath("alice"), flipped, 0600); err != nil {
+			t.Fatal(err)
+		}
+		store, state := openTestStore(t)
+		if messages := state.Chats["bob"].Messages; len(messages) != 1+min(record, 3) {
+			t.Fatalf("checksum of record %d broken: %d messages", record, len(messages))
+		}
+		store.crash()
+	}
+}
+
+func TestJournalSkipsRecordsInSnapshot(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	store, _ := openTestStore(t)
+	put(t, store, storeMessage("m1", "first"))
+	put(t, store, storeMessage("m1", "edited"))
+	put(t, store, storeMessage("m2", "second"))
+	store.crash()
+	// the snapshot was written with the first two records, the crash came
+	// before the journal was emptied
+	snapshot := PersistedState{Username: "alice", Seq: 2, Chats: map[string]ChatData{
+		"bob": {Messages: []ChatMessage{storeMessage("m1", "from the snapshot")}},
+	}}
+	content, _ := json.Marshal(&snapshot)
+	if err := writeStorageFile(storagePath("alice"), content); err != nil {
+		t.Fatal(err)
+	}
+
+	store, state := openTestStore(t)
+	defer store.crash()
+	messages := state.Chats["bob"].Messages
+	if len(messages) != 2 || messages[0].Content != "from the snapshot" || messages[1].ID != "m2" || state.Seq != 3 {
+		t.Fatalf("seq %d, messages %#v", state.Seq, messages)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	store, state := openTestStore(t)
+	for _, id := range []string{"m1", "m2"} {
+		message := storeMessage(id, "text of "+id)
+		put(t, store, message)
+		data := state.Chats["bob"]
+		data.Messages = append(data.Messages, message)
+		state.Chats["bob"] = data
+	}
+	if err := store.Close(state); err != nil {
+		t.Fatal(err)
+	}
+	if stat, _ := os.Stat(journalPath("alice")); stat.Size() != 0 {
+		t.Fatalf("journal of %d bytes after compaction", stat.Size())
+	}
+	store, state = openTestStore(t)
+	defer store.crash()
+	if messages := state.Chats["bob"].Messages; len(messages) != 2 || state.Seq != 2 || store.NeedsCompaction() {
+		t.Fatalf("seq %d, messages %#v", state.Seq, messages)
+	}
+}
+
+func TestMigrationFromJSON(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	// the history file written by versions without a journal
+	legacy := `{"username":"alice","chats":{"bob":{"unread":1,"messages":[` +
+		`{"id":"m1","fromUsername":"bob","toUsername":"alice","content":"old","timestamp":"2024-01-01T12:00:00Z"}]}}}`
+	os.MkdirAll(storagePath(""), 0700)
+	if err := os.WriteFile(storagePath("alice"), []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, state := openTestStore(t)
+	if messages := state.Chats["bob"].Messages; len(messages) != 1 || messages[0].Content != "old" || state.Chats["bob"].Unread != 1 {
+		t.Fatalf("migrated %#v", state.Chats["bob"])
+	}
+	put(t, store, storeMessage("m2", "new"))
+	store.crash()
+	store, state = openTestStore(t)
+	defer store.crash()
+	if messages := state.Chats["bob"].Messages; len(messages) != 2 || messages[1].Content != "new" {
+		t.Fatalf("after reopening %#v", messages)
+	}
+}
+
+func TestFailedWriteStopsStore(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	store, _ := openTestStore(t)
+	put(t, store, storeMessage("m1", "kept"))
+	// a journal that can be neither written nor cut back
+	store.journal.Close()
+	readOnly, err := os.Open(journalPath("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.journal = readOnly
+	if err := store.PutMessage("bob", storeMessage("m2", "lost")); err == nil {
+		t.Fatal("write to a read only journal succeeded")
+	}
+	if err := store.PutMessage("bob", storeMessage("m3", "after")); err == nil || store.err == nil {
+		t.Fatal("appended after a write that could not be cut back")
+	}
+	store.crash()
+	store, state := openTestStore(t)
+	defer store.crash()
+	if messages := state.Chats["bob"].Messages; len(messages) != 1 || state.Seq != 1 {
+		t.Fatalf("seq %d, messages %#v", state.Seq, messages)
+	}
+}
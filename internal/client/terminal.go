@@ -1,8 +1,12 @@
 package client
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"regexp"
+	"strings"
 	"time"
 
 	"golang.org/x/term"
@@ -62,42 +66,159 @@ const (
 const (
 	ANSI_ENTER_ALT_SCREEN = "\x1b[?1049h"
 	ANSI_EXIT_ALT_SCREEN  = "\x1b[?1049l"
+
+	// pasted text is sent between KEY_PASTE_START and KEY_PASTE_END
+	ANSI_ENABLE_BRACKETED_PASTE  = "\x1b[?2004h"
+	ANSI_DISABLE_BRACKETED_PASTE = "\x1b[?2004l"
+
+	// xterm modifyOtherKeys level 1, lets Shift+Enter be told from Enter
+	ANSI_ENABLE_MODIFY_OTHER_KEYS  = "\x1b[>4;1m"
+	ANSI_DISABLE_MODIFY_OTHER_KEYS = "\x1b[>4m"
+)
+
+// EventResize is the new size of the terminal.
+type EventResize struct {
+	Width  int
+	Height int
+}
+
+const (
+	// RESIZE_POLL_INTERVAL is how often the size is checked where resizes
+	// are not signalled.
+	RESIZE_POLL_INTERVAL = 500 * time.Millisecond
+	// RESIZE_SETTLE is how long signals must stop for before the size is
+	// read, so dragging a window corner renders once at the end.
+	RESIZE_SETTLE = 30 * time.Millisecond
 )
 
-func listenResizeEvents(events chan int) {
-	_, height, err := term.GetSize(int(os.Stdin.Fd()))
+func listenResizeEvents(events chan EventResize) {
+	signals, ok := notifyResize()
+	var poll <-chan time.Time
+	if !ok {
+		poll = time.NewTicker(RESIZE_POLL_INTERVAL).C
+	}
+	watchSize(terminalSize, signals, poll, events)
+}
+
+func terminalSize() (int, int, error) {
+	return term.GetSize(int(os.Stdin.Fd()))
+}
+
+// watchSize reads size after every burst of signals or poll tick and sends
+// it when it changed. events is closed once the size can not be read.
+func watchSize(size func() (int, int, error), signals <-chan os.Signal, poll <-chan time.Time, events chan EventResize) {
+	width, height, err := size()
 	if err != nil {
 		close(events)
 		return
 	}
 	for {
-		time.Sleep(time.Millisecond * 500)
-		_, newHeight, err := term.GetSize(int(os.Stdin.Fd()))
+		select {
+		case <-signals:
+			waitForQuiet(signals)
+		case <-poll:
+		}
+		newWidth, newHeight, err := size()
 		if err != nil {
 			close(events)
 			return
 		}
-		if newHeight != height {
-			height = newHeight
-			events <- height
+		if newWidth != width || newHeight != height {
+			width, height = newWidth, newHeight
+			events <- EventResize{Width: width, Height: height}
+		}
+	}
+}
+
+// waitForQuiet returns once no signal arrived for RESIZE_SETTLE.
+func waitForQuiet(signals <-chan os.Signal) {
+	timer := time.NewTimer(RESIZE_SETTLE)
+	defer timer.Stop()
+	for {
+		select {
+		case <-signals:
+			timer.Reset(RESIZE_SETTLE)
+		case <-timer.C:
+			return
 		}
 	}
 }
 
 var oldState *term.State
 
+// synchronizedUpdates is set by SetupTerminal when the terminal supports
+// SYNC_BEGIN and SYNC_END.
+var synchronizedUpdates bool
+
+// SYNC_QUERY_TIMEOUT bounds the wait for terminals that answer no queries.
+const SYNC_QUERY_TIMEOUT = 200 * time.Millisecond
+
+var (
+	syncModeReport   = regexp.MustCompile(`\x1b\[\?2026;(\d)\$y`)
+	deviceAttributes = regexp.MustCompile(`\x1b\[\?[\d;]*c`)
+)
+
+// querySynchronizedUpdates asks the terminal about mode 2026 with DECRQM.
+// The device attributes query after it is answered by every terminal, so
+// one that ignores DECRQM does not make us wait for the timeout. Keys typed
+// meanwhile are left in the input for the key reader.
+func querySynchronizedUpdates(in *inputReader, out io.Writer) bool {
+	fmt.Fprint(out, ESC+"[?2026$p", ESC+"[c")
+	deadline := time.Now().Add(SYNC_QUERY_TIMEOUT)
+	reply := []byte{}
+	for !deviceAttributes.Match(reply) {
+		b, err := in.readByte(deadline)
+		if err != nil {
+			break
+		}
+		reply = append(reply, b)
+	}
+	// 1 and 2 are set and reset, 3 permanently set
+	match := syncModeReport.FindSubmatch(reply)
+	in.unread(deviceAttributes.ReplaceAll(syncModeReport.ReplaceAll(reply, nil), nil))
+	return match != nil && strings.Contains("123", string(match[1]))
+}
+
 func SetupTerminal() error {
 	state, err := term.MakeRaw(int(os.Stdin.Fd()))
 	if err != nil {
 		return err
 	}
 	oldState = state
-	fmt.Print(ANSI_ENTER_ALT_SCREEN)
+	stdin = newInputReader(os.Stdin)
+	synchronizedUpdates = querySynchronizedUpdates(stdin, os.Stdout)
+	fmt.Print(ANSI_ENTER_ALT_SCREEN, ANSI_ENABLE_BRACKETED_PASTE, ANSI_ENABLE_MODIFY_OTHER_KEYS)
 	return nil
 }
 
 func RestoreTerminal() {
 	fmt.Print(ClearScreen, CursorHome, CursorShow)
-	fmt.Print(ANSI_EXIT_ALT_SCREEN)
+	fmt.Print(ANSI_DISABLE_MODIFY_OTHER_KEYS, ANSI_DISABLE_BRACKETED_PASTE, ANSI_EXIT_ALT_SCREEN)
 	term.Restore(int(os.Stdin.Fd()), oldState)
 }
+
+// PromptPassphrase reads a passphrase without echo, asking twice when
+// confirm is set. It must run before SetupTerminal.
+func PromptPassphrase(confirm bool) (string, error) {
+	fmt.Fprint(os.Stderr, "Passphrase: ")
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if len(passphrase) == 0 {
+		return "", errors.New("empty passphrase")
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+		repeated, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		if string(repeated) != string(passphrase) {
+			return "", errors.New("passphrases do not match")
+		}
+	}
+	return string(passphrase), nil
+}
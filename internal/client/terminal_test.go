@@ -0,0 +1,105 @@
+package client
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeTerminal is a terminal whose size the test sets, reads are counted.
+type fakeTerminal struct {
+	width  atomic.Int64
+	reads  atomic.Int64
+	broken atomic.Bool
+}
+
+func (f *fakeTerminal) size() (int, int, error) {
+	f.reads.Add(1)
+	if f.broken.Load() {
+		return 0, 0, errors.New("not a terminal")
+	}
+	return int(f.width.Load()), 24, nil
+}
+
+func watchFake(poll <-chan time.Time) (*fakeTerminal, chan os.Signal, chan EventResize) {
+	terminal := &fakeTerminal{}
+	terminal.width.Store(80)
+	signals := make(chan os.Signal)
+	events := make(chan EventResize, 16)
+	go watchSize(terminal.size, signals, poll, events)
+	return terminal, signals, events
+}
+
+func nextResize(t *testing.T, events chan EventResize) EventResize {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no resize")
+	}
+	return EventResize{}
+}
+
+func noResize(t *testing.T, events chan EventResize) {
+	t.Helper()
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected %#v", event)
+	case <-time.After(5 * RESIZE_SETTLE):
+	}
+}
+
+func TestResizeBurstCoalesced(t *testing.T) {
+	terminal, signals, events := watchFake(nil)
+	// a window corner dragged, the size changes with every signal
+	for width := 81; width <= 120; width++ {
+		terminal.width.Store(int64(width))
+		signals <- os.Interrupt
+	}
+	if event := nextResize(t, events); event != (EventResize{Width: 120, Height: 24}) {
+		t.Fatalf("got %#v", event)
+	}
+	noResize(t, events)
+	// the size was read once at the start and once for the burst
+	if reads := terminal.reads.Load(); reads != 2 {
+		t.Fatalf("size read %d times", reads)
+	}
+
+	// a signal without a change sends nothing
+	signals <- os.Interrupt
+	noResize(t, events)
+
+	// the next burst is reported on its own
+	terminal.width.Store(100)
+	signals <- os.Interrupt
+	if event := nextResize(t, events); event.Width != 100 {
+		t.Fatalf("got %#v", event)
+	}
+}
+
+func TestResizePolled(t *testing.T) {
+	poll := make(chan time.Time)
+	terminal, _, events := watchFake(poll)
+	poll <- time.Now()
+	noResize(t, events)
+	terminal.width.Store(90)
+	poll <- time.Now()
+	if event := nextResize(t, events); event.Width != 90 {
+		t.Fatalf("got %#v", event)
+	}
+
+	// events is closed once the size can not be read
+	terminal.broken.Store(true)
+	poll <- time.Now()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatal("resize from a broken terminal")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("events not closed")
+	}
+}
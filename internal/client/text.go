@@ -0,0 +1,296 @@
+package client
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	ZERO_WIDTH_JOINER  = '\u200d'
+	VARIATION_SELECTOR = '\ufe0f' // emoji presentation
+)
+
+// wideRanges are the East Asian Wide and Fullwidth blocks plus the emoji
+// blocks terminals draw two cells wide.
+var wideRanges = [][2]rune{
+	{0x1100, 0x115F},
+	{0x231A, 0x231B},
+	{0x23E9, 0x23EC},
+	{0x23F0, 0x23F0},
+	{0x23F3, 0x23F3},
+	{0x25FD, 0x25FE},
+	{0x2614, 0x2615},
+	{0x2648, 0x2653},
+	{0x267F, 0x267F},
+	{0x2693, 0x2693},
+	{0x26A1, 0x26A1},
+	{0x26AA, 0x26AB},
+	{0x26BD, 0x26BE},
+	{0x26C4, 0x26C5},
+	{0x26CE, 0x26CE},
+	{0x26D4, 0x26D4},
+	{0x26EA, 0x26EA},
+	{0x26F2, 0x26F3},
+	{0x26F5, 0x26F5},
+	{0x26FA, 0x26FA},
+	{0x26FD, 0x26FD},
+	{0x2705, 0x2705},
+	{0x270A, 0x270B},
+	{0x2728, 0x2728},
+	{0x274C, 0x274C},
+	{0x274E, 0x274E},
+	{0x2753, 0x2755},
+	{0x2757, 0x2757},
+	{0x2795, 0x2797},
+	{0x27B0, 0x27B0},
+	{0x27BF, 0x27BF},
+	{0x2B1B, 0x2B1C},
+	{0x2B50, 0x2B50},
+	{0x2B55, 0x2B55},
+	{0x2E80, 0x303E},
+	{0x3041, 0x33FF},
+	{0x3400, 0x4DBF},
+	{0x4E00, 0x9FFF},
+	{0xA000, 0xA4CF},
+	{0xA960, 0xA97F},
+	{0xAC00, 0xD7A3},
+	{0xF900, 0xFAFF},
+	{0xFE10, 0xFE19},
+	{0xFE30, 0xFE6F},
+	{0xFF00, 0xFF60},
+	{0xFFE0, 0xFFE6},
+	{0x1F004, 0x1F004},
+	{0x1F0CF, 0x1F0CF},
+	{0x1F18E, 0x1F18E},
+	{0x1F191, 0x1F19A},
+	{0x1F200, 0x1F251},
+	{0x1F300, 0x1F64F},
+	{0x1F680, 0x1F6FF},
+	{0x1F7E0, 0x1F7EB},
+	{0x1F90C, 0x1F9FF},
+	{0x1FA70, 0x1FAFF},
+	{0x20000, 0x2FFFD},
+	{0x30000, 0x3FFFD},
+}
+
+// runeWidth is the number of terminal cells r takes on its own.
+func runeWidth(r rune) int {
+	if r == 0 || r == ZERO_WIDTH_JOINER || unicode.IsControl(r) ||
+		unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf) {
+		return 0
+	}
+	for _, wide := range wideRanges {
+		if r < wide[0] {
+			break
+		}
+		if r <= wide[1] {
+			return 2
+		}
+	}
+	return 1
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+func isEmojiModifier(r rune) bool {
+	return r >= 0x1F3FB && r <= 0x1F3FF
+}
+
+// extendsGrapheme reports whether r belongs to the grapheme before it.
+func extendsGrapheme(previous, r rune) bool {
+	switch {
+	case previous == ZERO_WIDTH_JOINER:
+		return true
+	case r == ZERO_WIDTH_JOINER || isEmojiModifier(r):
+		return true
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc):
+		return true
+	}
+	return false
+}
+
+/*
+splitGraphemes splits s into user perceived characters. It covers what a
+chat sees in practice rather than all of UAX #29:
+
+	base followed by combining marks     é as e + U+0301
+	emoji with modifiers and selectors   👍🏽, ❤️
+	emoji joined with U+200D             👩‍💻
+	pairs of regional indicators         flags like 🇩🇪
+*/
+func splitGraphemes(s string) []string {
+	graphemes := []string{}
+	start := 0
+	previous := rune(-1)
+	regionalIndicators := 0
+	for i, r := range s {
+		joins := i > 0 && extendsGrapheme(previous, r)
+		if i > 0 && isRegionalIndicator(r) && isRegionalIndicator(previous) && regionalIndicators%2 == 1 {
+			joins = true
+		}
+		if isRegionalIndicator(r) {
+			regionalIndicators++
+		} else {
+			regionalIndicators = 0
+		}
+		if i > 0 && !joins {
+			graphemes = append(graphemes, s[start:i])
+			start = i
+		}
+		previous = r
+	}
+	if start < len(s) {
+		graphemes = append(graphemes, s[start:])
+	}
+	return graphemes
+}
+
+// graphemeWidth is the number of cells a grapheme takes. Emoji sequences
+// and emoji presentation are drawn wide.
+func graphemeWidth(grapheme string) int {
+	first, size := utf8.DecodeRuneInString(grapheme)
+	width := runeWidth(first)
+	if size < len(grapheme) {
+		for _, r := range grapheme[size:] {
+			if r == VARIATION_SELECTOR || r == ZERO_WIDTH_JOINER || isRegionalIndicator(r) {
+				return 2
+			}
+		}
+	}
+	return width
+}
+
+// stringWidth is the number of terminal cells s takes.
+func stringWidth(s string) int {
+	width := 0
+	for _, grapheme := range splitGraphemes(s) {
+		width += graphemeWidth(grapheme)
+	}
+	return width
+}
+
+// truncateToWidth cuts s to at most width cells, ending it with an ellipsis
+// when something was cut.
+func truncateToWidth(s string, width int) string {
+	if stringWidth(s) <= width {
+		return s
+	}
+	if width < 1 {
+		return ""
+	}
+	return cutToWidth(s, width-1) + "…"
+}
+
+// cutToWidth is the longest prefix of s at most width cells wide.
+func cutToWidth(s string, width int) string {
+	used, length := 0, 0
+	for _, grapheme := range splitGraphemes(s) {
+		used += graphemeWidth(grapheme)
+		if used > width {
+			break
+		}
+		length += len(grapheme)
+	}
+	return s[:length]
+}
+
+/*
+wrapText breaks text into lines at most width cells wide, at spaces where
+it can and inside words longer than a line. The first line starts offset
+cells in, it is left empty when its first word only fits on a line of its
+own. Spaces at a break are dropped.
+*/
+func wrapText(text string, width, offset int) []string {
+	lines := []string{}
+	for _, paragraph := range strings.Split(text, "\n") {
+		line, used := "", offset
+		// byte offset in line just after its last space, -1 if none
+		breakAt := -1
+		graphemes := splitGraphemes(paragraph)
+		for i, grapheme := range graphemes {
+			w := graphemeWidth(grapheme)
+			if used+w > width && (line != "" || used > 0) {
+				switch {
+				case grapheme == " ":
+					lines = append(lines, line)
+					line, used, breakAt = "", 0, -1
+					continue
+				case breakAt > 0:
+					lines = append(lines, strings.TrimRight(line[:breakAt], " "))
+					line = line[breakAt:]
+				case used > stringWidth(line) && stringWidth(line)+wordWidth(graphemes[i:]) <= width:
+					// the word moves below the offset whole
+					lines = append(lines, "")
+				default:
+					lines = append(lines, line)
+					line = ""
+				}
+				used, breakAt = stringWidth(line), -1
+			}
+			line += grapheme
+			used += w
+			if grapheme == " " {
+				breakAt = len(line)
+			}
+		}
+		lines = append(lines, line)
+		offset = 0
+	}
+	return lines
+}
+
+// wordWidth is the width of graphemes up to the first space.
+func wordWidth(graphemes []string) int {
+	width := 0
+	for _, grapheme := range graphemes {
+		if grapheme == " " {
+			break
+		}
+		width += graphemeWidth(grapheme)
+	}
+	return width
+}
+
+// padToWidth pads s with spaces to width cells.
+func padToWidth(s string, width int) string {
+	for w := stringWidth(s); w < width; w++ {
+		s += " "
+	}
+	return s
+}
+
+// trimLastGrapheme removes the last user perceived character of s.
+func trimLastGrapheme(s string) string {
+	graphemes := splitGraphemes(s)
+	if len(graphemes) == 0 {
+		return s
+	}
+	return s[:len(s)-len(graphemes[len(graphemes)-1])]
+}
+
+// TAB_WIDTH is how many spaces a tab is shown as.
+const TAB_WIDTH = 4
+
+// escapeSequence matches CSI and OSC sequences and other escapes.
+var escapeSequence = regexp.MustCompile("\x1b(\\[[0-?]*[ -/]*[@-~]|\\][^\x07\x1b]*(\x07|\x1b\\\\)?|.)?")
+
+// sanitizeText makes text safe to print: line endings become "\n", tabs
+// become spaces and other control characters, escape sequences included,
+// are dropped.
+func sanitizeText(text string) string {
+	text = strings.ToValidUTF8(text, "�")
+	text = escapeSequence.ReplaceAllString(text, "")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	text = strings.ReplaceAll(text, "\t", strings.Repeat(" ", TAB_WIDTH))
+	return strings.Map(func(r rune) rune {
+		if r != '\n' && unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, text)
+}
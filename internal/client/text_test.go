@@ -0,0 +1,139 @@
+package client
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitGraphemes(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"abc", []string{"a", "b", "c"}},
+		{"éa", []string{"é", "a"}},
+		{"日本", []string{"日", "本"}},
+		{"👍🏽!", []string{"👍🏽", "!"}},
+		{"❤️x", []string{"❤️", "x"}},
+		{"👩‍💻👩", []string{"👩‍💻", "👩"}},
+		{"🇩🇪🇫🇷", []string{"🇩🇪", "🇫🇷"}},
+		{"🇩🇪🇫", []string{"🇩🇪", "🇫"}},
+		{"", []string{}},
+	}
+	for _, test := range tests {
+		if got := splitGraphemes(test.text); !slices.Equal(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestStringWidth(t *testing.T) {
+	tests := []struct {
+		text  string
+		width int
+	}{
+		{"hello", 5},
+		{"日本語", 6},
+		{"é", 1},
+		{"👍", 2},
+		{"👍🏽", 2},
+		{"❤", 1},
+		{"❤️", 2},
+		{"👩‍💻", 2},
+		{"🇩🇪", 2},
+		{"a​b", 2},
+		{"한글 ok", 7},
+	}
+	for _, test := range tests {
+		if got := stringWidth(test.text); got != test.width {
+			t.Errorf("%q: width %d, want %d", test.text, got, test.width)
+		}
+	}
+}
+
+func TestCutToWidth(t *testing.T) {
+	tests := []struct {
+		text      string
+		width     int
+		cut       string
+		truncated string
+	}{
+		{"hello", 5, "hello", "hello"},
+		{"hello", 4, "hell", "hel…"},
+		// a wide character that does not fit is left out whole
+		{"日本語", 5, "日本", "日本…"},
+		{"日本語", 3, "日", "日…"},
+		{"ééé", 2, "éé", "é…"},
+		{"👩‍💻👩‍💻", 3, "👩‍💻", "👩‍💻…"},
+		{"abc", 0, "", ""},
+	}
+	for _, test := range tests {
+		if got := cutToWidth(test.text, test.width); got != test.cut {
+			t.Errorf("cut %q to %d: got %q, want %q", test.text, test.width, got, test.cut)
+		}
+		if got := truncateToWidth(test.text, test.width); got != test.truncated {
+			t.Errorf("truncate %q to %d: got %q, want %q", test.text, test.width, got, test.truncated)
+		}
+	}
+}
+
+func TestWrapText(t *testing.T) {
+	tests := []struct {
+		text   string
+		width  int
+		offset int
+		want   []string
+	}{
+		{"hello world", 5, 0, []string{"hello", "world"}},
+		{"hello world", 8, 0, []string{"hello", "world"}},
+		{"one two three", 9, 0, []string{"one two", "three"}},
+		{"abcdefgh", 3, 0, []string{"abc", "def", "gh"}},
+		{"a\nb", 5, 0, []string{"a", "b"}},
+		// the first line starts after the offset
+		{"hello world", 8, 4, []string{"", "hello", "world"}},
+		{"hi there", 8, 4, []string{"hi", "there"}},
+		{"abcdefghij", 8, 4, []string{"abcd", "efghij"}},
+		// wide characters never straddle a line
+		{"日本語テキスト", 5, 0, []string{"日本", "語テ", "キス", "ト"}},
+		{"日本 語", 4, 0, []string{"日本", "語"}},
+		{"👍🏽👍🏽👍🏽", 5, 0, []string{"👍🏽👍🏽", "👍🏽"}},
+		{"ééé", 2, 0, []string{"éé", "é"}},
+	}
+	for _, test := range tests {
+		got := wrapText(test.text, test.width, test.offset)
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%q in %d from %d: got %q, want %q", test.text, test.width, test.offset, got, test.want)
+			continue
+		}
+		for i, line := range got {
+			limit := test.width
+			if i == 0 {
+				limit -= test.offset
+			}
+			if stringWidth(line) > limit {
+				t.Errorf("%q: line %q wider than %d", test.text, line, limit)
+			}
+		}
+	}
+}
+
+func TestSanitizeText(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"plain", "plain"},
+		{"a\r\nb\rc", "a\nb\nc"},
+		{"\tx", "    x"},
+		{"red \x1b[31mtext\x1b[0m", "red text"},
+		{"title \x1b]0;owned\x07done", "title done"},
+		{"bell\x07 nul\x00", "bell nul"},
+		{"bad \xff utf8", "bad � utf8"},
+		{"日本 👩‍💻", "日本 👩‍💻"},
+	}
+	for _, test := range tests {
+		if got := sanitizeText(test.text); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.text, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package client
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
+)
+
+// Run with -update to rewrite the snapshots in testdata after a deliberate
+// change to the UI.
+
+var presence = []string{protocol.CAPABILITY_PRESENCE}
+
+func chatFrom(from, content string) *protocol.Chat {
+	return &protocol.Chat{FromUsername: from, ToUsername: "alice", Content: content, Timestamp: HARNESS_TIME}
+}
+
+func TestVirtualTerminalWraps(t *testing.T) {
+	vt := NewVirtualTerminal(4, 3)
+	fmt.Fprint(vt, "abcdef")
+	if text := vt.Text(); text != "abcd\nef\n\n" {
+		t.Fatalf("wrapped into %q", text)
+	}
+	// printing in the last column of the last row scrolls only when the
+	// next character comes
+	fmt.Fprint(vt, "\x1b[3;4H", "x")
+	if text := vt.Text(); text != "abcd\nef\n   x\n" {
+		t.Fatalf("scrolled early %q", text)
+	}
+	fmt.Fprint(vt, "界")
+	if text := vt.Text(); text != "ef\n   x\n界\n" {
+		t.Fatalf("wrapped into %q", text)
+	}
+	fmt.Fprint(vt, "\x1b[2J\x1b[1;1H", "e\u0301👍\x1b[K")
+	if text := vt.Text(); text != "e\u0301👍\n\n\n" {
+		t.Fatalf("marks and wide characters %q", text)
+	}
+	if row, col, _ := vt.Cursor(); row != 1 || col != 4 {
+		t.Fatalf("cursor at %d,%d", row, col)
+	}
+}
+
+func TestContactList(t *testing.T) {
+	h := NewHarness(t, "alice", presence, 60, 12)
+	h.Receive(&protocol.Presence{Users: []string{"alice", "bob", "carol"}})
+	h.Receive(chatFrom("dave", "are you there?"), chatFrom("dave", "hello?"))
+	h.MatchGolden("list_unread")
+	h.Press(Key(KEY_TYPE_RIGHT_ARROW), Key(KEY_TYPE_DOWN_ARROW))
+	h.MatchGolden("list_online")
+}
+
+func TestSendMessage(t *testing.T) {
+	h := NewHarness(t, "alice", presence, 60, 12)
+	h.Receive(&protocol.Presence{Users: []string{"alice", "bob"}})
+	h.Receive(chatFrom("bob", "hi alice"))
+	h.Press(Key(KEY_TYPE_ENTER))
+	h.Type("hi bob")
+	h.MatchGolden("chat_compose")
+	h.Press(Key(KEY_TYPE_ENTER))
+	h.MatchGolden("chat_sent")
+
+	send, ok := h.LastSent().(*protocol.Send)
+	if !ok || send.ToUsername != "bob" || send.Content != "hi bob" {
+		t.Fatalf("sent %#v", h.LastSent())
+	}
+}
+
+func TestWrapAndResize(t *testing.T) {
+	h := NewHarness(t, "alice", presence, 60, 14)
+	h.Receive(&protocol.Presence{Users: []string{"alice", "bob"}})
+	h.Receive(chatFrom("bob", strings.Repeat("a long message that wraps ", 4)))
+	h.Press(Key(KEY_TYPE_ENTER))
+	h.MatchGolden("wrap_wide")
+	h.Resize(40, 14)
+	h.MatchGolden("wrap_narrow")
+	// taller than the view, cut at the bottom
+	h.Resize(40, 10)
+	h.MatchGolden("wrap_cut")
+}
+
+func TestMultiLinePaste(t *testing.T) {
+	h := NewHarness(t, "alice", presence, 60, 14)
+	h.Receive(&protocol.Presence{Users: []string{"alice", "bob"}})
+	h.Press(Key(KEY_TYPE_RIGHT_ARROW), Key(KEY_TYPE_ENTER))
+	h.Paste("first line\r\nsecond\tline\x1b[31m\r\n")
+	h.Type("third")
+	h.MatchGolden("paste_compose")
+	h.Press(Key(KEY_TYPE_ENTER))
+	h.MatchGolden("paste_sent")
+}
+
+func TestReplyThread(t *testing.T) {
+	h := NewHarness(t, "alice", presence, 70, 14)
+	h.Receive(&protocol.Presence{Users: []string{"alice", "bob"}})
+	h.Receive(chatFrom("bob", "lunch?"), chatFrom("bob", "or coffee"))
+	h.Press(Key(KEY_TYPE_ENTER), Key(KEY_TYPE_TAB), Key(KEY_TYPE_UP_ARROW))
+	h.MatchGolden("reply_select")
+	h.Type("r")
+	h.Type("lunch")
+	h.Press(Key(KEY_TYPE_ENTER))
+	h.MatchGolden("reply_sent")
+
+	send := h.LastSent().(*protocol.Send)
+	if send.ReplyTo != "r2" || send.ReplyToFrom != "bob" {
+		t.Fatalf("reply to %q from %q, want r2 from bob", send.ReplyTo, send.ReplyToFrom)
+	}
+	h.Press(Key(KEY_TYPE_TAB), Key(KEY_TYPE_UP_ARROW), Key(KEY_TYPE_UP_ARROW))
+	h.Type("t")
+	h.MatchGolden("reply_thread")
+}
+
+func TestSplitPane(t *testing.T) {
+	h := NewHarness(t, "alice", presence, 110, 12)
+	h.State.split = true
+	h.Receive(&protocol.Presence{Users: []string{"alice", "bob", "carol"}})
+	h.Receive(chatFrom("bob", "hi there"))
+	h.Press(Key(KEY_TYPE_ENTER))
+	h.Type("draft")
+	h.Receive(chatFrom("carol", "ping"))
+	h.MatchGolden("split_chat")
+	h.Press(Key(KEY_TYPE_CTRL_O))
+	h.MatchGolden("split_list")
+	h.Resize(80, 12)
+	h.MatchGolden("split_narrow")
+}
+
+func TestNewChat(t *testing.T) {
+	h := NewHarness(t, "alice", presence, 60, 12)
+	h.Receive(&protocol.Presence{Users: []string{"alice", "carl", "carol"}})
+	h.Press(Key(KEY_TYPE_CTRL_N))
+	h.Type("c")
+	h.Press(Key(KEY_TYPE_TAB))
+	h.MatchGolden("new_chat_complete")
+	h.Press(Key(KEY_TYPE_BACKSPACE), Key(KEY_TYPE_BACKSPACE), Key(KEY_TYPE_BACKSPACE))
+	h.Type("dave")
+	h.Press(Key(KEY_TYPE_ENTER))
+	h.MatchGolden("new_chat_open")
+	if _, ok := h.State.chats["dave"]; !ok {
+		t.Fatal("no chat with dave")
+	}
+}
+
+func TestIdentityStaysInTempHome(t *testing.T) {
+	h := NewHarness(t, "alice", []string{protocol.CAPABILITY_PRESENCE, protocol.CAPABILITY_E2E}, 60, 12)
+	if h.State.identity == nil {
+		t.Fatal("no identity: ", h.State.status)
+	}
+	if !strings.HasPrefix(identityPath("alice"), os.Getenv("HOME")) || !fileExists(identityPath("alice")) {
+		t.Fatalf("identity at %s, HOME is %s", identityPath("alice"), os.Getenv("HOME"))
+	}
+}
+
+func TestOversizedDraftKept(t *testing.T) {
+	h := NewHarness(t, "alice", []string{protocol.CAPABILITY_PRESENCE, protocol.CAPABILITY_EDIT}, 60, 12)
+	h.Receive(&protocol.Presence{Users: []string{"alice", "bob"}})
+	h.Receive(chatFrom("bob", "hi alice"))
+	h.Press(Key(KEY_TYPE_ENTER))
+	// pastes are limited, typing is not
+	draft := strings.Repeat("a", protocol.MAX_CONTENT_SIZE) + "b"
+	h.Paste(draft[:protocol.MAX_CONTENT_SIZE])
+	h.Type("b")
+	h.Press(Key(KEY_TYPE_ENTER))
+	if h.State.exit || len(h.Sent) != 0 {
+		t.Fatalf("exit %v, sent %d frames", h.State.exit, len(h.Sent))
+	}
+	if h.State.currentText != draft || !strings.Contains(h.State.status, "larger than") {
+		t.Fatalf("draft of %d bytes, status %q", len(h.State.currentText), h.State.status)
+	}
+	if messages := h.State.chats["bob"].Messages; len(messages) != 1 {
+		t.Fatalf("%d messages in the chat", len(messages))
+	}
+
+	// the same for an edit of an own message
+	h.Press(Key(KEY_TYPE_CTRL_U))
+	h.Type("short")
+	h.Press(Key(KEY_TYPE_ENTER), Key(KEY_TYPE_TAB))
+	h.Type("e")
+	h.Press(Key(KEY_TYPE_CTRL_U))
+	h.Paste(draft[:protocol.MAX_CONTENT_SIZE])
+	h.Type("b")
+	h.Press(Key(KEY_TYPE_ENTER))
+	if h.State.exit || len(h.Sent) != 1 || h.State.editingID == "" {
+		t.Fatalf("exit %v, sent %d frames, editing %q", h.State.exit, len(h.Sent), h.State.editingID)
+	}
+	if message, _ := findMessage(h.State, "bob", "alice", h.State.editingID); message.Content != "short" {
+		t.Fatalf("edited to %d bytes", len(message.Content))
+	}
+}
+
+func testIdentity(t *testing.T) *Identity {
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchangeKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newIdentity(signingKey, exchangeKey)
+}
+
+// sealedFrom is a chat from bob to alice sealed by sender, with the id the
+// harness gives the next frame it receives.
+func sealedFrom(h *Harness, sender *Identity, content string) *protocol.Chat {
+	h.t.Helper()
+	id := fmt.Sprint("r", h.received+1)
+	sealed, err := seal(sender, h.State.identity.Bundle, "bob", "alice", id, content)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return &protocol.Chat{FromUsername: "bob", ToUsername: "alice", Sealed: sealed, Timestamp: HARNESS_TIME}
+}
+
+func TestChangedKeyWithheld(t *testing.T) {
+	h := NewHarness(t, "alice", []string{protocol.CAPABILITY_PRESENCE, protocol.CAPABILITY_E2E}, 70, 12)
+	h.Receive(&protocol.Presence{Users: []string{"alice", "bob"}})
+	first, second := testIdentity(t), testIdentity(t)
+	h.Receive(sealedFrom(h, first, "pinned key"))
+	h.Receive(sealedFrom(h, second, "attacker text"))
+	h.Press(Key(KEY_TYPE_ENTER))
+	if strings.Contains(h.Terminal.Text(), "attacker text") {
+		t.Fatal("message from a changed key shown")
+	}
+	messages := h.State.chats["bob"].Messages
+	if messages[0].Content != "pinned key" || messages[1].Content != WITHHELD_TEXT || !messages[1].KeyChanged {
+		t.Fatalf("messages %q %q", messages[0].Content, messages[1].Content)
+	}
+
+	// shown once the new key is verified
+	h.Press(Key(KEY_TYPE_CTRL_F))
+	h.Receive(&protocol.Keys{Username: "bob", Bundle: &second.Bundle})
+	h.Press(Key(KEY_TYPE_ENTER))
+	if messages := h.State.chats["bob"].Messages; messages[1].Content != "attacker text" || messages[1].KeyChanged {
+		t.Fatalf("after verifying %q", messages[1].Content)
+	}
+	if !strings.Contains(h.Terminal.Text(), "attacker text") {
+		t.Fatalf("not shown after verifying:\n%s", h.Terminal.Text())
+	}
+}
+
+func TestSealedKeptUntilIdentityLoaded(t *testing.T) {
+	capabilities := []string{protocol.CAPABILITY_PRESENCE, protocol.CAPABILITY_E2E}
+	h := NewHarness(t, "alice", capabilities, 60, 12)
+	h.Receive(&protocol.Presence{Users: []string{"alice", "bob"}})
+	bob := testIdentity(t)
+	sealed := sealedFrom(h, bob, "for alice")
+	// the identity failed to load in this session
+	h.State.identity = nil
+	h.Receive(sealed)
+	message := h.State.chats["bob"].Messages[0]
+	if message.Sealed == nil || message.Content != "[encrypted message]" {
+		t.Fatalf("sealed %v, content %q", message.Sealed != nil, message.Content)
+	}
+
+	// the next session loads the identity from HOME
+	restarted := NewUIState("alice", harnessConn{h}, capabilities, nil, PersistedState{Chats: h.State.chats}, h.Terminal, 60, 12)
+	message = restarted.chats["bob"].Messages[0]
+	if message.Sealed != nil || message.Content != "for alice" || !message.Encrypted {
+		t.Fatalf("sealed %v, content %q", message.Sealed != nil, message.Content)
+	}
+	if restarted.chats["bob"].PeerFingerprint != bob.Bundle.Fingerprint() {
+		t.Fatal("sender key not pinned")
+	}
+}
+
+// receiveWithID handles payload in a frame with the given id.
+func receiveWithID(h *Harness, id string, payload protocol.Payload) {
+	frame := protocol.NewFrame(payload)
+	frame.ID = id
+	handleWSMessage(h.State, frame)
+}
+
+func TestMessagesKeyedBySender(t *testing.T) {
+	h := NewHarness(t, "alice", []string{protocol.CAPABILITY_PRESENCE, protocol.CAPABILITY_EDIT}, 60, 12)
+	h.Receive(&protocol.Presence{Users: []string{"alice", "bob"}})
+	h.Receive(chatFrom("bob", "hi alice"))
+	h.Press(Key(KEY_TYPE_ENTER))
+	h.Type("mine")
+	h.Press(Key(KEY_TYPE_ENTER))
+	id := h.Sent[len(h.Sent)-1].ID
+
+	// bob reuses the id of the message alice sent
+	receiveWithID(h, id, chatFrom("bob", "his"))
+	receiveWithID(h, "e1", &protocol.EditMessage{FromUsername: "bob", ToUsername: "alice", MessageID: id, Content: "edited"})
+	receiveWithID(h, id, chatFrom("bob", "again"))
+	// alice edits her message, above the one from bob
+	h.Press(Key(KEY_TYPE_TAB), Key(KEY_TYPE_UP_ARROW))
+	h.Type("e")
+	h.Press(Key(KEY_TYPE_CTRL_U))
+	h.Type("mine too")
+	h.Press(Key(KEY_TYPE_ENTER))
+	mine, _ := findMessage(h.State, "bob", "alice", id)
+	his, _ := findMessage(h.State, "bob", "bob", id)
+	if mine.Content != "mine too" || his.Content != "edited" {
+		t.Fatalf("alice has %q, bob has %q", mine.Content, his.Content)
+	}
+	if messages := h.State.chats["bob"].Messages; len(messages) != 3 {
+		t.Fatalf("%d messages in the chat, the repeated id was not dropped", len(messages))
+	}
+
+	receiveWithID(h, "d1", &protocol.DeleteMessage{FromUsername: "bob", ToUsername: "alice", MessageID: id})
+	mine, _ = findMessage(h.State, "bob", "alice", id)
+	his, _ = findMessage(h.State, "bob", "bob", id)
+	if mine.Deleted || !his.Deleted {
+		t.Fatalf("bob deleted alice's message %v, his own %v", mine.Deleted, his.Deleted)
+	}
+}
+
+func TestReactionKeyedByAuthor(t *testing.T) {
+	capabilities := []string{protocol.CAPABILITY_PRESENCE, protocol.CAPABILITY_REACTIONS}
+	h := NewHarness(t, "alice", capabilities, 60, 12)
+	h.Receive(&protocol.Presence{Users: []string{"alice", "bob"}})
+	h.Receive(chatFrom("bob", "hi alice"))
+	h.Press(Key(KEY_TYPE_ENTER))
+	h.Type("mine")
+	h.Press(Key(KEY_TYPE_ENTER))
+	id := h.Sent[len(h.Sent)-1].ID
+	// bob reuses the id of the message alice sent and reacts to his own
+	receiveWithID(h, id, chatFrom("bob", "his"))
+	h.Receive(&protocol.Reaction{FromUsername: "bob", ToUsername: "alice", MessageFrom: "bob", MessageID: id, Emoji: "👍"})
+	mine, _ := findMessage(h.State, "bob", "alice", id)
+	his, _ := findMessage(h.State, "bob", "bob", id)
+	if len(mine.Reactions) != 0 || len(his.Reactions["👍"]) != 1 {
+		t.Fatalf("alice has %v, bob has %v", mine.Reactions, his.Reactions)
+	}
+
+	// alice reacts to her own message, the author goes with the reaction
+	h.Press(Key(KEY_TYPE_TAB), Key(KEY_TYPE_UP_ARROW))
+	h.Type("+")
+	reaction, ok := h.LastSent().(*protocol.Reaction)
+	if !ok || reaction.MessageFrom != "alice" || reaction.MessageID != id {
+		t.Fatalf("sent %#v", h.LastSent())
+	}
+}
+
+func TestReplyKeyedByAuthor(t *testing.T) {
+	h := NewHarness(t, "alice", presence, 60, 12)
+	h.Receive(&protocol.Presence{Users: []string{"alice", "bob"}})
+	h.Receive(chatFrom("bob", "hi alice"))
+	h.Press(Key(KEY_TYPE_ENTER))
+	h.Type("mine")
+	h.Press(Key(KEY_TYPE_ENTER))
+	id := h.Sent[len(h.Sent)-1].ID
+	// bob reuses the id of the message alice sent and replies to his own
+	receiveWithID(h, id, chatFrom("bob", "his"))
+	reply := chatFrom("bob", "about mine")
+	reply.ReplyTo, reply.ReplyToFrom = id, "bob"
+	h.Receive(reply)
+
+	messages := h.State.chats["bob"].Messages
+	mine, _ := findMessage(h.State, "bob", "alice", id)
+	his, _ := findMessage(h.State, "bob", "bob", id)
+	if quote := quoteOf(messages, parentOf(messages[len(messages)-1])); quote != "bob: his" {
+		t.Fatalf("quoted %q", quote)
+	}
+	if replyCount(messages, mine) != 0 || replyCount(messages, his) != 1 {
+		t.Fatalf("replies to alice %d, to bob %d", replyCount(messages, mine), replyCount(messages, his))
+	}
+	if thread := threadMessages(messages, refOf(mine)); len(thread) != 1 {
+		t.Fatalf("thread of alice's message has %d messages", len(thread))
+	}
+}
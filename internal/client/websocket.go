@@ -1,41 +1,214 @@
 package client
 
 import (
+	"compress/flate"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
 	"net/url"
 
 	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
 	"github.com/gorilla/websocket"
 )
 
-func connect(username string, url url.URL) (*websocket.Conn, error) {
-	log.Printf("connecting to %s", url.String())
-	c, _, err := websocket.DefaultDialer.Dial(url.String(), nil)
+const (
+	CLIENT_NAME    = "GoChatTUI"
+	CLIENT_VERSION = "1.0"
+)
+
+var clientCapabilities = []string{
+	protocol.CAPABILITY_PRESENCE,
+	protocol.CAPABILITY_E2E,
+	protocol.CAPABILITY_FILES,
+	protocol.CAPABILITY_EDIT,
+	protocol.CAPABILITY_REACTIONS,
+}
+
+const (
+	TRANSPORT_AUTO      = "auto"
+	TRANSPORT_WEBSOCKET = "ws"
+	TRANSPORT_SSE       = "sse"
+	TRANSPORT_POLL      = "poll"
+)
+
+// Conn is a message oriented connection to the server.
+type Conn interface {
+	ReadMessage() ([]byte, error)
+	WriteMessage(data []byte) error
+	Close() error
+}
+
+// CompressionConfig configures permessage-deflate on the websocket transport.
+// Frames smaller than Threshold bytes are sent uncompressed.
+type CompressionConfig struct {
+	Enabled   bool
+	Level     int
+	Threshold int
+}
+
+var compression = CompressionConfig{
+	Enabled:   true,
+	Level:     flate.BestSpeed,
+	Threshold: 256,
+}
+
+func SetCompression(config CompressionConfig) error {
+	if config.Enabled && (config.Level < flate.HuffmanOnly || config.Level > flate.BestCompression) {
+		return errors.New("invalid compression level")
+	}
+	compression = config
+	wsDialer.EnableCompression = config.Enabled
+	return nil
+}
+
+var wsDialer = websocket.Dialer{
+	Proxy:             http.ProxyFromEnvironment,
+	HandshakeTimeout:  websocket.DefaultDialer.HandshakeTimeout,
+	EnableCompression: true,
+}
+
+type websocketConn struct {
+	conn *websocket.Conn
+}
+
+func (c *websocketConn) ReadMessage() ([]byte, error) {
+	_, data, err := c.conn.ReadMessage()
+	return data, err
+}
+
+func (c *websocketConn) WriteMessage(data []byte) error {
+	c.conn.EnableWriteCompression(compression.Enabled && len(data) >= compression.Threshold)
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (c *websocketConn) Close() error {
+	return c.conn.Close()
+}
+
+// connect opens a connection with the chosen transport, negotiates the
+// protocol and claims username. With TRANSPORT_AUTO websocket is tried first,
+// falling back to server sent events when the upgrade fails.
+func connect(username string, url url.URL, transport string) (Conn, *protocol.Welcome, error) {
+	var conn Conn
+	var err error
+	switch transport {
+	case TRANSPORT_WEBSOCKET:
+		conn, err = dialWebsocket(url)
+	case TRANSPORT_SSE, TRANSPORT_POLL:
+		conn, err = dialHTTP(url, transport)
+	case TRANSPORT_AUTO:
+		conn, err = dialWebsocket(url)
+		if err != nil {
+			log.Printf("websocket failed (%v), falling back to %s", err, TRANSPORT_SSE)
+			conn, err = dialHTTP(url, TRANSPORT_SSE)
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown transport: %s", transport)
+	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	welcome, err := handshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
 	}
-	message := protocol.ClaimUsernameRequest{
+	message := protocol.ClaimUsername{
 		Username: username,
 	}
-	err = c.WriteJSON(&message)
+	if err = writeFrame(conn, protocol.NewFrame(&message)); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, welcome, nil
+}
+
+func handshake(conn Conn) (*protocol.Welcome, error) {
+	err := writeFrame(conn, protocol.NewFrame(&protocol.Hello{
+		ProtocolVersion: protocol.PROTOCOL_VERSION,
+		ClientName:      CLIENT_NAME,
+		ClientVersion:   CLIENT_VERSION,
+		Capabilities:    clientCapabilities,
+	}))
+	if err != nil {
+		return nil, err
+	}
+	frame, err := readFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+	switch payload := frame.Payload.(type) {
+	case *protocol.Welcome:
+		if _, err := protocol.NegotiateVersion(payload.ProtocolVersion); err != nil {
+			return nil, err
+		}
+		return payload, nil
+	case *protocol.Error:
+		return nil, fmt.Errorf("server rejected client: %s", payload.Message)
+	default:
+		return nil, fmt.Errorf("unexpected handshake reply: %s", frame.Type())
+	}
+}
+
+func dialWebsocket(url url.URL) (Conn, error) {
+	log.Printf("connecting to %s", url.String())
+	c, _, err := wsDialer.Dial(url.String(), nil)
 	if err != nil {
 		return nil, err
 	}
-	return c, nil
+	if compression.Enabled {
+		c.SetCompressionLevel(compression.Level)
+	}
+	return &websocketConn{conn: c}, nil
+}
+
+func readFrame(conn Conn) (protocol.Frame, error) {
+	data, err := conn.ReadMessage()
+	if err != nil {
+		return protocol.Frame{}, err
+	}
+	return protocol.Decode(data)
+}
+
+func writeFrame(conn Conn, frame protocol.Frame) error {
+	data, err := protocol.Encode(frame)
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(data)
+}
+
+// sendFrame sends frame for the UI, reporting whether it was sent. A frame
+// that does not validate is reported on the status line and the connection
+// stays up, only a failed write closes it and exits.
+func sendFrame(state *UIState, frame protocol.Frame) bool {
+	data, err := protocol.Encode(frame)
+	if err != nil {
+		state.status = "not sent: " + err.Error()
+		return false
+	}
+	if err := state.conn.WriteMessage(data); err != nil {
+		state.conn.Close()
+		state.exit = true
+		return false
+	}
+	return true
 }
 
-func listenWSEvents(conn *websocket.Conn, messages chan protocol.Message) {
+// listenWSEvents reads frames until the connection fails, frames that do
+// not decode are skipped.
+func listenWSEvents(conn Conn, frames chan protocol.Frame) {
 	for {
-		message := protocol.Message{}
-		err := conn.ReadJSON(&message)
+		data, err := conn.ReadMessage()
 		if err != nil {
-			close(messages)
+			close(frames)
 			break
 		}
-		messages <- message
+		frame, err := protocol.Decode(data)
+		if err != nil {
+			continue
+		}
+		frames <- frame
 	}
 }
-
-func writeMessage(conn *websocket.Conn, message protocol.Message) error {
-	return conn.WriteJSON(message)
-}
@@ -0,0 +1,165 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrMalformedFrame = errors.New("malformed frame")
+	ErrUnknownType    = errors.New("unknown message type")
+	ErrInvalidPayload = errors.New("invalid payload")
+)
+
+// Envelope is the wire format of every frame:
+//
+//	{"type": "CHAT", "id": "...", "payload": {...}}
+type Envelope struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Payload is the typed body of a frame, every type is registered under the
+// name returned by MessageType.
+type Payload interface {
+	MessageType() string
+	Validate() error
+}
+
+// Frame is a decoded envelope.
+type Frame struct {
+	ID      string
+	Payload Payload
+}
+
+func (f Frame) Type() string {
+	return f.Payload.MessageType()
+}
+
+// Codec turns frames into wire messages. JSON is always available and is
+// used for the handshake; other codecs are switched to once negotiated.
+type Codec interface {
+	Name() string
+	// Binary codecs need a transport that carries binary messages.
+	Binary() bool
+	Encode(frame Frame) ([]byte, error)
+	Decode(data []byte) (Frame, error)
+}
+
+type jsonCodec struct{}
+
+var JSONCodec Codec = jsonCodec{}
+
+func (jsonCodec) Name() string                       { return "json" }
+func (jsonCodec) Binary() bool                       { return false }
+func (jsonCodec) Encode(frame Frame) ([]byte, error) { return Encode(frame) }
+func (jsonCodec) Decode(data []byte) (Frame, error)  { return Decode(data) }
+
+// NegotiatedCodec returns the codec selected by the negotiated capabilities.
+func NegotiatedCodec(capabilities []string) Codec {
+	if HasCapability(capabilities, CAPABILITY_MSGPACK) {
+		return MsgpackCodec
+	}
+	return JSONCodec
+}
+
+var registry = map[string]func() Payload{}
+
+// Register adds a payload type to the registry used by Decode.
+func Register(newPayload func() Payload) {
+	registry[newPayload().MessageType()] = newPayload
+}
+
+func NewFrame(payload Payload) Frame {
+	return Frame{Payload: payload}
+}
+
+// MAX_ID_LENGTH bounds ids that refer to frames, like message ids.
+const MAX_ID_LENGTH = 32
+
+// ValidateID accepts ids of up to MAX_ID_LENGTH letters, digits, '-' and
+// '_'. Frame ids become message ids, so they are held to the same rules as
+// the ids that refer to messages later.
+func ValidateID(id string) error {
+	if id == "" || len(id) > MAX_ID_LENGTH {
+		return errors.New("invalid id length")
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return errors.New("invalid character in id")
+		}
+	}
+	return nil
+}
+
+// NewID returns a random frame id.
+func NewID() string {
+	bytes := make([]byte, 8)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+func Encode(frame Frame) ([]byte, error) {
+	if frame.Payload == nil {
+		return nil, fmt.Errorf("%w: missing payload", ErrInvalidPayload)
+	}
+	if err := frame.Payload.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidPayload, frame.Type(), err)
+	}
+	payload, err := json.Marshal(frame.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&Envelope{
+		Type:    frame.Type(),
+		ID:      frame.ID,
+		Payload: payload,
+	})
+}
+
+// Decode parses and validates a frame, rejecting unknown types, unknown
+// fields and trailing data.
+func Decode(data []byte) (Frame, error) {
+	var envelope Envelope
+	if err := decodeStrict(data, &envelope); err != nil {
+		return Frame{}, err
+	}
+	if envelope.ID != "" {
+		if err := ValidateID(envelope.ID); err != nil {
+			return Frame{}, fmt.Errorf("%w: frame id: %v", ErrMalformedFrame, err)
+		}
+	}
+	newPayload, has := registry[envelope.Type]
+	if !has {
+		return Frame{}, fmt.Errorf("%w: %q", ErrUnknownType, envelope.Type)
+	}
+	if len(envelope.Payload) == 0 || string(envelope.Payload) == "null" {
+		return Frame{}, fmt.Errorf("%w: missing payload", ErrMalformedFrame)
+	}
+	payload := newPayload()
+	if err := decodeStrict(envelope.Payload, payload); err != nil {
+		return Frame{}, err
+	}
+	if err := payload.Validate(); err != nil {
+		return Frame{}, fmt.Errorf("%w: %s: %v", ErrInvalidPayload, envelope.Type, err)
+	}
+	return Frame{ID: envelope.ID, Payload: payload}, nil
+}
+
+func decodeStrict(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedFrame, err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return fmt.Errorf("%w: trailing data", ErrMalformedFrame)
+	}
+	return nil
+}
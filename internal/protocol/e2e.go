@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+const MESSAGE_TYPE_PUBLISH_KEYS = "PUBLISH_KEYS"
+const MESSAGE_TYPE_REQUEST_KEYS = "REQUEST_KEYS"
+const MESSAGE_TYPE_KEYS = "KEYS"
+
+const X25519_KEY_SIZE = 32
+const AEAD_NONCE_SIZE = 12
+const AEAD_OVERHEAD = 16
+
+func init() {
+	Register(func() Payload { return &PublishKeys{} })
+	Register(func() Payload { return &RequestKeys{} })
+	Register(func() Payload { return &Keys{} })
+}
+
+// KeyBundle holds the public keys of a user: an ed25519 identity key and an
+// x25519 key for key exchange, signed by the identity key.
+type KeyBundle struct {
+	IdentityKey []byte `json:"identityKey"`
+	ExchangeKey []byte `json:"exchangeKey"`
+	Signature   []byte `json:"signature"`
+}
+
+// PublishKeys stores the sender's bundle in the server key directory.
+type PublishKeys struct {
+	Bundle KeyBundle `json:"bundle"`
+}
+
+// RequestKeys asks the server for the bundle of Username.
+type RequestKeys struct {
+	Username string `json:"username"`
+}
+
+// Keys answers RequestKeys, Bundle is nil when the user never published one.
+type Keys struct {
+	Username string     `json:"username"`
+	Bundle   *KeyBundle `json:"bundle,omitempty"`
+}
+
+// Sealed is an end-to-end encrypted message body. The server relays it
+// without being able to read it.
+type Sealed struct {
+	Sender       KeyBundle `json:"sender"`
+	EphemeralKey []byte    `json:"ephemeralKey"`
+	Nonce        []byte    `json:"nonce"`
+	Ciphertext   []byte    `json:"ciphertext"`
+}
+
+func (*PublishKeys) MessageType() string { return MESSAGE_TYPE_PUBLISH_KEYS }
+func (*RequestKeys) MessageType() string { return MESSAGE_TYPE_REQUEST_KEYS }
+func (*Keys) MessageType() string        { return MESSAGE_TYPE_KEYS }
+
+// Verify checks key sizes and the identity signature over the exchange key.
+func (b *KeyBundle) Verify() error {
+	if len(b.IdentityKey) != ed25519.PublicKeySize {
+		return errors.New("invalid identity key")
+	}
+	if len(b.ExchangeKey) != X25519_KEY_SIZE {
+		return errors.New("invalid exchange key")
+	}
+	if !ed25519.Verify(b.IdentityKey, b.ExchangeKey, b.Signature) {
+		return errors.New("invalid key signature")
+	}
+	return nil
+}
+
+// Fingerprint is the sha256 of the identity key, in groups of four hex
+// digits for reading out loud.
+func (b *KeyBundle) Fingerprint() string {
+	sum := sha256.Sum256(b.IdentityKey)
+	digits := hex.EncodeToString(sum[:16])
+	groups := make([]string, 0, len(digits)/4)
+	for i := 0; i < len(digits); i += 4 {
+		groups = append(groups, digits[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+func (p *PublishKeys) Validate() error {
+	return p.Bundle.Verify()
+}
+
+func (p *RequestKeys) Validate() error {
+	return ValidateUsername(p.Username)
+}
+
+func (p *Keys) Validate() error {
+	if err := ValidateUsername(p.Username); err != nil {
+		return err
+	}
+	if p.Bundle != nil {
+		return p.Bundle.Verify()
+	}
+	return nil
+}
+
+func (s *Sealed) Validate() error {
+	if err := s.Sender.Verify(); err != nil {
+		return err
+	}
+	if len(s.EphemeralKey) != X25519_KEY_SIZE {
+		return errors.New("invalid ephemeral key")
+	}
+	if len(s.Nonce) != AEAD_NONCE_SIZE {
+		return errors.New("invalid nonce")
+	}
+	if len(s.Ciphertext) < AEAD_OVERHEAD || len(s.Ciphertext) > MAX_CONTENT_SIZE+AEAD_OVERHEAD {
+		return errors.New("invalid ciphertext size")
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package protocol
+
+import "fmt"
+
+const MESSAGE_TYPE_EDIT_MESSAGE = "EDIT_MESSAGE"
+const MESSAGE_TYPE_DELETE_MESSAGE = "DELETE_MESSAGE"
+
+func init() {
+	Register(func() Payload { return &EditMessage{} })
+	Register(func() Payload { return &DeleteMessage{} })
+}
+
+// EditMessage replaces the body of the message MessageID, sent earlier by
+// the same user. Like FILE_* frames it is relayed with FromUsername set by
+// the server, recipients ignore edits of messages from someone else.
+type EditMessage struct {
+	FromUsername string  `json:"fromUsername,omitempty"`
+	ToUsername   string  `json:"toUsername"`
+	MessageID    string  `json:"messageId"`
+	Content      string  `json:"content,omitempty"`
+	Sealed       *Sealed `json:"sealed,omitempty"`
+}
+
+// DeleteMessage retracts the message MessageID for everyone.
+type DeleteMessage struct {
+	FromUsername string `json:"fromUsername,omitempty"`
+	ToUsername   string `json:"toUsername"`
+	MessageID    string `json:"messageId"`
+}
+
+func (*EditMessage) MessageType() string   { return MESSAGE_TYPE_EDIT_MESSAGE }
+func (*DeleteMessage) MessageType() string { return MESSAGE_TYPE_DELETE_MESSAGE }
+
+func (p *EditMessage) Recipient() string           { return p.ToUsername }
+func (p *EditMessage) SetSender(username string)   { p.FromUsername = username }
+func (p *EditMessage) Capability() string          { return CAPABILITY_EDIT }
+func (p *DeleteMessage) Recipient() string         { return p.ToUsername }
+func (p *DeleteMessage) SetSender(username string) { p.FromUsername = username }
+func (p *DeleteMessage) Capability() string        { return CAPABILITY_EDIT }
+
+func validateMessageReference(from, to, id string) error {
+	if from != "" {
+		if err := ValidateUsername(from); err != nil {
+			return err
+		}
+	}
+	if err := ValidateUsername(to); err != nil {
+		return err
+	}
+	if err := ValidateID(id); err != nil {
+		return fmt.Errorf("message id: %w", err)
+	}
+	return nil
+}
+
+func (p *EditMessage) Validate() error {
+	if err := validateMessageReference(p.FromUsername, p.ToUsername, p.MessageID); err != nil {
+		return err
+	}
+	return validateBody(p.Content, p.Sealed)
+}
+
+func (p *DeleteMessage) Validate() error {
+	return validateMessageReference(p.FromUsername, p.ToUsername, p.MessageID)
+}
@@ -0,0 +1,165 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const MESSAGE_TYPE_FILE_OFFER = "FILE_OFFER"
+const MESSAGE_TYPE_FILE_ANSWER = "FILE_ANSWER"
+const MESSAGE_TYPE_FILE_CHUNK = "FILE_CHUNK"
+const MESSAGE_TYPE_FILE_ACK = "FILE_ACK"
+
+const MAX_FILE_SIZE = 64 * 1024 * 1024
+const FILE_CHUNK_SIZE = 32 * 1024
+const MAX_FILE_NAME_LENGTH = 255
+
+func init() {
+	Register(func() Payload { return &FileOffer{} })
+	Register(func() Payload { return &FileAnswer{} })
+	Register(func() Payload { return &FileChunk{} })
+	Register(func() Payload { return &FileAck{} })
+}
+
+/*
+A file transfer is relayed between two users as is:
+
+	sender    FILE_OFFER          name, size and sha256 of the file
+	recipient FILE_ANSWER         accepted, or declined
+	sender    FILE_CHUNK ...      at most FILE_CHUNK_SIZE bytes each, in order
+	recipient FILE_ACK ...        bytes received so far, one per chunk
+
+The sender keeps a bounded number of unacknowledged chunks in flight. Either
+side gives up with a declining FILE_ANSWER, the recipient also does so when
+the checksum does not match.
+*/
+
+// FileTransfer is common to every file frame. Clients fill ToUsername, the
+// server sets FromUsername before relaying.
+type FileTransfer struct {
+	FromUsername string `json:"fromUsername,omitempty"`
+	ToUsername   string `json:"toUsername"`
+	TransferID   string `json:"transferId"`
+}
+
+type FileOffer struct {
+	FileTransfer
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+type FileAnswer struct {
+	FileTransfer
+	Accept bool `json:"accept"`
+}
+
+type FileChunk struct {
+	FileTransfer
+	Offset int64  `json:"offset"`
+	Data   []byte `json:"data"`
+}
+
+type FileAck struct {
+	FileTransfer
+	Received int64 `json:"received"`
+}
+
+// Relayed payloads are forwarded from one user to another unchanged, apart
+// from the sender the server stamps on them. Capability is what the sender
+// must have negotiated.
+type Relayed interface {
+	Payload
+	Recipient() string
+	SetSender(username string)
+	Capability() string
+}
+
+func (*FileOffer) MessageType() string  { return MESSAGE_TYPE_FILE_OFFER }
+func (*FileAnswer) MessageType() string { return MESSAGE_TYPE_FILE_ANSWER }
+func (*FileChunk) MessageType() string  { return MESSAGE_TYPE_FILE_CHUNK }
+func (*FileAck) MessageType() string    { return MESSAGE_TYPE_FILE_ACK }
+
+func (t *FileTransfer) Recipient() string {
+	return t.ToUsername
+}
+
+func (t *FileTransfer) SetSender(username string) {
+	t.FromUsername = username
+}
+
+func (t *FileTransfer) Capability() string {
+	return CAPABILITY_FILES
+}
+
+func (t *FileTransfer) validate() error {
+	if t.FromUsername != "" {
+		if err := ValidateUsername(t.FromUsername); err != nil {
+			return err
+		}
+	}
+	if err := ValidateUsername(t.ToUsername); err != nil {
+		return err
+	}
+	if err := ValidateID(t.TransferID); err != nil {
+		return fmt.Errorf("transfer id: %w", err)
+	}
+	return nil
+}
+
+// ValidateFileName accepts plain file names only, never paths.
+func ValidateFileName(name string) error {
+	if name == "" || len(name) > MAX_FILE_NAME_LENGTH {
+		return errors.New("invalid file name length")
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") || filepath.Base(name) != name {
+		return errors.New("file name must not be a path")
+	}
+	return nil
+}
+
+func (p *FileOffer) Validate() error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	if err := ValidateFileName(p.Name); err != nil {
+		return err
+	}
+	if p.Size < 0 || p.Size > MAX_FILE_SIZE {
+		return errors.New("file too large")
+	}
+	if checksum, err := hex.DecodeString(p.Checksum); err != nil || len(checksum) != 32 {
+		return errors.New("invalid checksum")
+	}
+	return nil
+}
+
+func (p *FileAnswer) Validate() error {
+	return p.validate()
+}
+
+func (p *FileChunk) Validate() error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	if len(p.Data) == 0 || len(p.Data) > FILE_CHUNK_SIZE {
+		return errors.New("invalid chunk size")
+	}
+	if p.Offset < 0 || p.Offset+int64(len(p.Data)) > MAX_FILE_SIZE {
+		return errors.New("invalid chunk offset")
+	}
+	return nil
+}
+
+func (p *FileAck) Validate() error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	if p.Received < 0 || p.Received > MAX_FILE_SIZE {
+		return errors.New("invalid received size")
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+// PROTOCOL_VERSION is the version spoken by this build, peers down to
+// MIN_PROTOCOL_VERSION are still accepted. Version 2 introduced the typed
+// envelope.
+const PROTOCOL_VERSION = 2
+const MIN_PROTOCOL_VERSION = 2
+
+const MESSAGE_TYPE_HELLO = "HELLO"
+const MESSAGE_TYPE_WELCOME = "WELCOME"
+const MESSAGE_TYPE_ERROR = "ERROR"
+
+// Optional features, only used when both sides list them in the handshake.
+const (
+	// CAPABILITY_PRESENCE: the server sends PRESENCE user lists.
+	CAPABILITY_PRESENCE = "presence"
+	// CAPABILITY_MSGPACK: every frame after WELCOME uses MsgpackCodec.
+	CAPABILITY_MSGPACK = "msgpack"
+	// CAPABILITY_E2E: the server keeps a key directory and relays sealed
+	// message bodies.
+	CAPABILITY_E2E = "e2e"
+	// CAPABILITY_FILES: the server relays FILE_* frames between users.
+	CAPABILITY_FILES = "files"
+	// CAPABILITY_EDIT: the server relays EDIT_MESSAGE and DELETE_MESSAGE.
+	CAPABILITY_EDIT = "edit"
+	// CAPABILITY_REACTIONS: the server relays REACTION frames.
+	CAPABILITY_REACTIONS = "reactions"
+)
+
+func init() {
+	Register(func() Payload { return &Hello{} })
+	Register(func() Payload { return &Welcome{} })
+	Register(func() Payload { return &Error{} })
+}
+
+// Hello is the first frame a client sends, before ClaimUsername.
+type Hello struct {
+	ProtocolVersion int      `json:"protocolVersion"`
+	ClientName      string   `json:"clientName"`
+	ClientVersion   string   `json:"clientVersion"`
+	Capabilities    []string `json:"capabilities"`
+}
+
+// Welcome answers an accepted Hello with the negotiated version and the
+// capabilities both sides support.
+type Welcome struct {
+	ProtocolVersion int      `json:"protocolVersion"`
+	ServerVersion   string   `json:"serverVersion"`
+	Capabilities    []string `json:"capabilities"`
+}
+
+// Error reports a rejected handshake or frame. The server closes the
+// connection after a rejected handshake.
+type Error struct {
+	Message string `json:"message"`
+}
+
+func (*Hello) MessageType() string   { return MESSAGE_TYPE_HELLO }
+func (*Welcome) MessageType() string { return MESSAGE_TYPE_WELCOME }
+func (*Error) MessageType() string   { return MESSAGE_TYPE_ERROR }
+
+func (p *Hello) Validate() error {
+	if p.ProtocolVersion <= 0 {
+		return errors.New("missing protocol version")
+	}
+	if p.ClientName == "" {
+		return errors.New("missing client name")
+	}
+	return nil
+}
+
+func (p *Welcome) Validate() error {
+	if p.ProtocolVersion <= 0 {
+		return errors.New("missing protocol version")
+	}
+	return nil
+}
+
+func (p *Error) Validate() error {
+	if p.Message == "" {
+		return errors.New("empty error message")
+	}
+	return nil
+}
+
+// NegotiateVersion picks the version to speak with a peer, or fails when
+// the peer is too old or too new.
+func NegotiateVersion(peerVersion int) (int, error) {
+	if peerVersion < MIN_PROTOCOL_VERSION || peerVersion > PROTOCOL_VERSION {
+		return 0, fmt.Errorf(
+			"unsupported protocol version %d, supported %d-%d",
+			peerVersion, MIN_PROTOCOL_VERSION, PROTOCOL_VERSION,
+		)
+	}
+	return peerVersion, nil
+}
+
+// NegotiateCapabilities returns the offered capabilities that are supported.
+func NegotiateCapabilities(offered, supported []string) []string {
+	negotiated := []string{}
+	for _, capability := range offered {
+		if HasCapability(supported, capability) {
+			negotiated = append(negotiated, capability)
+		}
+	}
+	return negotiated
+}
+
+func HasCapability(capabilities []string, capability string) bool {
+	for _, v := range capabilities {
+		if v == capability {
+			return true
+		}
+	}
+	return false
+}
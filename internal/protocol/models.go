@@ -1,26 +1,152 @@
 package protocol
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"time"
+	"unicode"
 )
 
+const MESSAGE_TYPE_CLAIM_USERNAME = "CLAIM_USERNAME"
+const MESSAGE_TYPE_SEND = "SEND"
 const MESSAGE_TYPE_CHAT = "CHAT"
-const MESSAGE_TYPE_BROADCAST = "BROADCAST"
+const MESSAGE_TYPE_PRESENCE = "PRESENCE"
 
-type ClaimUsernameRequest struct {
+const MAX_USERNAME_LENGTH = 32
+const MAX_CONTENT_SIZE = 64 * 1024
+
+func init() {
+	Register(func() Payload { return &ClaimUsername{} })
+	Register(func() Payload { return &Send{} })
+	Register(func() Payload { return &Chat{} })
+	Register(func() Payload { return &Presence{} })
+}
+
+// ClaimUsername is sent by the client right after the handshake.
+type ClaimUsername struct {
 	Username string `json:"username"`
 }
 
-type ForwardMessageRequest struct {
-	ToUsername string `json:"toUsername"`
-	Content    string `json:"content"`
+// Send asks the server to deliver Content, or the end-to-end encrypted
+// Sealed body, to ToUsername. The frame id is kept as the id of the
+// delivered chat message. ReplyTo is the id of the message replied to and
+// ReplyToFrom its sender, ids are only unique per sender.
+type Send struct {
+	ToUsername  string  `json:"toUsername"`
+	Content     string  `json:"content,omitempty"`
+	Sealed      *Sealed `json:"sealed,omitempty"`
+	ReplyTo     string  `json:"replyTo,omitempty"`
+	ReplyToFrom string  `json:"replyToFrom,omitempty"`
 }
 
-type Message struct {
-	Type         string    `json:"type"`
+// Chat is a message delivered by the server, its frame id identifies the
+// message on both ends.
+type Chat struct {
 	FromUsername string    `json:"fromUsername"`
 	ToUsername   string    `json:"toUsername"`
-	Content      string    `json:"content"`
+	Content      string    `json:"content,omitempty"`
+	Sealed       *Sealed   `json:"sealed,omitempty"`
+	ReplyTo      string    `json:"replyTo,omitempty"`
+	ReplyToFrom  string    `json:"replyToFrom,omitempty"`
 	Timestamp    time.Time `json:"timestamp"`
-	Users        []string  `json:"users"`
+}
+
+// Presence lists every connected user.
+type Presence struct {
+	Users []string `json:"users"`
+}
+
+type HTTPSessionResponse struct {
+	Token string `json:"token"`
+}
+
+// HTTPPollResponse carries messages of the HTTP transport, Cursor is the
+// cursor to acknowledge them with.
+type HTTPPollResponse struct {
+	Cursor   uint64            `json:"cursor"`
+	Messages []json.RawMessage `json:"messages"`
+}
+
+func (*ClaimUsername) MessageType() string { return MESSAGE_TYPE_CLAIM_USERNAME }
+func (*Send) MessageType() string          { return MESSAGE_TYPE_SEND }
+func (*Chat) MessageType() string          { return MESSAGE_TYPE_CHAT }
+func (*Presence) MessageType() string      { return MESSAGE_TYPE_PRESENCE }
+
+func ValidateUsername(username string) error {
+	if username == "" {
+		return errors.New("empty username")
+	}
+	if len(username) > MAX_USERNAME_LENGTH {
+		return errors.New("username too long")
+	}
+	for _, r := range username {
+		if unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return errors.New("username contains whitespace or control characters")
+		}
+	}
+	return nil
+}
+
+// validateBody accepts either plain content or a sealed body, not both.
+func validateBody(content string, sealed *Sealed) error {
+	if sealed != nil {
+		if content != "" {
+			return errors.New("both content and sealed body")
+		}
+		return sealed.Validate()
+	}
+	if content == "" {
+		return errors.New("empty content")
+	}
+	if len(content) > MAX_CONTENT_SIZE {
+		return errors.New("content too large")
+	}
+	return nil
+}
+
+func (p *ClaimUsername) Validate() error {
+	return ValidateUsername(p.Username)
+}
+
+// validateReply checks the reference to a parent message, which is either
+// absent or has both an id and a sender.
+func validateReply(id, from string) error {
+	if id == "" && from == "" {
+		return nil
+	}
+	if err := ValidateID(id); err != nil {
+		return fmt.Errorf("reply id: %w", err)
+	}
+	return ValidateUsername(from)
+}
+
+func (p *Send) Validate() error {
+	if err := ValidateUsername(p.ToUsername); err != nil {
+		return err
+	}
+	if err := validateReply(p.ReplyTo, p.ReplyToFrom); err != nil {
+		return err
+	}
+	return validateBody(p.Content, p.Sealed)
+}
+
+func (p *Chat) Validate() error {
+	if err := ValidateUsername(p.FromUsername); err != nil {
+		return err
+	}
+	if err := ValidateUsername(p.ToUsername); err != nil {
+		return err
+	}
+	if err := validateReply(p.ReplyTo, p.ReplyToFrom); err != nil {
+		return err
+	}
+	if p.ReplyToFrom != "" && p.ReplyToFrom != p.FromUsername && p.ReplyToFrom != p.ToUsername {
+		return errors.New("reply to a message from outside the conversation")
+	}
+	return validateBody(p.Content, p.Sealed)
+}
+
+func (p *Presence) Validate() error {
+	return nil
 }
@@ -0,0 +1,94 @@
+package protocol
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// msgpackEnvelope mirrors Envelope, the payload is embedded as msgpack.
+// Field names follow the json tags so both codecs share one schema.
+type msgpackEnvelope struct {
+	Type    string             `json:"type"`
+	ID      string             `json:"id,omitempty"`
+	Payload msgpack.RawMessage `json:"payload"`
+}
+
+type msgpackCodec struct{}
+
+// MsgpackCodec is the binary codec for high volume clients.
+var MsgpackCodec Codec = msgpackCodec{}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+func (msgpackCodec) Binary() bool { return true }
+
+func (msgpackCodec) Encode(frame Frame) ([]byte, error) {
+	if frame.Payload == nil {
+		return nil, fmt.Errorf("%w: missing payload", ErrInvalidPayload)
+	}
+	if err := frame.Payload.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidPayload, frame.Type(), err)
+	}
+	payload, err := marshalMsgpack(frame.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return marshalMsgpack(&msgpackEnvelope{
+		Type:    frame.Type(),
+		ID:      frame.ID,
+		Payload: payload,
+	})
+}
+
+func (msgpackCodec) Decode(data []byte) (Frame, error) {
+	var envelope msgpackEnvelope
+	if err := unmarshalMsgpackStrict(data, &envelope); err != nil {
+		return Frame{}, err
+	}
+	if envelope.ID != "" {
+		if err := ValidateID(envelope.ID); err != nil {
+			return Frame{}, fmt.Errorf("%w: frame id: %v", ErrMalformedFrame, err)
+		}
+	}
+	newPayload, has := registry[envelope.Type]
+	if !has {
+		return Frame{}, fmt.Errorf("%w: %q", ErrUnknownType, envelope.Type)
+	}
+	if len(envelope.Payload) == 0 {
+		return Frame{}, fmt.Errorf("%w: missing payload", ErrMalformedFrame)
+	}
+	payload := newPayload()
+	if err := unmarshalMsgpackStrict(envelope.Payload, payload); err != nil {
+		return Frame{}, err
+	}
+	if err := payload.Validate(); err != nil {
+		return Frame{}, fmt.Errorf("%w: %s: %v", ErrInvalidPayload, envelope.Type, err)
+	}
+	return Frame{ID: envelope.ID, Payload: payload}, nil
+}
+
+func marshalMsgpack(v interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := msgpack.NewEncoder(&buffer)
+	encoder.SetCustomStructTag("json")
+	encoder.UseCompactInts(true)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func unmarshalMsgpackStrict(data []byte, v interface{}) error {
+	reader := bytes.NewReader(data)
+	decoder := msgpack.NewDecoder(reader)
+	decoder.SetCustomStructTag("json")
+	decoder.DisallowUnknownFields(true)
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedFrame, err)
+	}
+	if reader.Len() != 0 {
+		return fmt.Errorf("%w: trailing data", ErrMalformedFrame)
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// testBundle is a validly signed bundle from fixed keys, so goldens do not
+// change from run to run.
+func testBundle() KeyBundle {
+	identity := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	exchangeKey := bytes.Repeat([]byte{2}, X25519_KEY_SIZE)
+	return KeyBundle{
+		IdentityKey: identity.Public().(ed25519.PublicKey),
+		ExchangeKey: exchangeKey,
+		Signature:   ed25519.Sign(identity, exchangeKey),
+	}
+}
+
+// examples has a frame of every registered type, each is kept in
+// testdata/TYPE.json.
+func examples() []Frame {
+	bundle := testBundle()
+	transfer := FileTransfer{FromUsername: "alice", ToUsername: "bob", TransferID: "t1"}
+	return []Frame{
+		{Payload: &Hello{ProtocolVersion: PROTOCOL_VERSION, ClientName: "GoChatTUI", ClientVersion: "1.0", Capabilities: []string{CAPABILITY_PRESENCE, CAPABILITY_E2E}}},
+		{Payload: &Welcome{ProtocolVersion: PROTOCOL_VERSION, ServerVersion: "1.0", Capabilities: []string{CAPABILITY_PRESENCE}}},
+		{ID: "f1", Payload: &Error{Message: "unexpected frame: WELCOME"}},
+		{Payload: &ClaimUsername{Username: "alice"}},
+		{ID: "m1", Payload: &Send{ToUsername: "bob", Content: "hi bob", ReplyTo: "m0", ReplyToFrom: "bob"}},
+		{ID: "m1", Payload: &Chat{FromUsername: "alice", ToUsername: "bob", Content: "hi bob", ReplyTo: "m0", ReplyToFrom: "bob", Timestamp: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}},
+		{Payload: &Presence{Users: []string{"alice", "bob"}}},
+		{Payload: &PublishKeys{Bundle: bundle}},
+		{Payload: &RequestKeys{Username: "bob"}},
+		{Payload: &Keys{Username: "bob", Bundle: &bundle}},
+		{Payload: &FileOffer{FileTransfer: transfer, Name: "notes.txt", Size: 5, Checksum: strings.Repeat("ab", 32)}},
+		{Payload: &FileAnswer{FileTransfer: transfer, Accept: true}},
+		{Payload: &FileChunk{FileTransfer: transfer, Offset: 0, Data: []byte("notes")}},
+		{Payload: &FileAck{FileTransfer: transfer, Received: 5}},
+		{Payload: &EditMessage{FromUsername: "alice", ToUsername: "bob", MessageID: "m1", Content: "hi bob!"}},
+		{Payload: &DeleteMessage{FromUsername: "alice", ToUsername: "bob", MessageID: "m1"}},
+		{Payload: &Reaction{FromUsername: "alice", ToUsername: "bob", MessageFrom: "bob", MessageID: "m1", Emoji: "👍"}},
+	}
+}
+
+func TestWireFormat(t *testing.T) {
+	covered := map[string]bool{}
+	for _, frame := range examples() {
+		covered[frame.Type()] = true
+		t.Run(frame.Type(), func(t *testing.T) {
+			data, err := Encode(frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var indented bytes.Buffer
+			json.Indent(&indented, data, "", "  ")
+			indented.WriteString("\n")
+			goldenPath := path.Join("testdata", frame.Type()+".json")
+			if *update {
+				os.MkdirAll("testdata", 0755)
+				if err := os.WriteFile(goldenPath, indented.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			golden, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(golden, indented.Bytes()) {
+				t.Fatalf("%s changed:\nwant %s\n got %s", goldenPath, golden, indented.Bytes())
+			}
+
+			// the golden decodes back to the same frame
+			decoded, err := Decode(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, err := Encode(decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(again, data) {
+				t.Fatalf("round trip changed the frame:\nwant %s\n got %s", data, again)
+			}
+		})
+	}
+	for messageType := range registry {
+		if !covered[messageType] {
+			t.Errorf("no example for %s, add one to examples", messageType)
+		}
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	oversized := `{"toUsername":"bob","content":"` + strings.Repeat("a", MAX_CONTENT_SIZE+1) + `"}`
+	tests := []struct {
+		name string
+		data string
+		err  error
+	}{
+		{"unknown type", `{"type":"SHOUT","payload":{"content":"hi"}}`, ErrUnknownType},
+		{"missing type", `{"payload":{"username":"alice"}}`, ErrUnknownType},
+		{"missing payload", `{"type":"CLAIM_USERNAME"}`, ErrMalformedFrame},
+		{"null payload", `{"type":"CLAIM_USERNAME","payload":null}`, ErrMalformedFrame},
+		{"unknown envelope field", `{"type":"CLAIM_USERNAME","to":"x","payload":{"username":"alice"}}`, ErrMalformedFrame},
+		{"unknown payload field", `{"type":"CLAIM_USERNAME","payload":{"username":"alice","admin":true}}`, ErrMalformedFrame},
+		{"wrong field type", `{"type":"CLAIM_USERNAME","payload":{"username":7}}`, ErrMalformedFrame},
+		{"trailing data", `{"type":"CLAIM_USERNAME","payload":{"username":"alice"}} {}`, ErrMalformedFrame},
+		{"not json", `CLAIM_USERNAME alice`, ErrMalformedFrame},
+		{"oversized content", `{"type":"SEND","payload":` + oversized + `}`, ErrInvalidPayload},
+		{"empty content", `{"type":"SEND","payload":{"toUsername":"bob","content":""}}`, ErrInvalidPayload},
+		{"bad username", `{"type":"CLAIM_USERNAME","payload":{"username":"al ice"}}`, ErrInvalidPayload},
+		{"long id", `{"type":"DELETE_MESSAGE","payload":{"toUsername":"bob","messageId":"` + strings.Repeat("1", MAX_ID_LENGTH+1) + `"}}`, ErrInvalidPayload},
+		{"long frame id", `{"type":"SEND","id":"` + strings.Repeat("1", MAX_ID_LENGTH+1) + `","payload":{"toUsername":"bob","content":"hi"}}`, ErrMalformedFrame},
+		{"frame id with spaces", `{"type":"SEND","id":"m 1","payload":{"toUsername":"bob","content":"hi"}}`, ErrMalformedFrame},
+		{"message id with spaces", `{"type":"DELETE_MESSAGE","payload":{"toUsername":"bob","messageId":"m 1"}}`, ErrInvalidPayload},
+		{"reply without its sender", `{"type":"SEND","payload":{"toUsername":"bob","content":"hi","replyTo":"m0"}}`, ErrInvalidPayload},
+		{"reply outside the conversation", `{"type":"CHAT","payload":{"fromUsername":"alice","toUsername":"bob","content":"hi","replyTo":"m0","replyToFrom":"carol","timestamp":"2024-01-01T12:00:00Z"}}`, ErrInvalidPayload},
+		{"reaction outside the conversation", `{"type":"REACTION","payload":{"fromUsername":"alice","toUsername":"bob","messageFrom":"carol","messageId":"m1","emoji":"x"}}`, ErrInvalidPayload},
+		{"path as file name", `{"type":"FILE_OFFER","payload":{"toUsername":"bob","transferId":"t1","name":"../x","size":1,"checksum":"` + strings.Repeat("ab", 32) + `"}}`, ErrInvalidPayload},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Decode([]byte(test.data))
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestEncodeRejects(t *testing.T) {
+	if _, err := Encode(Frame{}); !errors.Is(err, ErrInvalidPayload) {
+		t.Fatalf("missing payload: %v", err)
+	}
+	send := &Send{ToUsername: "bob", Content: strings.Repeat("a", MAX_CONTENT_SIZE+1)}
+	if _, err := Encode(NewFrame(send)); !errors.Is(err, ErrInvalidPayload) {
+		t.Fatalf("oversized content: %v", err)
+	}
+}
+
+// TestCodecsAgree checks that a frame encoded with either codec decodes to
+// the same envelope.
+func TestCodecsAgree(t *testing.T) {
+	for _, frame := range examples() {
+		t.Run(frame.Type(), func(t *testing.T) {
+			want, err := Encode(frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, codec := range []Codec{JSONCodec, MsgpackCodec} {
+				data, err := codec.Encode(frame)
+				if err != nil {
+					t.Fatal(codec.Name(), ": ", err)
+				}
+				decoded, err := codec.Decode(data)
+				if err != nil {
+					t.Fatal(codec.Name(), ": ", err)
+				}
+				// compared through JSON, the canonical form of the envelope
+				got, err := Encode(decoded)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatalf("%s round trip:\nwant %s\n got %s", codec.Name(), want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestMsgpackDecodeRejects(t *testing.T) {
+	unknown, err := marshalMsgpack(&msgpackEnvelope{Type: "SHOUT", Payload: []byte{0x80}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MsgpackCodec.Decode(unknown); !errors.Is(err, ErrUnknownType) {
+		t.Fatalf("unknown type: %v", err)
+	}
+	missing, err := marshalMsgpack(&msgpackEnvelope{Type: MESSAGE_TYPE_CLAIM_USERNAME})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MsgpackCodec.Decode(missing); !errors.Is(err, ErrMalformedFrame) {
+		t.Fatalf("missing payload: %v", err)
+	}
+	longID, err := marshalMsgpack(&msgpackEnvelope{Type: MESSAGE_TYPE_CLAIM_USERNAME, ID: strings.Repeat("1", MAX_ID_LENGTH+1), Payload: []byte{0x80}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MsgpackCodec.Decode(longID); !errors.Is(err, ErrMalformedFrame) {
+		t.Fatalf("long frame id: %v", err)
+	}
+	data, err := MsgpackCodec.Encode(NewFrame(&ClaimUsername{Username: "alice"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MsgpackCodec.Decode(append(data, 0xc0)); !errors.Is(err, ErrMalformedFrame) {
+		t.Fatalf("trailing data: %v", err)
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	for _, peer := range []int{0, MIN_PROTOCOL_VERSION - 1, PROTOCOL_VERSION + 1} {
+		if _, err := NegotiateVersion(peer); err == nil {
+			t.Fatalf("version %d accepted", peer)
+		}
+	}
+	for peer := MIN_PROTOCOL_VERSION; peer <= PROTOCOL_VERSION; peer++ {
+		if version, err := NegotiateVersion(peer); err != nil || version != peer {
+			t.Fatalf("version %d: %d %v", peer, version, err)
+		}
+	}
+}
+
+func TestNegotiateCapabilities(t *testing.T) {
+	supported := []string{CAPABILITY_PRESENCE, CAPABILITY_MSGPACK, CAPABILITY_E2E}
+	tests := []struct {
+		offered []string
+		want    []string
+	}{
+		{nil, []string{}},
+		{[]string{"telepathy"}, []string{}},
+		{[]string{CAPABILITY_E2E, "telepathy", CAPABILITY_PRESENCE}, []string{CAPABILITY_E2E, CAPABILITY_PRESENCE}},
+		{[]string{CAPABILITY_FILES, CAPABILITY_MSGPACK}, []string{CAPABILITY_MSGPACK}},
+	}
+	for _, test := range tests {
+		got := NegotiateCapabilities(test.offered, supported)
+		if got == nil || !slices.Equal(got, test.want) {
+			t.Fatalf("offered %v: got %#v, want %v", test.offered, got, test.want)
+		}
+	}
+}
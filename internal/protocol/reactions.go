@@ -0,0 +1,56 @@
+package protocol
+
+import (
+	"errors"
+	"unicode"
+)
+
+const MESSAGE_TYPE_REACTION = "REACTION"
+
+const MAX_EMOJI_SIZE = 32
+
+func init() {
+	Register(func() Payload { return &Reaction{} })
+}
+
+// Reaction adds or, with Remove, takes back the Emoji reaction of the
+// sender to the message MessageID of their conversation with ToUsername.
+// Message ids are chosen by their sender, MessageFrom names the author of
+// the message so that both users can use the same id. It is relayed like
+// EDIT_MESSAGE.
+type Reaction struct {
+	FromUsername string `json:"fromUsername,omitempty"`
+	ToUsername   string `json:"toUsername"`
+	MessageFrom  string `json:"messageFrom"`
+	MessageID    string `json:"messageId"`
+	Emoji        string `json:"emoji"`
+	Remove       bool   `json:"remove,omitempty"`
+}
+
+func (*Reaction) MessageType() string { return MESSAGE_TYPE_REACTION }
+
+func (p *Reaction) Recipient() string         { return p.ToUsername }
+func (p *Reaction) SetSender(username string) { p.FromUsername = username }
+func (p *Reaction) Capability() string        { return CAPABILITY_REACTIONS }
+
+func (p *Reaction) Validate() error {
+	if err := validateMessageReference(p.FromUsername, p.ToUsername, p.MessageID); err != nil {
+		return err
+	}
+	if err := ValidateUsername(p.MessageFrom); err != nil {
+		return err
+	}
+	// the sender is only known once the server set it
+	if p.FromUsername != "" && p.MessageFrom != p.FromUsername && p.MessageFrom != p.ToUsername {
+		return errors.New("reaction to a message from outside the conversation")
+	}
+	if p.Emoji == "" || len(p.Emoji) > MAX_EMOJI_SIZE {
+		return errors.New("invalid emoji")
+	}
+	for _, r := range p.Emoji {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return errors.New("invalid emoji")
+		}
+	}
+	return nil
+}
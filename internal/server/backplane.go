@@ -0,0 +1,194 @@
+package server
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
+)
+
+// Delivery is a frame on its way to a user, or to every user when To is
+// empty.
+type Delivery struct {
+	To    string
+	Frame protocol.Frame
+}
+
+// Backplane shares presence between server instances and routes deliveries
+// to the instance a user is connected to.
+type Backplane interface {
+	// Join claims username for this instance, returns false if it is taken.
+	Join(username string) (bool, error)
+	Leave(username string) error
+	Users() ([]string, error)
+	// Publish sends a delivery to the instance owning its recipient, or to
+	// every instance when it has none.
+	Publish(delivery Delivery) error
+	// Messages delivers everything published to this instance.
+	Messages() <-chan Delivery
+	// PutKeys and Keys are the shared public key directory, Keys returns
+	// nil for users without a bundle.
+	PutKeys(username string, bundle protocol.KeyBundle) error
+	Keys(username string) (*protocol.KeyBundle, error)
+	Close() error
+}
+
+// MemoryHub connects in-process backplanes, one per broker.
+type MemoryHub struct {
+	mu       sync.Mutex
+	presence map[string]*MemoryBackplane
+	nodes    map[*MemoryBackplane]struct{}
+	keys     map[string]protocol.KeyBundle
+}
+
+func NewMemoryHub() *MemoryHub {
+	return &MemoryHub{
+		presence: make(map[string]*MemoryBackplane),
+		nodes:    make(map[*MemoryBackplane]struct{}),
+		keys:     make(map[string]protocol.KeyBundle),
+	}
+}
+
+type MemoryBackplane struct {
+	hub      *MemoryHub
+	mu       sync.Mutex
+	queue    []Delivery
+	wakeup   chan struct{}
+	messages chan Delivery
+	stop     chan struct{}
+}
+
+// NewBackplane attaches a new instance to the hub.
+func (h *MemoryHub) NewBackplane() *MemoryBackplane {
+	node := &MemoryBackplane{
+		hub:      h,
+		wakeup:   make(chan struct{}, 1),
+		messages: make(chan Delivery, 1024),
+		stop:     make(chan struct{}),
+	}
+	h.mu.Lock()
+	h.nodes[node] = struct{}{}
+	h.mu.Unlock()
+	go node.pump()
+	return node
+}
+
+// NewLocalBackplane is a backplane for a single server instance.
+func NewLocalBackplane() *MemoryBackplane {
+	return NewMemoryHub().NewBackplane()
+}
+
+// pump moves queued deliveries to the messages channel so that publishing
+// never blocks on a busy subscriber.
+func (n *MemoryBackplane) pump() {
+	defer close(n.messages)
+	for {
+		n.mu.Lock()
+		queue := n.queue
+		n.queue = nil
+		n.mu.Unlock()
+		for _, delivery := range queue {
+			select {
+			case n.messages <- delivery:
+			case <-n.stop:
+				return
+			}
+		}
+		select {
+		case <-n.wakeup:
+		case <-n.stop:
+			return
+		}
+	}
+}
+
+func (n *MemoryBackplane) enqueue(delivery Delivery) {
+	n.mu.Lock()
+	n.queue = append(n.queue, delivery)
+	n.mu.Unlock()
+	select {
+	case n.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (n *MemoryBackplane) Join(username string) (bool, error) {
+	n.hub.mu.Lock()
+	defer n.hub.mu.Unlock()
+	if _, has := n.hub.presence[username]; has {
+		return false, nil
+	}
+	n.hub.presence[username] = n
+	return true, nil
+}
+
+func (n *MemoryBackplane) Leave(username string) error {
+	n.hub.mu.Lock()
+	defer n.hub.mu.Unlock()
+	if n.hub.presence[username] == n {
+		delete(n.hub.presence, username)
+	}
+	return nil
+}
+
+func (n *MemoryBackplane) Users() ([]string, error) {
+	n.hub.mu.Lock()
+	defer n.hub.mu.Unlock()
+	users := make([]string, 0, len(n.hub.presence))
+	for username := range n.hub.presence {
+		users = append(users, username)
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+func (n *MemoryBackplane) Publish(delivery Delivery) error {
+	n.hub.mu.Lock()
+	defer n.hub.mu.Unlock()
+	if delivery.To == "" {
+		for node := range n.hub.nodes {
+			node.enqueue(delivery)
+		}
+		return nil
+	}
+	if node, has := n.hub.presence[delivery.To]; has {
+		node.enqueue(delivery)
+	}
+	return nil
+}
+
+func (n *MemoryBackplane) Messages() <-chan Delivery {
+	return n.messages
+}
+
+func (n *MemoryBackplane) PutKeys(username string, bundle protocol.KeyBundle) error {
+	n.hub.mu.Lock()
+	defer n.hub.mu.Unlock()
+	n.hub.keys[username] = bundle
+	return nil
+}
+
+func (n *MemoryBackplane) Keys(username string) (*protocol.KeyBundle, error) {
+	n.hub.mu.Lock()
+	defer n.hub.mu.Unlock()
+	if bundle, has := n.hub.keys[username]; has {
+		return &bundle, nil
+	}
+	return nil, nil
+}
+
+func (n *MemoryBackplane) Close() error {
+	n.hub.mu.Lock()
+	defer n.hub.mu.Unlock()
+	if _, has := n.hub.nodes[n]; !has {
+		return nil
+	}
+	delete(n.hub.nodes, n)
+	for username, node := range n.hub.presence {
+		if node == n {
+			delete(n.hub.presence, username)
+		}
+	}
+	close(n.stop)
+	return nil
+}
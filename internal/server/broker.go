@@ -1,120 +1,302 @@
 package server
 
 import (
+	"hash/fnv"
 	"log"
+	"sync"
 
 	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
-	"github.com/gorilla/websocket"
 )
 
 type JoinUserRequest struct {
-	username string
-	conn     *websocket.Conn
+	username     string
+	conn         Conn
+	capabilities []string
+	codec        protocol.Codec
 }
 
 type User struct {
-	username   string
-	conn       *websocket.Conn
-	messageBox chan interface{}
+	username     string
+	conn         Conn
+	capabilities []string
+	codec        protocol.Codec
+	messageBox   chan protocol.Frame
 }
 
+// Broker spreads users over shards by username hash. Every shard runs its own
+// event loop and owns the users hashed to it, so joins, kicks and deliveries
+// for different users run in parallel. All messages from one sender to one
+// recipient pass through the sender's reader goroutine and the recipient's
+// shard queue in order, which keeps per-pair ordering.
 type Broker struct {
+	shards          []*shard
+	backplane       Backplane
+	presenceChanged chan struct{}
+	stop            chan struct{}
+	stopped         sync.WaitGroup
+}
+
+type shard struct {
+	broker              *Broker
 	users               map[string]User
 	joinUserRequests    chan JoinUserRequest
-	stop                chan struct{}
-	messageBroker       chan protocol.Message
+	messageBroker       chan Delivery
+	remoteMessages      chan Delivery
 	kickOutUserRequests chan string
-	connectionRequests  chan *websocket.Conn
+	stop                chan struct{}
 }
 
 func NewBroker() *Broker {
-	return &Broker{
-		users:               make(map[string]User),
-		joinUserRequests:    make(chan JoinUserRequest, 1024),
-		kickOutUserRequests: make(chan string, 1024),
-		messageBroker:       make(chan protocol.Message, 1024),
-		stop:                make(chan struct{}),
-		connectionRequests:  make(chan *websocket.Conn, 1024),
+	return NewBrokerWithBackplane(NewLocalBackplane(), 1)
+}
+
+func NewBrokerWithBackplane(backplane Backplane, shardCount int) *Broker {
+	b := &Broker{
+		shards:          make([]*shard, max(1, shardCount)),
+		backplane:       backplane,
+		presenceChanged: make(chan struct{}, 1),
+		stop:            make(chan struct{}),
+	}
+	for i := range b.shards {
+		b.shards[i] = &shard{
+			broker:              b,
+			users:               make(map[string]User),
+			joinUserRequests:    make(chan JoinUserRequest, 1024),
+			kickOutUserRequests: make(chan string, 1024),
+			messageBroker:       make(chan Delivery, 1024),
+			remoteMessages:      make(chan Delivery, 1024),
+			stop:                make(chan struct{}),
+		}
 	}
+	return b
 }
 
-func (b *Broker) handleStop() {
-	for _, val := range b.users {
-		val.conn.Close()
-		close(val.messageBox)
+func (b *Broker) shardFor(username string) *shard {
+	hash := fnv.New32a()
+	hash.Write([]byte(username))
+	return b.shards[hash.Sum32()%uint32(len(b.shards))]
+}
+
+func (b *Broker) Start() {
+	for _, s := range b.shards {
+		b.stopped.Add(1)
+		go func() {
+			defer b.stopped.Done()
+			s.run()
+		}()
 	}
-	close(b.joinUserRequests)
-	close(b.kickOutUserRequests)
-	close(b.messageBroker)
+	go b.dispatchRemoteMessages()
+	go b.publishPresence()
+}
+
+func (b *Broker) Stop() {
 	close(b.stop)
-	close(b.connectionRequests)
+	for _, s := range b.shards {
+		s.stop <- struct{}{}
+	}
+	b.stopped.Wait()
+	b.backplane.Close()
 }
 
-func (b *Broker) Start() {
-	go func() {
-		for {
-			select {
-			case joinUserRequest := <-b.joinUserRequests:
-				b.handleJoinUserRequest(joinUserRequest)
-			case message := <-b.messageBroker:
-				b.handleMessageForwarding(message)
-			case username := <-b.kickOutUserRequests:
-				b.handleKickOutUser(username)
-			case _ = <-b.stop:
-				b.handleStop()
-				return
+// join, forward and kickOut give up once the broker stopped, the shards no
+// longer read their queues. A join is refused even when its queue has room.
+func (b *Broker) join(request JoinUserRequest) {
+	select {
+	case <-b.stop:
+		request.conn.Close()
+		return
+	default:
+	}
+	select {
+	case b.shardFor(request.username).joinUserRequests <- request:
+	case <-b.stop:
+		request.conn.Close()
+	}
+}
+
+func (b *Broker) forward(delivery Delivery) {
+	select {
+	case b.shardFor(delivery.To).messageBroker <- delivery:
+	case <-b.stop:
+	}
+}
+
+func (b *Broker) kickOut(username string) {
+	select {
+	case b.shardFor(username).kickOutUserRequests <- username:
+	case <-b.stop:
+	}
+}
+
+// dispatchRemoteMessages hands backplane deliveries to the shard owning the
+// recipient, broadcasts go to every shard.
+func (b *Broker) dispatchRemoteMessages() {
+	for delivery := range b.backplane.Messages() {
+		if delivery.To == "" {
+			for _, s := range b.shards {
+				if !s.queueRemote(delivery) {
+					return
+				}
 			}
+			continue
 		}
-	}()
+		if !b.shardFor(delivery.To).queueRemote(delivery) {
+			return
+		}
+	}
 }
 
-func (b *Broker) Stop() {
-	b.stop <- struct{}{}
+func (s *shard) queueRemote(delivery Delivery) bool {
+	select {
+	case s.remoteMessages <- delivery:
+		return true
+	case <-s.broker.stop:
+		return false
+	}
 }
 
-func (b *Broker) handleJoinUserRequest(request JoinUserRequest) {
-	if _, has := b.users[request.username]; has {
-		request.conn.Close()
-	} else {
-		log.Print("join user: ", request.username)
-		messageBox := make(chan interface{}, 1024)
-		joinedUser := User{
-			username:   request.username,
-			conn:       request.conn,
-			messageBox: messageBox,
+func (b *Broker) notifyPresenceChanged() {
+	select {
+	case b.presenceChanged <- struct{}{}:
+	default:
+	}
+}
+
+// publishPresence publishes the cluster wide user list to every instance.
+// Bursts of joins and kicks are coalesced into a single broadcast.
+func (b *Broker) publishPresence() {
+	for {
+		select {
+		case <-b.presenceChanged:
+		case <-b.stop:
+			return
+		}
+		keys, err := b.backplane.Users()
+		if err != nil {
+			log.Print("err presence:", err)
+			continue
+		}
+		delivery := Delivery{
+			Frame: protocol.NewFrame(&protocol.Presence{Users: keys}),
+		}
+		if err := b.backplane.Publish(delivery); err != nil {
+			log.Print("err broadcast:", err)
 		}
-		b.users[request.username] = joinedUser
-		go messageReciever(request.conn, b.messageBroker, request.username, b.kickOutUserRequests)
-		go messageSender(request.conn, messageBox)
-		b.broadcast()
 	}
 }
 
-func (b *Broker) handleMessageForwarding(message protocol.Message) {
-	if user, has := b.users[message.ToUsername]; has {
-		user.messageBox <- message
+func (s *shard) run() {
+	for {
+		select {
+		case joinUserRequest := <-s.joinUserRequests:
+			s.handleJoinUserRequest(joinUserRequest)
+		case message := <-s.messageBroker:
+			s.handleMessageForwarding(message)
+		case message := <-s.remoteMessages:
+			s.handleRemoteMessage(message)
+		case username := <-s.kickOutUserRequests:
+			s.handleKickOutUser(username)
+		case _ = <-s.stop:
+			s.handleStop()
+			return
+		}
 	}
 }
 
-func (b *Broker) broadcast() {
-	keys := make([]string, 0, len(b.users))
-	for k := range b.users {
-		keys = append(keys, k)
+// handleStop disconnects the local users and releases their names, so other
+// instances sharing the backplane can take them.
+func (s *shard) handleStop() {
+	for username, val := range s.users {
+		val.conn.Close()
+		close(val.messageBox)
+		if err := s.broker.backplane.Leave(username); err != nil {
+			log.Print("err leave:", err)
+		}
+	}
+	for {
+		select {
+		case request := <-s.joinUserRequests:
+			request.conn.Close()
+		default:
+			return
+		}
 	}
-	message := protocol.Message{
-		Type:  protocol.MESSAGE_TYPE_BROADCAST,
-		Users: keys,
+}
+
+func (s *shard) handleJoinUserRequest(request JoinUserRequest) {
+	if _, has := s.users[request.username]; has {
+		request.conn.Close()
+		return
 	}
-	for _, user := range b.users {
-		user.messageBox <- message
+	joined, err := s.broker.backplane.Join(request.username)
+	if err != nil {
+		log.Print("err join:", err)
+	}
+	if !joined {
+		request.conn.Close()
+		return
+	}
+	log.Print("join user: ", request.username, " from ", request.conn.RemoteAddr())
+	messageBox := make(chan protocol.Frame, 1024)
+	joinedUser := User{
+		username:     request.username,
+		conn:         request.conn,
+		capabilities: request.capabilities,
+		codec:        request.codec,
+		messageBox:   messageBox,
+	}
+	s.users[request.username] = joinedUser
+	go messageReciever(s.broker, joinedUser)
+	go messageSender(request.conn, request.codec, messageBox)
+	s.broker.notifyPresenceChanged()
+}
+
+// deliver queues frame for user without blocking the shard. A user whose
+// queue is full is not keeping up, its connection is closed and the kick out
+// follows from its reader.
+func (s *shard) deliver(user User, frame protocol.Frame) {
+	select {
+	case user.messageBox <- frame:
+	default:
+		log.Print("err deliver: queue full, disconnecting ", user.username)
+		user.conn.Close()
+	}
+}
+
+func (s *shard) handleMessageForwarding(delivery Delivery) {
+	if user, has := s.users[delivery.To]; has {
+		s.deliver(user, delivery.Frame)
+		return
+	}
+	if err := s.broker.backplane.Publish(delivery); err != nil {
+		log.Print("err forward:", err)
+	}
+}
+
+func (s *shard) handleRemoteMessage(delivery Delivery) {
+	if delivery.To == "" {
+		presence := delivery.Frame.Type() == protocol.MESSAGE_TYPE_PRESENCE
+		for _, user := range s.users {
+			if presence && !protocol.HasCapability(user.capabilities, protocol.CAPABILITY_PRESENCE) {
+				continue
+			}
+			s.deliver(user, delivery.Frame)
+		}
+		return
+	}
+	if user, has := s.users[delivery.To]; has {
+		s.deliver(user, delivery.Frame)
 	}
 }
 
-func (b *Broker) handleKickOutUser(username string) {
-	if user, has := b.users[username]; has {
+func (s *shard) handleKickOutUser(username string) {
+	if user, has := s.users[username]; has {
 		close(user.messageBox)
-		delete(b.users, username)
-		b.broadcast()
+		delete(s.users, username)
+		if err := s.broker.backplane.Leave(username); err != nil {
+			log.Print("err leave:", err)
+		}
+		s.broker.notifyPresenceChanged()
 		log.Print("kick user: ", username)
 	}
 }
@@ -0,0 +1,477 @@
+package server
+
+import (
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
+)
+
+// The broker is driven through NewPipe, testClient is the client end of a
+// pipe that has gone through the handshake.
+
+const TEST_TIMEOUT = 2 * time.Second
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+type testClient struct {
+	t        testing.TB
+	username string
+	conn     Conn
+	codec    protocol.Codec
+	// frames is closed when the connection fails
+	frames chan protocol.Frame
+}
+
+func startBroker(t testing.TB, shardCount int) *Broker {
+	b := NewBrokerWithBackplane(NewLocalBackplane(), shardCount)
+	b.Start()
+	t.Cleanup(b.Stop)
+	return b
+}
+
+// dial runs the handshake for username, the claim may still be rejected.
+func dial(t testing.TB, b *Broker, username string, capabilities ...string) *testClient {
+	t.Helper()
+	conn, serverConn := NewPipe()
+	b.HandleConn(serverConn)
+	c := &testClient{t: t, username: username, conn: conn, codec: protocol.JSONCodec, frames: make(chan protocol.Frame, 1024)}
+	c.send(&protocol.Hello{ProtocolVersion: protocol.PROTOCOL_VERSION, ClientName: "test", Capabilities: capabilities})
+	data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal("no welcome: ", err)
+	}
+	frame, err := protocol.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	welcome, ok := frame.Payload.(*protocol.Welcome)
+	if !ok {
+		t.Fatalf("expected WELCOME, got %#v", frame.Payload)
+	}
+	c.codec = protocol.NegotiatedCodec(welcome.Capabilities)
+	c.send(&protocol.ClaimUsername{Username: username})
+	go func() {
+		defer close(c.frames)
+		for {
+			frame, err := readFrame(conn, c.codec)
+			if err != nil {
+				return
+			}
+			c.frames <- frame
+		}
+	}()
+	return c
+}
+
+// connect dials and waits until the user is in the presence list.
+func connect(t testing.TB, b *Broker, username string) *testClient {
+	t.Helper()
+	c := dial(t, b, username, protocol.CAPABILITY_PRESENCE)
+	c.waitPresence(func(users []string) bool { return slices.Contains(users, username) })
+	return c
+}
+
+func (c *testClient) send(payload protocol.Payload) {
+	c.t.Helper()
+	if err := writeFrame(c.conn, c.codec, protocol.NewFrame(payload)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// next is the next frame that is not a presence list.
+func (c *testClient) next() (protocol.Frame, bool) {
+	c.t.Helper()
+	for {
+		select {
+		case frame, ok := <-c.frames:
+			if !ok {
+				return protocol.Frame{}, false
+			}
+			if frame.Type() == protocol.MESSAGE_TYPE_PRESENCE {
+				continue
+			}
+			return frame, true
+		case <-time.After(TEST_TIMEOUT):
+			c.t.Fatalf("%s: no frame in %v", c.username, TEST_TIMEOUT)
+		}
+	}
+}
+
+func (c *testClient) receiveChat() *protocol.Chat {
+	c.t.Helper()
+	frame, ok := c.next()
+	if !ok {
+		c.t.Fatalf("%s: connection closed", c.username)
+	}
+	chat, ok := frame.Payload.(*protocol.Chat)
+	if !ok {
+		c.t.Fatalf("%s: expected CHAT, got %#v", c.username, frame.Payload)
+	}
+	return chat
+}
+
+func (c *testClient) waitPresence(done func(users []string) bool) {
+	c.t.Helper()
+	for {
+		select {
+		case frame, ok := <-c.frames:
+			if !ok {
+				c.t.Fatalf("%s: connection closed", c.username)
+			}
+			if presence, ok := frame.Payload.(*protocol.Presence); ok && done(presence.Users) {
+				return
+			}
+		case <-time.After(TEST_TIMEOUT):
+			c.t.Fatalf("%s: presence not seen in %v", c.username, TEST_TIMEOUT)
+		}
+	}
+}
+
+// waitClosed waits for the broker to close the connection.
+func (c *testClient) waitClosed() {
+	c.t.Helper()
+	for {
+		select {
+		case _, ok := <-c.frames:
+			if !ok {
+				return
+			}
+		case <-time.After(TEST_TIMEOUT):
+			c.t.Fatalf("%s: connection still open after %v", c.username, TEST_TIMEOUT)
+		}
+	}
+}
+
+func TestClaim(t *testing.T) {
+	b := startBroker(t, 1)
+	connect(t, b, "alice")
+	bob := dial(t, b, "bob", protocol.CAPABILITY_PRESENCE)
+	bob.waitPresence(func(users []string) bool { return slices.Equal(users, []string{"alice", "bob"}) })
+}
+
+func TestDuplicateUsernameRejected(t *testing.T) {
+	b := startBroker(t, 4)
+	alice := connect(t, b, "alice")
+	dial(t, b, "alice", protocol.CAPABILITY_PRESENCE).waitClosed()
+
+	// the first connection is not affected
+	bob := connect(t, b, "bob")
+	bob.send(&protocol.Send{ToUsername: "alice", Content: "still there?"})
+	if chat := alice.receiveChat(); chat.FromUsername != "bob" {
+		t.Fatalf("chat from %q", chat.FromUsername)
+	}
+}
+
+func TestForward(t *testing.T) {
+	b := startBroker(t, 4)
+	alice := connect(t, b, "alice")
+	bob := connect(t, b, "bob")
+	alice.send(&protocol.Send{ToUsername: "bob", Content: "hi bob"})
+	chat := bob.receiveChat()
+	if chat.FromUsername != "alice" || chat.ToUsername != "bob" || chat.Content != "hi bob" {
+		t.Fatalf("received %#v", chat)
+	}
+	if chat.Timestamp.IsZero() {
+		t.Fatal("no timestamp")
+	}
+}
+
+func TestOfflineRecipient(t *testing.T) {
+	b := startBroker(t, 4)
+	alice := connect(t, b, "alice")
+	alice.send(&protocol.Send{ToUsername: "nobody", Content: "hello?"})
+
+	// dropped, and alice stays connected
+	bob := connect(t, b, "bob")
+	bob.send(&protocol.Send{ToUsername: "alice", Content: "hi"})
+	if chat := alice.receiveChat(); chat.Content != "hi" {
+		t.Fatalf("received %#v", chat)
+	}
+	// nobody joining later does not get it either
+	nobody := connect(t, b, "nobody")
+	bob.send(&protocol.Send{ToUsername: "nobody", Content: "now"})
+	if chat := nobody.receiveChat(); chat.Content != "now" {
+		t.Fatalf("received %#v", chat)
+	}
+}
+
+func TestDisconnectKicksOut(t *testing.T) {
+	b := startBroker(t, 4)
+	alice := connect(t, b, "alice")
+	bob := connect(t, b, "bob")
+	alice.waitPresence(func(users []string) bool { return slices.Contains(users, "bob") })
+
+	bob.conn.Close()
+	alice.waitPresence(func(users []string) bool { return !slices.Contains(users, "bob") })
+
+	// the name is free again
+	bob = connect(t, b, "bob")
+	alice.send(&protocol.Send{ToUsername: "bob", Content: "welcome back"})
+	if chat := bob.receiveChat(); chat.Content != "welcome back" {
+		t.Fatalf("received %#v", chat)
+	}
+}
+
+func TestInvalidFrameAnsweredWithError(t *testing.T) {
+	b := startBroker(t, 1)
+	alice := connect(t, b, "alice")
+	alice.send(&protocol.ClaimUsername{Username: "again"})
+	frame, ok := alice.next()
+	if !ok {
+		t.Fatal("connection closed")
+	}
+	if _, ok := frame.Payload.(*protocol.Error); !ok {
+		t.Fatalf("expected ERROR, got %#v", frame.Payload)
+	}
+}
+
+func TestInvalidFrameIDRejected(t *testing.T) {
+	b := startBroker(t, 2)
+	alice := connect(t, b, "alice")
+	bob := connect(t, b, "bob")
+	long := `{"type":"SEND","id":"` + strings.Repeat("1", protocol.MAX_ID_LENGTH+1) + `","payload":{"toUsername":"bob","content":"hi"}}`
+	if err := alice.conn.WriteMessage([]byte(long)); err != nil {
+		t.Fatal(err)
+	}
+	frame, ok := alice.next()
+	if _, is := frame.Payload.(*protocol.Error); !ok || !is {
+		t.Fatalf("expected ERROR, got %#v", frame.Payload)
+	}
+	alice.send(&protocol.Send{ToUsername: "bob", Content: "after"})
+	if chat := bob.receiveChat(); chat.Content != "after" {
+		t.Fatalf("received %#v", chat)
+	}
+}
+
+func TestReplyOutsideConversationRejected(t *testing.T) {
+	b := startBroker(t, 2)
+	alice := connect(t, b, "alice")
+	bob := connect(t, b, "bob")
+	alice.send(&protocol.Send{ToUsername: "bob", Content: "hi", ReplyTo: "m0", ReplyToFrom: "carol"})
+	frame, ok := alice.next()
+	if _, is := frame.Payload.(*protocol.Error); !ok || !is {
+		t.Fatalf("expected ERROR, got %#v", frame.Payload)
+	}
+	alice.send(&protocol.Send{ToUsername: "bob", Content: "hi", ReplyTo: "m0", ReplyToFrom: "bob"})
+	if chat := bob.receiveChat(); chat.ReplyTo != "m0" || chat.ReplyToFrom != "bob" {
+		t.Fatalf("received %#v", chat)
+	}
+}
+
+func TestReactionOutsideConversationRejected(t *testing.T) {
+	b := startBroker(t, 2)
+	alice := dial(t, b, "alice", protocol.CAPABILITY_PRESENCE, protocol.CAPABILITY_REACTIONS)
+	bob := dial(t, b, "bob", protocol.CAPABILITY_PRESENCE, protocol.CAPABILITY_REACTIONS)
+	bob.waitPresence(func(users []string) bool { return slices.Contains(users, "alice") })
+	alice.send(&protocol.Reaction{ToUsername: "bob", MessageFrom: "carol", MessageID: "m1", Emoji: "x"})
+	frame, ok := alice.next()
+	if !ok {
+		t.Fatal("connection closed")
+	}
+	if _, ok := frame.Payload.(*protocol.Error); !ok {
+		t.Fatalf("expected ERROR, got %#v", frame.Payload)
+	}
+
+	alice.send(&protocol.Reaction{ToUsername: "bob", MessageFrom: "bob", MessageID: "m1", Emoji: "x"})
+	frame, ok = bob.next()
+	if reaction, is := frame.Payload.(*protocol.Reaction); !ok || !is || reaction.FromUsername != "alice" || reaction.MessageFrom != "bob" {
+		t.Fatalf("bob got %#v", frame.Payload)
+	}
+}
+
+// forwardPairs connects pairs of senders and recipients, s0 to r0 and so on,
+// and returns once every user is in the presence list.
+func forwardPairs(t testing.TB, b *Broker, pairs int, capabilities ...string) ([]*testClient, []*testClient) {
+	t.Helper()
+	capabilities = append(capabilities, protocol.CAPABILITY_PRESENCE)
+	senders := make([]*testClient, pairs)
+	recipients := make([]*testClient, pairs)
+	for i := range pairs {
+		senders[i] = dial(t, b, "s"+strconv.Itoa(i), capabilities...)
+		recipients[i] = dial(t, b, "r"+strconv.Itoa(i), capabilities...)
+	}
+	for _, c := range recipients {
+		c.waitPresence(func(users []string) bool { return len(users) == 2*pairs })
+	}
+	for _, c := range senders {
+		go func() {
+			for range c.frames {
+			}
+		}()
+	}
+	return senders, recipients
+}
+
+// sendInOrder sends count numbered messages from every sender to its
+// recipient at once, and checks that each recipient gets them in order.
+func sendInOrder(t testing.TB, senders, recipients []*testClient, count func(pair int) int) {
+	var wg sync.WaitGroup
+	for i := range senders {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			to := recipients[i].username
+			for n := range count(i) {
+				frame := protocol.NewFrame(&protocol.Send{ToUsername: to, Content: strconv.Itoa(n)})
+				if err := writeFrame(senders[i].conn, senders[i].codec, frame); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for next := 0; next < count(i); {
+				frame, ok := <-recipients[i].frames
+				if !ok {
+					t.Errorf("pair %d: connection closed", i)
+					return
+				}
+				chat, ok := frame.Payload.(*protocol.Chat)
+				if !ok {
+					continue
+				}
+				if chat.Content != strconv.Itoa(next) {
+					t.Errorf("pair %d: got %s want %d", i, chat.Content, next)
+					return
+				}
+				next++
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPerPairOrdering(t *testing.T) {
+	b := startBroker(t, 8)
+	senders, recipients := forwardPairs(t, b, 16)
+	sendInOrder(t, senders, recipients, func(int) int { return 500 })
+}
+
+func TestForwardMsgpack(t *testing.T) {
+	b := startBroker(t, 4)
+	senders, recipients := forwardPairs(t, b, 4, protocol.CAPABILITY_MSGPACK)
+	if recipients[0].codec != protocol.MsgpackCodec {
+		t.Fatalf("negotiated %s", recipients[0].codec.Name())
+	}
+	sendInOrder(t, senders, recipients, func(int) int { return 100 })
+}
+
+/*
+BenchmarkForwardJSON measures forwarding between 64 pairs of users over
+in-memory pipes, with one shard per core as the server runs by default:
+
+	go test -run NONE -bench Forward -cpu 1,2,4,8 ./internal/server
+
+b.N messages are sent in total, spread over the pairs. BenchmarkForwardMsgpack
+runs the same path with clients that negotiate msgpack.
+*/
+func BenchmarkForwardJSON(b *testing.B) {
+	benchmarkForward(b)
+}
+
+func BenchmarkForwardMsgpack(b *testing.B) {
+	benchmarkForward(b, protocol.CAPABILITY_MSGPACK)
+}
+
+func benchmarkForward(b *testing.B, capabilities ...string) {
+	pairs := 64
+	broker := startBroker(b, runtime.GOMAXPROCS(0))
+	senders, recipients := forwardPairs(b, broker, pairs, capabilities...)
+	b.ReportAllocs()
+	b.ResetTimer()
+	sendInOrder(b, senders, recipients, func(pair int) int {
+		if pair < b.N%pairs {
+			return b.N/pairs + 1
+		}
+		return b.N / pairs
+	})
+	b.StopTimer()
+}
+
+func TestSlowRecipientDisconnected(t *testing.T) {
+	b := startBroker(t, 1)
+	alice := connect(t, b, "alice")
+	bob := connect(t, b, "bob")
+	// reads nothing after the handshake, so its queues fill up
+	slow := dial(t, b, "slow")
+	alice.waitPresence(func(users []string) bool { return slices.Contains(users, "slow") })
+	for i := 0; i < 4096; i++ {
+		alice.send(&protocol.Send{ToUsername: "slow", Content: "flood"})
+	}
+	alice.waitPresence(func(users []string) bool { return !slices.Contains(users, "slow") })
+	slow.waitClosed()
+
+	// the shard kept forwarding to everyone else
+	alice.send(&protocol.Send{ToUsername: "bob", Content: "still here"})
+	if chat := bob.receiveChat(); chat.Content != "still here" {
+		t.Fatalf("received %#v", chat)
+	}
+}
+
+// leaveRecorder records the names released through the backplane.
+type leaveRecorder struct {
+	Backplane
+	mu   sync.Mutex
+	left []string
+}
+
+func (r *leaveRecorder) Leave(username string) error {
+	r.mu.Lock()
+	r.left = append(r.left, username)
+	r.mu.Unlock()
+	return r.Backplane.Leave(username)
+}
+
+func TestStopLeavesBackplane(t *testing.T) {
+	backplane := &leaveRecorder{Backplane: NewLocalBackplane()}
+	b := NewBrokerWithBackplane(backplane, 2)
+	b.Start()
+	alice := connect(t, b, "alice")
+	connect(t, b, "bob")
+	b.Stop()
+	alice.waitClosed()
+	backplane.mu.Lock()
+	defer backplane.mu.Unlock()
+	slices.Sort(backplane.left)
+	if !slices.Equal(backplane.left, []string{"alice", "bob"}) {
+		t.Fatalf("left %v", backplane.left)
+	}
+}
+
+func TestQueueingAfterStopReturns(t *testing.T) {
+	b := NewBrokerWithBackplane(NewLocalBackplane(), 1)
+	b.Start()
+	b.Stop()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// more than the shard queues hold
+		for i := 0; i < 2048; i++ {
+			b.forward(Delivery{To: "alice", Frame: protocol.NewFrame(&protocol.Error{Message: "late"})})
+			b.kickOut("alice")
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(TEST_TIMEOUT):
+		t.Fatal("forward or kickOut blocked after Stop")
+	}
+	conn, serverConn := NewPipe()
+	b.join(JoinUserRequest{username: "alice", conn: serverConn})
+	if _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("joined after Stop")
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bufio"
+	"compress/flate"
+	"errors"
+	"expvar"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// CompressionConfig configures permessage-deflate on websocket connections.
+// Frames smaller than Threshold bytes are sent uncompressed.
+type CompressionConfig struct {
+	Enabled   bool
+	Level     int
+	Threshold int
+}
+
+var compression = CompressionConfig{
+	Enabled:   true,
+	Level:     flate.BestSpeed,
+	Threshold: 256,
+}
+
+// Compression metrics, published on /debug/vars. ws_bytes_saved only counts
+// frames that were actually compressed, as the size they would have had
+// uncompressed minus the size they had on the wire.
+var (
+	wsPayloadBytes       = expvar.NewInt("ws_payload_bytes")
+	wsWireBytes          = expvar.NewInt("ws_wire_bytes")
+	wsCompressedFrames   = expvar.NewInt("ws_compressed_frames")
+	wsUncompressedFrames = expvar.NewInt("ws_uncompressed_frames")
+	wsBytesSaved         = expvar.NewInt("ws_bytes_saved")
+)
+
+func init() {
+	wsUpgrader.EnableCompression = compression.Enabled
+}
+
+func SetCompression(config CompressionConfig) error {
+	if config.Enabled && (config.Level < flate.HuffmanOnly || config.Level > flate.BestCompression) {
+		return errors.New("invalid compression level")
+	}
+	compression = config
+	wsUpgrader.EnableCompression = config.Enabled
+	return nil
+}
+
+// offersDeflate tells whether the upgrader negotiates permessage-deflate for
+// r, it does whenever compression is enabled and the client offers it.
+func offersDeflate(r *http.Request) bool {
+	if !compression.Enabled {
+		return false
+	}
+	for _, header := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, extension := range strings.Split(header, ",") {
+			name, _, _ := strings.Cut(extension, ";")
+			if strings.TrimSpace(name) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// frameSize is the size of an uncompressed server frame carrying n bytes.
+func frameSize(n int) int64 {
+	switch {
+	case n <= 125:
+		return int64(n) + 2
+	case n <= 65535:
+		return int64(n) + 4
+	default:
+		return int64(n) + 10
+	}
+}
+
+// countingResponseWriter hands the upgrader a connection that counts the
+// bytes written to the socket, which is what compression saves on.
+type countingResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &countingConn{Conn: conn}, brw, nil
+}
+
+type countingConn struct {
+	net.Conn
+	written atomic.Int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	wsWireBytes.Add(int64(n))
+	c.written.Add(int64(n))
+	return n, err
+}
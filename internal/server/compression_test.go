@@ -0,0 +1,74 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// writeThroughWebsocket sends messages from the server end of a websocket to
+// a client that offers compression or not.
+func writeThroughWebsocket(t *testing.T, clientCompression bool, messages ...string) {
+	t.Helper()
+	written := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := wsUpgrader.Upgrade(countingResponseWriter{w}, r, nil)
+		if err != nil {
+			written <- err
+			return
+		}
+		conn := NewWebsocketConn(ws, offersDeflate(r))
+		for _, message := range messages {
+			if err := conn.WriteMessage([]byte(message)); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- nil
+	}))
+	t.Cleanup(srv.Close)
+	dialer := websocket.Dialer{EnableCompression: clientCompression}
+	client, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for _, message := range messages {
+		_, data, err := client.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != message {
+			t.Fatalf("received %q, sent %q", data, message)
+		}
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompressionSavings(t *testing.T) {
+	saved, compressed := wsBytesSaved.Value(), wsCompressedFrames.Value()
+	large := strings.Repeat("compressible ", 1000)
+	writeThroughWebsocket(t, true, large, "small")
+	if frames := wsCompressedFrames.Value() - compressed; frames != 1 {
+		t.Fatalf("%d frames compressed, expected only the large one", frames)
+	}
+	if savings := wsBytesSaved.Value() - saved; savings <= 0 || savings >= int64(len(large)) {
+		t.Fatalf("saved %d bytes on a %d byte frame", savings, len(large))
+	}
+}
+
+func TestNoSavingsWithoutDeflate(t *testing.T) {
+	saved, compressed, uncompressed := wsBytesSaved.Value(), wsCompressedFrames.Value(), wsUncompressedFrames.Value()
+	writeThroughWebsocket(t, false, strings.Repeat("compressible ", 1000), "small")
+	if wsBytesSaved.Value() != saved || wsCompressedFrames.Value() != compressed {
+		t.Fatal("counted savings for a client without permessage-deflate")
+	}
+	if frames := wsUncompressedFrames.Value() - uncompressed; frames != 2 {
+		t.Fatalf("%d frames sent uncompressed, expected 2", frames)
+	}
+}
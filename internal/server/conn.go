@@ -0,0 +1,152 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Conn is a message oriented client connection, the broker only talks to
+// clients through it.
+type Conn interface {
+	ReadMessage() ([]byte, error)
+	WriteMessage(data []byte) error
+	Close() error
+	RemoteAddr() net.Addr
+}
+
+// binaryConn is implemented by transports that can carry binary messages,
+// only those are offered binary codecs.
+type binaryConn interface {
+	WriteBinaryMessage(data []byte) error
+}
+
+var ErrConnClosed = errors.New("connection closed")
+
+const WRITE_TIMEOUT = time.Second
+
+type websocketConn struct {
+	conn    *websocket.Conn
+	deflate bool
+	wire    *countingConn
+}
+
+// NewWebsocketConn wraps conn, deflate tells whether permessage-deflate was
+// negotiated during the upgrade.
+func NewWebsocketConn(conn *websocket.Conn, deflate bool) Conn {
+	wire, _ := conn.NetConn().(*countingConn)
+	return &websocketConn{conn: conn, deflate: deflate, wire: wire}
+}
+
+func (c *websocketConn) ReadMessage() ([]byte, error) {
+	_, data, err := c.conn.ReadMessage()
+	return data, err
+}
+
+func (c *websocketConn) WriteMessage(data []byte) error {
+	return c.write(websocket.TextMessage, data)
+}
+
+func (c *websocketConn) WriteBinaryMessage(data []byte) error {
+	return c.write(websocket.BinaryMessage, data)
+}
+
+// write only compresses frames above the compression threshold, small
+// frames cost more to deflate than they save.
+func (c *websocketConn) write(messageType int, data []byte) error {
+	compress := c.deflate && len(data) >= compression.Threshold
+	c.conn.EnableWriteCompression(compress)
+	wsPayloadBytes.Add(int64(len(data)))
+	var before int64
+	if c.wire != nil {
+		before = c.wire.written.Load()
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+	err := c.conn.WriteMessage(messageType, data)
+	if err != nil {
+		return err
+	}
+	if !compress {
+		wsUncompressedFrames.Add(1)
+		return nil
+	}
+	wsCompressedFrames.Add(1)
+	if c.wire != nil {
+		wsBytesSaved.Add(frameSize(len(data)) - (c.wire.written.Load() - before))
+	}
+	return nil
+}
+
+func (c *websocketConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *websocketConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// pipeConn is one end of an in-memory connection created by NewPipe.
+type pipeConn struct {
+	incoming  <-chan []byte
+	outgoing  chan<- []byte
+	closed    chan struct{}
+	closeOnce *sync.Once
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// NewPipe returns both ends of an in-memory connection, closing either end
+// closes both.
+func NewPipe() (Conn, Conn) {
+	aToB := make(chan []byte, 1024)
+	bToA := make(chan []byte, 1024)
+	closed := make(chan struct{})
+	closeOnce := &sync.Once{}
+	a := &pipeConn{incoming: bToA, outgoing: aToB, closed: closed, closeOnce: closeOnce}
+	b := &pipeConn{incoming: aToB, outgoing: bToA, closed: closed, closeOnce: closeOnce}
+	return a, b
+}
+
+func (c *pipeConn) ReadMessage() ([]byte, error) {
+	select {
+	case data := <-c.incoming:
+		return data, nil
+	case <-c.closed:
+		return nil, ErrConnClosed
+	}
+}
+
+func (c *pipeConn) WriteMessage(data []byte) error {
+	select {
+	case <-c.closed:
+		return ErrConnClosed
+	default:
+	}
+	select {
+	case c.outgoing <- data:
+		return nil
+	case <-c.closed:
+		return ErrConnClosed
+	}
+}
+
+func (c *pipeConn) WriteBinaryMessage(data []byte) error {
+	return c.WriteMessage(data)
+}
+
+func (c *pipeConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return pipeAddr{}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
+)
+
+const SERVER_VERSION = "1.0"
+
+const HANDSHAKE_TIMEOUT = 5 * time.Second
+
+var serverCapabilities = []string{
+	protocol.CAPABILITY_PRESENCE,
+	protocol.CAPABILITY_MSGPACK,
+	protocol.CAPABILITY_E2E,
+	protocol.CAPABILITY_FILES,
+	protocol.CAPABILITY_EDIT,
+	protocol.CAPABILITY_REACTIONS,
+}
+
+// supportedCapabilities drops binary codecs on text only transports.
+func supportedCapabilities(conn Conn) []string {
+	if _, ok := conn.(binaryConn); ok {
+		return serverCapabilities
+	}
+	supported := []string{}
+	for _, capability := range serverCapabilities {
+		if capability != protocol.CAPABILITY_MSGPACK {
+			supported = append(supported, capability)
+		}
+	}
+	return supported
+}
+
+// waitForHandshake runs the hello/welcome exchange and the username claim,
+// and joins the user once both succeed in time.
+func waitForHandshake(conn Conn, join func(JoinUserRequest)) {
+	// buffered so the reader never blocks or panics after a timeout
+	result := make(chan *JoinUserRequest, 1)
+
+	go func() {
+		result <- handshake(conn)
+	}()
+
+	select {
+	case <-time.After(HANDSHAKE_TIMEOUT):
+		conn.Close()
+		log.Print("closing client no handshake completed")
+		return
+	case request := <-result:
+		if request == nil {
+			conn.Close()
+			return
+		}
+		join(*request)
+	}
+}
+
+func handshake(conn Conn) *JoinUserRequest {
+	frame, err := readFrame(conn, protocol.JSONCodec)
+	if err != nil {
+		reject(conn, "expected HELLO frame, please upgrade your client: "+err.Error())
+		return nil
+	}
+	hello, ok := frame.Payload.(*protocol.Hello)
+	if !ok {
+		reject(conn, "expected HELLO before the username claim, please upgrade your client")
+		return nil
+	}
+	version, err := protocol.NegotiateVersion(hello.ProtocolVersion)
+	if err != nil {
+		reject(conn, err.Error())
+		return nil
+	}
+	capabilities := protocol.NegotiateCapabilities(hello.Capabilities, supportedCapabilities(conn))
+	err = writeFrame(conn, protocol.JSONCodec, protocol.NewFrame(&protocol.Welcome{
+		ProtocolVersion: version,
+		ServerVersion:   SERVER_VERSION,
+		Capabilities:    capabilities,
+	}))
+	if err != nil {
+		log.Print("err welcome:", err)
+		return nil
+	}
+
+	// everything after WELCOME uses the negotiated codec
+	codec := protocol.NegotiatedCodec(capabilities)
+	frame, err = readFrame(conn, codec)
+	if err != nil {
+		rejectWith(conn, codec, "expected CLAIM_USERNAME frame: "+err.Error())
+		return nil
+	}
+	claimUsername, ok := frame.Payload.(*protocol.ClaimUsername)
+	if !ok {
+		rejectWith(conn, codec, "expected CLAIM_USERNAME after the handshake")
+		return nil
+	}
+	log.Print("client ", hello.ClientName, "/", hello.ClientVersion, " protocol ", version, " capabilities ", capabilities)
+	return &JoinUserRequest{
+		username:     claimUsername.Username,
+		conn:         conn,
+		capabilities: capabilities,
+		codec:        codec,
+	}
+}
+
+func reject(conn Conn, reason string) {
+	rejectWith(conn, protocol.JSONCodec, reason)
+}
+
+func rejectWith(conn Conn, codec protocol.Codec, reason string) {
+	log.Print("reject client ", conn.RemoteAddr(), ": ", reason)
+	writeFrame(conn, codec, protocol.NewFrame(&protocol.Error{Message: reason}))
+}
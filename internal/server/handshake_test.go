@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
+)
+
+// hello runs the first half of the handshake over conn and returns the
+// server reply.
+func hello(t *testing.T, conn Conn, version int, capabilities ...string) protocol.Payload {
+	t.Helper()
+	err := writeFrame(conn, protocol.JSONCodec, protocol.NewFrame(&protocol.Hello{ProtocolVersion: version, ClientName: "test", Capabilities: capabilities}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := readFrame(conn, protocol.JSONCodec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame.Payload
+}
+
+func TestHandshakeVersionMismatch(t *testing.T) {
+	b := startBroker(t, 1)
+	for _, version := range []int{protocol.MIN_PROTOCOL_VERSION - 1, protocol.PROTOCOL_VERSION + 1} {
+		conn, serverConn := NewPipe()
+		b.HandleConn(serverConn)
+		reply, ok := hello(t, conn, version, protocol.CAPABILITY_PRESENCE).(*protocol.Error)
+		if !ok || !strings.Contains(reply.Message, "unsupported protocol version") {
+			t.Fatalf("version %d answered with %#v", version, reply)
+		}
+		if _, err := conn.ReadMessage(); err == nil {
+			t.Fatalf("version %d: connection left open", version)
+		}
+	}
+}
+
+func TestHandshakeClaimBeforeHello(t *testing.T) {
+	b := startBroker(t, 1)
+	conn, serverConn := NewPipe()
+	b.HandleConn(serverConn)
+	writeFrame(conn, protocol.JSONCodec, protocol.NewFrame(&protocol.ClaimUsername{Username: "alice"}))
+	frame, err := readFrame(conn, protocol.JSONCodec)
+	if reply, ok := frame.Payload.(*protocol.Error); err != nil || !ok || !strings.Contains(reply.Message, "expected HELLO") {
+		t.Fatalf("answered with %#v %v", frame.Payload, err)
+	}
+}
+
+func TestHandshakeCapabilities(t *testing.T) {
+	b := startBroker(t, 1)
+	offered := []string{"telepathy", protocol.CAPABILITY_MSGPACK, protocol.CAPABILITY_PRESENCE, protocol.CAPABILITY_EDIT}
+
+	// pipes carry binary messages
+	conn, serverConn := NewPipe()
+	b.HandleConn(serverConn)
+	welcome, ok := hello(t, conn, protocol.PROTOCOL_VERSION, offered...).(*protocol.Welcome)
+	if !ok || welcome.ProtocolVersion != protocol.PROTOCOL_VERSION || welcome.ServerVersion != SERVER_VERSION {
+		t.Fatalf("answered with %#v", welcome)
+	}
+	if !slices.Equal(welcome.Capabilities, offered[1:]) {
+		t.Fatalf("negotiated %v", welcome.Capabilities)
+	}
+
+	// lines of JSON are text only
+	client, server := net.Pipe()
+	b.HandleConn(NewStreamConn(server))
+	welcome, ok = hello(t, NewStreamConn(client), protocol.PROTOCOL_VERSION, offered...).(*protocol.Welcome)
+	if !ok || !slices.Equal(welcome.Capabilities, []string{protocol.CAPABILITY_PRESENCE, protocol.CAPABILITY_EDIT}) {
+		t.Fatalf("negotiated %#v over a stream", welcome)
+	}
+	client.Close()
+}
@@ -0,0 +1,440 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
+)
+
+const (
+	HTTP_SESSION_IDLE_TIMEOUT = 60 * time.Second
+	HTTP_POLL_TIMEOUT         = 25 * time.Second
+	HTTP_KEEPALIVE_INTERVAL   = 15 * time.Second
+	// HTTP_MAX_UNACKED messages are kept for a client until it acknowledges
+	// them, no more are taken from the broker meanwhile.
+	HTTP_MAX_UNACKED = 1024
+)
+
+// HTTPTransport is a fallback for networks that break websocket upgrades.
+// A client opens a session, receives events with server sent events or long
+// polling and sends messages with plain POST requests, all tied together by
+// the session token.
+//
+// Messages are numbered in the order they are sent. The cursor a client
+// passes is the number of messages it received, everything after it is
+// kept and sent again until a later cursor acknowledges it. Events carry
+// the cursor after them as their id.
+//
+//	POST /http/session                   -> {"token": "..."}
+//	POST /http/send?token=..             one JSON message per request
+//	GET  /http/events?token=..&cursor=.. text/event-stream, one message per event
+//	GET  /http/poll?token=..&cursor=..   -> {"cursor": .., "messages": [...]}
+//	POST /http/ack?token=..&cursor=..
+//	POST /http/close?token=..
+type HTTPTransport struct {
+	broker   *Broker
+	mu       sync.Mutex
+	sessions map[string]*httpSession
+}
+
+func NewHTTPTransport(broker *Broker) *HTTPTransport {
+	t := &HTTPTransport{
+		broker:   broker,
+		sessions: make(map[string]*httpSession),
+	}
+	go t.reapIdleSessions()
+	return t
+}
+
+func (t *HTTPTransport) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/http/session", t.handleSession)
+	mux.HandleFunc("/http/send", t.handleSend)
+	mux.HandleFunc("/http/events", t.handleEvents)
+	mux.HandleFunc("/http/poll", t.handlePoll)
+	mux.HandleFunc("/http/ack", t.handleAck)
+	mux.HandleFunc("/http/close", t.handleClose)
+}
+
+// httpSession is the broker side Conn of an HTTP client.
+type httpSession struct {
+	token      string
+	remoteAddr net.Addr
+	incoming   chan []byte
+	outgoing   chan []byte
+	closed     chan struct{}
+	closeOnce  sync.Once
+	mu         sync.Mutex
+	lastSeen   time.Time
+	// unacked were taken from outgoing and not acknowledged yet, the first
+	// is message number acked
+	unacked [][]byte
+	acked   uint64
+	// acks is signalled when unacked shrinks
+	acks chan struct{}
+	// a single events or poll request reads outgoing at a time, reading is
+	// closed when a newer one takes over
+	readMu  sync.Mutex
+	reading chan struct{}
+}
+
+type httpAddr string
+
+func (a httpAddr) Network() string { return "http" }
+func (a httpAddr) String() string  { return string(a) }
+
+func (s *httpSession) ReadMessage() ([]byte, error) {
+	select {
+	case data := <-s.incoming:
+		return data, nil
+	case <-s.closed:
+		return nil, ErrConnClosed
+	}
+}
+
+func (s *httpSession) WriteMessage(data []byte) error {
+	select {
+	case s.outgoing <- data:
+		return nil
+	case <-s.closed:
+		return ErrConnClosed
+	case <-time.After(WRITE_TIMEOUT):
+		return ErrConnClosed
+	}
+}
+
+func (s *httpSession) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	return nil
+}
+
+func (s *httpSession) RemoteAddr() net.Addr {
+	return s.remoteAddr
+}
+
+func (s *httpSession) touch() {
+	s.mu.Lock()
+	s.lastSeen = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *httpSession) idleSince() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.lastSeen)
+}
+
+// acknowledge drops the messages before cursor, reporting whether cursor is
+// one the session handed out.
+func (s *httpSession) acknowledge(cursor uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cursor < s.acked || cursor > s.acked+uint64(len(s.unacked)) {
+		return false
+	}
+	if cursor > s.acked {
+		s.unacked = s.unacked[cursor-s.acked:]
+		s.acked = cursor
+		select {
+		case s.acks <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+// keep adds data to the unacknowledged messages and returns the cursor after
+// it.
+func (s *httpSession) keep(data []byte) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unacked = append(s.unacked, data)
+	return s.acked + uint64(len(s.unacked))
+}
+
+// pending are the unacknowledged messages, numbered from start.
+func (s *httpSession) pending() (uint64, [][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.acked, slices.Clone(s.unacked)
+}
+
+// takeOver makes the request the only reader of outgoing, returning once an
+// earlier one ended. superseded is closed when a later request takes over.
+func (s *httpSession) takeOver() (release func(), superseded <-chan struct{}) {
+	s.mu.Lock()
+	if s.reading != nil {
+		close(s.reading)
+	}
+	reading := make(chan struct{})
+	s.reading = reading
+	s.mu.Unlock()
+	s.readMu.Lock()
+	return s.readMu.Unlock, reading
+}
+
+// outgoingIfRoom is outgoing while fewer than HTTP_MAX_UNACKED messages wait
+// for an acknowledgement, and nil otherwise.
+func (s *httpSession) outgoingIfRoom() chan []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.unacked) >= HTTP_MAX_UNACKED {
+		return nil
+	}
+	return s.outgoing
+}
+
+func newSessionToken() string {
+	bytes := make([]byte, 16)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+func (t *HTTPTransport) reapIdleSessions() {
+	for {
+		time.Sleep(HTTP_SESSION_IDLE_TIMEOUT / 4)
+		t.mu.Lock()
+		for token, session := range t.sessions {
+			select {
+			case <-session.closed:
+				delete(t.sessions, token)
+				continue
+			default:
+			}
+			if session.idleSince() > HTTP_SESSION_IDLE_TIMEOUT {
+				log.Print("closing idle http session from ", session.remoteAddr)
+				session.Close()
+				delete(t.sessions, token)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+// session looks up the session of the request token, replying with an
+// error when it is unknown or closed.
+func (t *HTTPTransport) session(w http.ResponseWriter, r *http.Request) *httpSession {
+	t.mu.Lock()
+	session, has := t.sessions[r.URL.Query().Get("token")]
+	t.mu.Unlock()
+	if !has {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return nil
+	}
+	select {
+	case <-session.closed:
+		http.Error(w, "session closed", http.StatusGone)
+		return nil
+	default:
+	}
+	session.touch()
+	return session
+}
+
+// acknowledgeCursor acknowledges the cursor of the request, replying with an
+// error when it is not valid.
+func acknowledgeCursor(w http.ResponseWriter, r *http.Request, session *httpSession) bool {
+	cursor := uint64(0)
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return false
+		}
+		cursor = parsed
+	}
+	if !session.acknowledge(cursor) {
+		http.Error(w, "cursor out of range", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func (t *HTTPTransport) handleSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	session := &httpSession{
+		token:      newSessionToken(),
+		remoteAddr: httpAddr(r.RemoteAddr),
+		incoming:   make(chan []byte, 1024),
+		outgoing:   make(chan []byte, 1024),
+		closed:     make(chan struct{}),
+		lastSeen:   time.Now(),
+		acks:       make(chan struct{}, 1),
+	}
+	t.mu.Lock()
+	t.sessions[session.token] = session
+	t.mu.Unlock()
+	t.broker.HandleConn(session)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&protocol.HTTPSessionResponse{Token: session.token})
+}
+
+func (t *HTTPTransport) handleSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	session := t.session(w, r)
+	if session == nil {
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MAX_LINE_SIZE))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	select {
+	case session.incoming <- data:
+		w.WriteHeader(http.StatusNoContent)
+	case <-session.closed:
+		http.Error(w, "session closed", http.StatusGone)
+	}
+}
+
+func (t *HTTPTransport) handleEvents(w http.ResponseWriter, r *http.Request) {
+	session := t.session(w, r)
+	if session == nil || !acknowledgeCursor(w, r, session) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	release, superseded := session.takeOver()
+	defer release()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+
+	writeEvent := func(cursor uint64, data []byte) bool {
+		_, err := w.Write([]byte("id: " + strconv.FormatUint(cursor, 10) + "\ndata: " + string(data) + "\n\n"))
+		return err == nil
+	}
+	// what an earlier stream may have lost is sent first
+	start, pending := session.pending()
+	for i, data := range pending {
+		if !writeEvent(start+uint64(i)+1, data) {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(HTTP_KEEPALIVE_INTERVAL)
+	defer keepalive.Stop()
+	for {
+		select {
+		case data := <-session.outgoingIfRoom():
+			if !writeEvent(session.keep(data), data) {
+				return
+			}
+			flusher.Flush()
+			session.touch()
+		case <-session.acks:
+		case <-keepalive.C:
+			if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+			session.touch()
+		case <-superseded:
+			return
+		case <-session.closed:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (t *HTTPTransport) handlePoll(w http.ResponseWriter, r *http.Request) {
+	session := t.session(w, r)
+	if session == nil || !acknowledgeCursor(w, r, session) {
+		return
+	}
+	release, superseded := session.takeOver()
+	defer release()
+	// unacknowledged messages are answered at once, otherwise the request
+	// waits for one
+	if _, pending := session.pending(); len(pending) == 0 {
+		select {
+		case data := <-session.outgoingIfRoom():
+			session.keep(data)
+		case <-time.After(HTTP_POLL_TIMEOUT):
+		case <-superseded:
+		case <-session.closed:
+			http.Error(w, "session closed", http.StatusGone)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+	for draining := true; draining; {
+		select {
+		case data := <-session.outgoingIfRoom():
+			session.keep(data)
+		default:
+			draining = false
+		}
+	}
+	start, pending := session.pending()
+	response := protocol.HTTPPollResponse{
+		Cursor:   start + uint64(len(pending)),
+		Messages: []json.RawMessage{},
+	}
+	for _, data := range pending {
+		response.Messages = append(response.Messages, data)
+	}
+	session.touch()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&response)
+}
+
+// handleAck acknowledges what a client received over events.
+func (t *HTTPTransport) handleAck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	session := t.session(w, r)
+	if session == nil || !acknowledgeCursor(w, r, session) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (t *HTTPTransport) handleClose(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	session := t.session(w, r)
+	if session == nil {
+		return
+	}
+	session.Close()
+	t.mu.Lock()
+	delete(t.sessions, session.token)
+	t.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
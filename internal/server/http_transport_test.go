@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
+)
+
+type httpTestClient struct {
+	t     *testing.T
+	url   string
+	token string
+}
+
+func startHTTPTransport(t *testing.T) *httpTestClient {
+	b := startBroker(t, 2)
+	mux := http.NewServeMux()
+	NewHTTPTransport(b).Register(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	resp, err := http.Post(srv.URL+"/http/session", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var session protocol.HTTPSessionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		t.Fatal(err)
+	}
+	return &httpTestClient{t: t, url: srv.URL, token: session.Token}
+}
+
+func (c *httpTestClient) post(name string, body []byte) int {
+	c.t.Helper()
+	resp, err := http.Post(c.url+"/http/"+name+"?token="+c.token, "application/json", bytes.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func (c *httpTestClient) send(payload protocol.Payload) {
+	c.t.Helper()
+	data, err := protocol.Encode(protocol.NewFrame(payload))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if status := c.post("send", data); status != http.StatusNoContent {
+		c.t.Fatalf("send: %d", status)
+	}
+}
+
+func (c *httpTestClient) poll(cursor uint64) protocol.HTTPPollResponse {
+	c.t.Helper()
+	resp, err := http.Get(c.url + "/http/poll?token=" + c.token + "&cursor=" + strconv.FormatUint(cursor, 10))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.t.Fatalf("poll: %s", resp.Status)
+	}
+	var response protocol.HTTPPollResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		c.t.Fatal(err)
+	}
+	return response
+}
+
+func messageTypes(messages []json.RawMessage) []string {
+	types := []string{}
+	for _, message := range messages {
+		frame, _ := protocol.Decode(message)
+		types = append(types, frame.Type())
+	}
+	return types
+}
+
+func TestHTTPPollKeepsUntilAcknowledged(t *testing.T) {
+	alice := startHTTPTransport(t)
+	alice.send(&protocol.Hello{ProtocolVersion: protocol.PROTOCOL_VERSION, ClientName: "test"})
+	first := alice.poll(0)
+	if len(first.Messages) == 0 || messageTypes(first.Messages)[0] != protocol.MESSAGE_TYPE_WELCOME {
+		t.Fatalf("first poll %v", messageTypes(first.Messages))
+	}
+
+	// the response was lost, polling with the same cursor gets it again
+	again := alice.poll(0)
+	if again.Cursor != first.Cursor || !slices.Equal(messageTypes(again.Messages), messageTypes(first.Messages)) {
+		t.Fatalf("second poll %d %v, first %d %v", again.Cursor, messageTypes(again.Messages), first.Cursor, messageTypes(first.Messages))
+	}
+
+	// acknowledged messages are not sent again
+	alice.send(&protocol.ClaimUsername{Username: "alice"})
+	alice.send(&protocol.ClaimUsername{Username: "again"})
+	for cursor := first.Cursor; ; {
+		response := alice.poll(cursor)
+		if response.Cursor != cursor+uint64(len(response.Messages)) {
+			t.Fatalf("cursor %d after %d messages from %d", response.Cursor, len(response.Messages), cursor)
+		}
+		if slices.Contains(messageTypes(response.Messages), protocol.MESSAGE_TYPE_WELCOME) {
+			t.Fatal("acknowledged WELCOME sent again")
+		}
+		if slices.Contains(messageTypes(response.Messages), protocol.MESSAGE_TYPE_ERROR) {
+			break
+		}
+		cursor = response.Cursor
+	}
+}
+
+func TestHTTPCursorOutOfRange(t *testing.T) {
+	alice := startHTTPTransport(t)
+	resp, err := http.Get(alice.url + "/http/poll?token=" + alice.token + "&cursor=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("poll past the messages sent: %s", resp.Status)
+	}
+}
+
+func TestHTTPSendTooLarge(t *testing.T) {
+	alice := startHTTPTransport(t)
+	if status := alice.post("send", []byte(strings.Repeat("a", MAX_LINE_SIZE+1))); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized send: %d", status)
+	}
+}
+
+func TestHTTPCloseOnlyByPost(t *testing.T) {
+	alice := startHTTPTransport(t)
+	// a link or prefetch must not end the session
+	resp, err := http.Get(alice.url + "/http/close?token=" + alice.token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("close by GET: %s", resp.Status)
+	}
+	alice.send(&protocol.Hello{ProtocolVersion: protocol.PROTOCOL_VERSION, ClientName: "test"})
+
+	if status := alice.post("close", nil); status != http.StatusNoContent {
+		t.Fatalf("close: %d", status)
+	}
+	if status := alice.post("send", []byte("{}")); status == http.StatusNoContent {
+		t.Fatal("send after close accepted")
+	}
+}
+
+// firstEvent reads the first event of a new stream, its id and data.
+func (c *httpTestClient) firstEvent(cursor uint64) (string, string) {
+	c.t.Helper()
+	resp, err := http.Get(c.url + "/http/events?token=" + c.token + "&cursor=" + strconv.FormatUint(cursor, 10))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	id := ""
+	for scanner.Scan() {
+		if value, has := strings.CutPrefix(scanner.Text(), "id: "); has {
+			id = value
+		}
+		if data, has := strings.CutPrefix(scanner.Text(), "data: "); has {
+			return id, data
+		}
+	}
+	c.t.Fatal("stream ended: ", scanner.Err())
+	return "", ""
+}
+
+func TestHTTPEventsResentAfterReconnect(t *testing.T) {
+	alice := startHTTPTransport(t)
+	alice.send(&protocol.Hello{ProtocolVersion: protocol.PROTOCOL_VERSION, ClientName: "test"})
+	id, welcome := alice.firstEvent(0)
+	if id != "1" || !strings.Contains(welcome, protocol.MESSAGE_TYPE_WELCOME) {
+		t.Fatalf("event %s: %s", id, welcome)
+	}
+	// the stream broke before the event was acknowledged
+	if again, data := alice.firstEvent(0); again != id || data != welcome {
+		t.Fatalf("event %s: %s sent again as %s: %s", id, welcome, again, data)
+	}
+	// a second claim is answered with an error
+	alice.send(&protocol.ClaimUsername{Username: "alice"})
+	alice.send(&protocol.ClaimUsername{Username: "again"})
+	if next, data := alice.firstEvent(1); next != "2" || data == welcome {
+		t.Fatalf("after the cursor got event %s: %s", next, data)
+	}
+}
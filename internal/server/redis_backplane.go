@@ -0,0 +1,304 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	REDIS_PRESENCE_PREFIX     = "gochat:presence:"
+	REDIS_KEYS_KEY            = "gochat:keys"
+	REDIS_BROADCAST_CHANNEL   = "gochat:broadcast"
+	REDIS_NODE_CHANNEL_PREFIX = "gochat:node:"
+)
+
+// A presence key expires REDIS_PRESENCE_TTL after the last heartbeat of its
+// node, so the usernames of a node that died are free again.
+const (
+	REDIS_PRESENCE_TTL = 30 * time.Second
+	REDIS_HEARTBEAT    = REDIS_PRESENCE_TTL / 3
+)
+
+// leaveScript only removes the presence key if this node still owns it.
+var leaveScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// refreshScript extends the presence key if this node still owns it.
+var refreshScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// redisDelivery is a Delivery as published on redis, the frame keeps its
+// wire encoding.
+type redisDelivery struct {
+	To    string          `json:"to"`
+	Frame json.RawMessage `json:"frame"`
+}
+
+// RedisBackplane keeps presence in a key per username holding the node id,
+// refreshed by a heartbeat, and routes messages over redis pub/sub, one
+// channel per node.
+type RedisBackplane struct {
+	client   *redis.Client
+	pubsub   *redis.PubSub
+	nodeID   string
+	messages chan Delivery
+	// local are the usernames this node holds
+	mu    sync.Mutex
+	local map[string]bool
+	// swept are the usernames seen by the last sweep
+	swept []string
+	stop  chan struct{}
+}
+
+func NewRedisBackplane(addr string) (*RedisBackplane, error) {
+	ctx := context.Background()
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	nodeID := newNodeID()
+	pubsub := client.Subscribe(ctx, REDIS_BROADCAST_CHANNEL, REDIS_NODE_CHANNEL_PREFIX+nodeID)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		client.Close()
+		return nil, err
+	}
+	b := &RedisBackplane{
+		client:   client,
+		pubsub:   pubsub,
+		nodeID:   nodeID,
+		messages: make(chan Delivery, 1024),
+		local:    make(map[string]bool),
+		stop:     make(chan struct{}),
+	}
+	go b.receive()
+	go b.heartbeat()
+	log.Print("redis backplane node: ", nodeID)
+	return b, nil
+}
+
+func newNodeID() string {
+	bytes := make([]byte, 8)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+// receive hands published deliveries to the broker until the backplane is
+// closed. Every REDIS_HEARTBEAT it also sweeps the presence keys, so users of
+// a node that died are reported gone once their keys expire.
+func (b *RedisBackplane) receive() {
+	defer close(b.messages)
+	sweep := time.NewTicker(REDIS_HEARTBEAT)
+	defer sweep.Stop()
+	published := b.pubsub.Channel()
+	for {
+		var delivery Delivery
+		select {
+		case payload, ok := <-published:
+			if !ok {
+				return
+			}
+			var err error
+			if delivery, err = decodeDelivery(payload.Payload); err != nil {
+				log.Print("err backplane decode:", err)
+				continue
+			}
+		case <-sweep.C:
+			var changed bool
+			if delivery, changed = b.sweep(); !changed {
+				continue
+			}
+		case <-b.stop:
+			return
+		}
+		select {
+		case b.messages <- delivery:
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+func decodeDelivery(payload string) (Delivery, error) {
+	var published redisDelivery
+	if err := json.Unmarshal([]byte(payload), &published); err != nil {
+		return Delivery{}, err
+	}
+	frame, err := protocol.Decode(published.Frame)
+	if err != nil {
+		return Delivery{}, err
+	}
+	return Delivery{To: published.To, Frame: frame}, nil
+}
+
+// sweep returns a presence list for the local users when a username is gone
+// since the last sweep. Leaves are broadcast by their node, expired keys are
+// only noticed here. Every node sweeps for itself, so nothing is published.
+func (b *RedisBackplane) sweep() (Delivery, bool) {
+	users, err := b.Users()
+	if err != nil {
+		log.Print("err presence sweep:", err)
+		return Delivery{}, false
+	}
+	b.mu.Lock()
+	gone := slices.ContainsFunc(b.swept, func(username string) bool {
+		return !slices.Contains(users, username)
+	})
+	b.swept = users
+	b.mu.Unlock()
+	if !gone {
+		return Delivery{}, false
+	}
+	return Delivery{Frame: protocol.NewFrame(&protocol.Presence{Users: users})}, true
+}
+
+// heartbeat keeps the presence keys of local users from expiring.
+func (b *RedisBackplane) heartbeat() {
+	ticker := time.NewTicker(REDIS_HEARTBEAT)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			b.refresh()
+		}
+	}
+}
+
+func (b *RedisBackplane) refresh() {
+	ctx := context.Background()
+	for _, username := range b.localUsers() {
+		owned, err := refreshScript.Run(ctx, b.client, []string{REDIS_PRESENCE_PREFIX + username}, b.nodeID, REDIS_PRESENCE_TTL.Milliseconds()).Int()
+		if err != nil {
+			log.Print("err presence heartbeat:", err)
+			continue
+		}
+		if owned == 0 {
+			log.Print("err presence heartbeat: lost ", username)
+		}
+	}
+}
+
+func (b *RedisBackplane) localUsers() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	users := make([]string, 0, len(b.local))
+	for username := range b.local {
+		users = append(users, username)
+	}
+	return users
+}
+
+func (b *RedisBackplane) Join(username string) (bool, error) {
+	joined, err := b.client.SetNX(context.Background(), REDIS_PRESENCE_PREFIX+username, b.nodeID, REDIS_PRESENCE_TTL).Result()
+	if err != nil || !joined {
+		return false, err
+	}
+	b.mu.Lock()
+	b.local[username] = true
+	b.mu.Unlock()
+	return true, nil
+}
+
+func (b *RedisBackplane) Leave(username string) error {
+	b.mu.Lock()
+	delete(b.local, username)
+	b.mu.Unlock()
+	return leaveScript.Run(context.Background(), b.client, []string{REDIS_PRESENCE_PREFIX + username}, b.nodeID).Err()
+}
+
+func (b *RedisBackplane) Users() ([]string, error) {
+	ctx := context.Background()
+	users := []string{}
+	iter := b.client.Scan(ctx, 0, REDIS_PRESENCE_PREFIX+"*", 256).Iterator()
+	for iter.Next(ctx) {
+		users = append(users, strings.TrimPrefix(iter.Val(), REDIS_PRESENCE_PREFIX))
+	}
+	// SCAN may return a key more than once
+	slices.Sort(users)
+	return slices.Compact(users), iter.Err()
+}
+
+func (b *RedisBackplane) Publish(delivery Delivery) error {
+	ctx := context.Background()
+	channel := REDIS_BROADCAST_CHANNEL
+	if delivery.To != "" {
+		nodeID, err := b.client.Get(ctx, REDIS_PRESENCE_PREFIX+delivery.To).Result()
+		if errors.Is(err, redis.Nil) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		channel = REDIS_NODE_CHANNEL_PREFIX + nodeID
+	}
+	frame, err := protocol.Encode(delivery.Frame)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(&redisDelivery{To: delivery.To, Frame: frame})
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(ctx, channel, payload).Err()
+}
+
+func (b *RedisBackplane) Messages() <-chan Delivery {
+	return b.messages
+}
+
+func (b *RedisBackplane) PutKeys(username string, bundle protocol.KeyBundle) error {
+	payload, err := json.Marshal(&bundle)
+	if err != nil {
+		return err
+	}
+	return b.client.HSet(context.Background(), REDIS_KEYS_KEY, username, payload).Err()
+}
+
+func (b *RedisBackplane) Keys(username string) (*protocol.KeyBundle, error) {
+	payload, err := b.client.HGet(context.Background(), REDIS_KEYS_KEY, username).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var bundle protocol.KeyBundle
+	if err := json.Unmarshal(payload, &bundle); err != nil {
+		return nil, err
+	}
+	return &bundle, nil
+}
+
+// Close releases every username still held by this node.
+func (b *RedisBackplane) Close() error {
+	close(b.stop)
+	for _, username := range b.localUsers() {
+		if err := b.Leave(username); err != nil {
+			log.Print("err presence leave:", err)
+		}
+	}
+	b.pubsub.Close()
+	return b.client.Close()
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
+	"github.com/alicebob/miniredis/v2"
+)
+
+func redisBackplane(t *testing.T, embedded *miniredis.Miniredis) *RedisBackplane {
+	t.Helper()
+	b, err := NewRedisBackplane(embedded.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestRedisPresence(t *testing.T) {
+	embedded := miniredis.RunT(t)
+	first := redisBackplane(t, embedded)
+	second := redisBackplane(t, embedded)
+	defer second.Close()
+
+	if joined, err := first.Join("alice"); err != nil || !joined {
+		t.Fatalf("join: %v %v", joined, err)
+	}
+	if joined, err := second.Join("alice"); err != nil || joined {
+		t.Fatalf("alice joined twice: %v %v", joined, err)
+	}
+	second.Join("bob")
+	if users, err := first.Users(); err != nil || !slices.Equal(users, []string{"alice", "bob"}) {
+		t.Fatalf("users %v %v", users, err)
+	}
+	// only the owner releases a username
+	second.Leave("alice")
+	if users, _ := first.Users(); !slices.Contains(users, "alice") {
+		t.Fatal("alice released by another node")
+	}
+	first.Close()
+	if users, _ := second.Users(); !slices.Equal(users, []string{"bob"}) {
+		t.Fatalf("users after close %v", users)
+	}
+}
+
+func TestRedisPresenceExpires(t *testing.T) {
+	embedded := miniredis.RunT(t)
+	crashed := redisBackplane(t, embedded)
+	other := redisBackplane(t, embedded)
+	defer other.Close()
+	crashed.Join("alice")
+
+	// heartbeats keep the username
+	for range 3 {
+		embedded.FastForward(REDIS_HEARTBEAT)
+		crashed.refresh()
+	}
+	if joined, _ := other.Join("alice"); joined {
+		t.Fatal("alice taken over while her node is alive")
+	}
+
+	// a node that stops sending heartbeats loses it
+	close(crashed.stop)
+	crashed.pubsub.Close()
+	crashed.client.Close()
+	embedded.FastForward(REDIS_PRESENCE_TTL + time.Second)
+	if users, _ := other.Users(); len(users) != 0 {
+		t.Fatalf("users %v", users)
+	}
+	if joined, err := other.Join("alice"); err != nil || !joined {
+		t.Fatalf("join after expiry: %v %v", joined, err)
+	}
+}
+
+func TestRedisExpiryReported(t *testing.T) {
+	embedded := miniredis.RunT(t)
+	crashed := redisBackplane(t, embedded)
+	other := redisBackplane(t, embedded)
+	defer other.Close()
+	crashed.Join("alice")
+	other.Join("bob")
+	if _, changed := other.sweep(); changed {
+		t.Fatal("presence reported on the first sweep")
+	}
+
+	close(crashed.stop)
+	crashed.pubsub.Close()
+	crashed.client.Close()
+	for range 4 {
+		embedded.FastForward(REDIS_HEARTBEAT)
+		other.refresh()
+	}
+	delivery, changed := other.sweep()
+	presence, ok := delivery.Frame.Payload.(*protocol.Presence)
+	if !changed || !ok || delivery.To != "" || !slices.Equal(presence.Users, []string{"bob"}) {
+		t.Fatalf("changed %v, delivery %#v", changed, delivery)
+	}
+	if _, changed := other.sweep(); changed {
+		t.Fatal("expiry reported twice")
+	}
+}
+
+func TestRedisCloseWithFullQueue(t *testing.T) {
+	embedded := miniredis.RunT(t)
+	stuck := redisBackplane(t, embedded)
+	publisher := redisBackplane(t, embedded)
+	defer publisher.Close()
+	// nobody reads the deliveries of stuck
+	for range cap(stuck.messages) + 16 {
+		publisher.Publish(Delivery{Frame: protocol.NewFrame(&protocol.Presence{Users: []string{}})})
+	}
+	for len(stuck.messages) < cap(stuck.messages) {
+		time.Sleep(time.Millisecond)
+	}
+	stuck.Close()
+	timeout := time.After(TEST_TIMEOUT)
+	for {
+		select {
+		case _, ok := <-stuck.messages:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("receive still blocked after Close")
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"time"
+)
+
+const MAX_LINE_SIZE = 1024 * 1024
+
+// streamConn speaks newline delimited JSON over a plain stream socket,
+// one message per line.
+type streamConn struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+}
+
+func NewStreamConn(conn net.Conn) Conn {
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), MAX_LINE_SIZE)
+	return &streamConn{conn: conn, scanner: scanner}
+}
+
+func (c *streamConn) ReadMessage() ([]byte, error) {
+	for c.scanner.Scan() {
+		line := c.scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		data := make([]byte, len(line))
+		copy(data, line)
+		return data, nil
+	}
+	if err := c.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrConnClosed
+}
+
+func (c *streamConn) WriteMessage(data []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+	line := make([]byte, 0, len(data)+1)
+	line = append(line, data...)
+	line = append(line, '\n')
+	_, err := c.conn.Write(line)
+	return err
+}
+
+func (c *streamConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// ServeListener accepts newline delimited JSON clients from a TCP or unix
+// socket listener until it fails.
+func (b *Broker) ServeListener(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		log.Print("stream client from ", listener.Addr().Network(), " ", conn.RemoteAddr())
+		b.HandleConn(NewStreamConn(conn))
+	}
+}
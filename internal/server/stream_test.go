@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/0ya-sh0/GoChatTUI/internal/protocol"
+)
+
+// lineClient speaks the newline delimited JSON of a stream socket by hand,
+// without the server side framing.
+type lineClient struct {
+	t     *testing.T
+	conn  net.Conn
+	lines *bufio.Scanner
+}
+
+func serveStream(t *testing.T, b *Broker, network, address string) net.Addr {
+	t.Helper()
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go b.ServeListener(listener)
+	return listener.Addr()
+}
+
+func dialLines(t *testing.T, addr net.Addr) *lineClient {
+	t.Helper()
+	conn, err := net.Dial(addr.Network(), addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	lines := bufio.NewScanner(conn)
+	lines.Buffer(nil, MAX_LINE_SIZE)
+	return &lineClient{t: t, conn: conn, lines: lines}
+}
+
+func (c *lineClient) write(line string) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(line)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *lineClient) send(payload protocol.Payload) {
+	c.t.Helper()
+	data, err := protocol.Encode(protocol.NewFrame(payload))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.write(string(data) + "\n")
+}
+
+// read is the next frame, ok is false once the server closed the
+// connection.
+func (c *lineClient) read() (protocol.Frame, bool) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(TEST_TIMEOUT))
+	if !c.lines.Scan() {
+		if err, ok := c.lines.Err().(net.Error); ok && err.Timeout() {
+			c.t.Fatal("no line in ", TEST_TIMEOUT)
+		}
+		return protocol.Frame{}, false
+	}
+	frame, err := protocol.Decode(c.lines.Bytes())
+	if err != nil {
+		c.t.Fatalf("line %q: %v", c.lines.Text(), err)
+	}
+	return frame, true
+}
+
+// next is the next frame that is not a presence list.
+func (c *lineClient) next() (protocol.Frame, bool) {
+	c.t.Helper()
+	for {
+		frame, ok := c.read()
+		if !ok || frame.Type() != protocol.MESSAGE_TYPE_PRESENCE {
+			return frame, ok
+		}
+	}
+}
+
+// join runs the handshake and waits until username is in the presence list.
+func (c *lineClient) join(username string) {
+	c.t.Helper()
+	c.send(&protocol.Hello{ProtocolVersion: protocol.PROTOCOL_VERSION, ClientName: "test", Capabilities: []string{protocol.CAPABILITY_PRESENCE}})
+	if frame, _ := c.next(); frame.Type() != protocol.MESSAGE_TYPE_WELCOME {
+		c.t.Fatalf("expected WELCOME, got %#v", frame.Payload)
+	}
+	c.send(&protocol.ClaimUsername{Username: username})
+	for {
+		frame, ok := c.read()
+		if !ok {
+			c.t.Fatalf("%s: connection closed", username)
+		}
+		if presence, ok := frame.Payload.(*protocol.Presence); ok && slices.Contains(presence.Users, username) {
+			return
+		}
+	}
+}
+
+func TestStreamListeners(t *testing.T) {
+	for _, network := range []string{"tcp", "unix"} {
+		t.Run(network, func(t *testing.T) {
+			address := "127.0.0.1:0"
+			if network == "unix" {
+				address = filepath.Join(t.TempDir(), "chat.sock")
+			}
+			addr := serveStream(t, startBroker(t, 2), network, address)
+			alice, bob := dialLines(t, addr), dialLines(t, addr)
+			alice.join("alice")
+			bob.join("bob")
+
+			// blank lines between frames are skipped, a frame may arrive
+			// in pieces
+			data, _ := protocol.Encode(protocol.NewFrame(&protocol.Send{ToUsername: "bob", Content: "over " + network}))
+			alice.write("\n\n" + string(data[:10]))
+			alice.write(string(data[10:]) + "\n")
+			frame, _ := bob.next()
+			if chat, ok := frame.Payload.(*protocol.Chat); !ok || chat.FromUsername != "alice" || chat.Content != "over "+network {
+				t.Fatalf("received %#v", frame.Payload)
+			}
+
+			bob.send(&protocol.Send{ToUsername: "alice", Content: "back"})
+			frame, _ = alice.next()
+			if chat, ok := frame.Payload.(*protocol.Chat); !ok || chat.Content != "back" {
+				t.Fatalf("received %#v", frame.Payload)
+			}
+		})
+	}
+}
+
+func TestStreamLineTooLong(t *testing.T) {
+	addr := serveStream(t, startBroker(t, 1), "tcp", "127.0.0.1:0")
+	alice := dialLines(t, addr)
+	alice.join("alice")
+	go alice.conn.Write([]byte(strings.Repeat("x", MAX_LINE_SIZE+1)))
+	for {
+		if _, ok := alice.next(); !ok {
+			return
+		}
+	}
+}
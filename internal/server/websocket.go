@@ -12,58 +12,52 @@ import (
 var wsUpgrader = websocket.Upgrader{}
 
 func (b *Broker) HandleWebsocketConnection(w http.ResponseWriter, r *http.Request) {
-	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	conn, err := wsUpgrader.Upgrade(countingResponseWriter{w}, r, nil)
 	if err != nil {
 		log.Print("err upgrade:", err)
 		return
 	}
-	go waitForUsernameClaim(conn, b.joinUserRequests)
+	if compression.Enabled {
+		conn.SetCompressionLevel(compression.Level)
+	}
+	b.HandleConn(NewWebsocketConn(conn, offersDeflate(r)))
 }
 
-func waitForUsernameClaim(conn *websocket.Conn, joinUserRequests chan<- JoinUserRequest) {
-	claimedUsername := make(chan *protocol.ClaimUsernameRequest)
-	defer close(claimedUsername)
+// HandleConn waits for the handshake on conn and joins the user.
+func (b *Broker) HandleConn(conn Conn) {
+	go waitForHandshake(conn, b.join)
+}
 
-	go func() {
-		var claimUsernameRequest protocol.ClaimUsernameRequest
-		err := conn.ReadJSON(&claimUsernameRequest)
-		if err == nil {
-			claimedUsername <- &claimUsernameRequest
-		} else {
-			log.Print("err username:", err)
-			claimedUsername <- nil
-		}
-	}()
+func readFrame(conn Conn, codec protocol.Codec) (protocol.Frame, error) {
+	data, err := conn.ReadMessage()
+	if err != nil {
+		return protocol.Frame{}, err
+	}
+	return codec.Decode(data)
+}
 
-	select {
-	case <-time.After(time.Second * 5):
-		conn.Close()
-		log.Print("closing client no username requested")
-		return
-	case username := <-claimedUsername:
-		if username == nil {
-			conn.Close()
-			return
-		}
-		joinUserRequests <- JoinUserRequest{
-			username: username.Username,
-			conn:     conn,
-		}
+func writeFrame(conn Conn, codec protocol.Codec, frame protocol.Frame) error {
+	data, err := codec.Encode(frame)
+	if err != nil {
+		return err
+	}
+	if binary, ok := conn.(binaryConn); ok && codec.Binary() {
+		return binary.WriteBinaryMessage(data)
 	}
+	return conn.WriteMessage(data)
 }
 
-func messageSender(conn *websocket.Conn, inbox <-chan interface{}) {
+func messageSender(conn Conn, codec protocol.Codec, inbox <-chan protocol.Frame) {
 	draining := false
 	for {
-		message, ok := <-inbox
+		frame, ok := <-inbox
 		if !ok {
 			return
 		}
 		if draining {
 			continue
 		}
-		conn.SetWriteDeadline(time.Now().Add(time.Second))
-		err := conn.WriteJSON(message)
+		err := writeFrame(conn, codec, frame)
 		if err != nil {
 			draining = true
 			conn.Close()
@@ -71,21 +65,123 @@ func messageSender(conn *websocket.Conn, inbox <-chan interface{}) {
 	}
 }
 
-func messageReciever(conn *websocket.Conn, outbox chan<- protocol.Message, username string, kickOutUser chan<- string) {
+// messageReciever reads frames from user until the connection fails.
+// Malformed or unexpected frames are answered with an ERROR frame, which is
+// routed back through the broker so that messageSender stays the only
+// writer.
+func messageReciever(b *Broker, user User) {
 	for {
-		var message protocol.ForwardMessageRequest
-		err := conn.ReadJSON(&message)
+		data, err := user.conn.ReadMessage()
 		if err != nil {
-			conn.Close()
-			kickOutUser <- username
+			user.conn.Close()
+			b.kickOut(user.username)
 			break
 		}
-		outbox <- protocol.Message{
-			Type:         protocol.MESSAGE_TYPE_CHAT,
-			FromUsername: username,
-			ToUsername:   message.ToUsername,
-			Content:      message.Content,
-			Timestamp:    time.Now(),
+		frame, err := user.codec.Decode(data)
+		if err != nil {
+			replyError(b, user.username, frame.ID, err.Error())
+			continue
+		}
+		switch payload := frame.Payload.(type) {
+		case *protocol.Send:
+			handleSend(b, user, frame.ID, payload)
+		case *protocol.PublishKeys:
+			handlePublishKeys(b, user, frame.ID, payload)
+		case *protocol.RequestKeys:
+			handleRequestKeys(b, user, frame.ID, payload)
+		case protocol.Relayed:
+			handleRelayed(b, user, frame.ID, payload)
+		default:
+			replyError(b, user.username, frame.ID, "unexpected frame: "+frame.Type())
 		}
 	}
 }
+
+func handleSend(b *Broker, user User, id string, send *protocol.Send) {
+	if send.Sealed != nil && !protocol.HasCapability(user.capabilities, protocol.CAPABILITY_E2E) {
+		replyError(b, user.username, id, "sealed messages need the e2e capability")
+		return
+	}
+	if send.ReplyToFrom != "" && send.ReplyToFrom != user.username && send.ReplyToFrom != send.ToUsername {
+		replyError(b, user.username, id, "reply to a message from outside the conversation")
+		return
+	}
+	if id == "" {
+		id = protocol.NewID()
+	}
+	b.forward(Delivery{
+		To: send.ToUsername,
+		Frame: protocol.Frame{
+			ID: id,
+			Payload: &protocol.Chat{
+				FromUsername: user.username,
+				ToUsername:   send.ToUsername,
+				Content:      send.Content,
+				Sealed:       send.Sealed,
+				ReplyTo:      send.ReplyTo,
+				ReplyToFrom:  send.ReplyToFrom,
+				Timestamp:    time.Now(),
+			},
+		},
+	})
+}
+
+func handlePublishKeys(b *Broker, user User, id string, publish *protocol.PublishKeys) {
+	if !protocol.HasCapability(user.capabilities, protocol.CAPABILITY_E2E) {
+		replyError(b, user.username, id, "key directory needs the e2e capability")
+		return
+	}
+	if err := b.backplane.PutKeys(user.username, publish.Bundle); err != nil {
+		log.Print("err put keys:", err)
+		replyError(b, user.username, id, "could not store keys")
+	}
+}
+
+func handleRequestKeys(b *Broker, user User, id string, request *protocol.RequestKeys) {
+	if !protocol.HasCapability(user.capabilities, protocol.CAPABILITY_E2E) {
+		replyError(b, user.username, id, "key directory needs the e2e capability")
+		return
+	}
+	bundle, err := b.backplane.Keys(request.Username)
+	if err != nil {
+		log.Print("err keys:", err)
+		replyError(b, user.username, id, "could not load keys")
+		return
+	}
+	b.forward(Delivery{
+		To: user.username,
+		Frame: protocol.Frame{
+			ID:      id,
+			Payload: &protocol.Keys{Username: request.Username, Bundle: bundle},
+		},
+	})
+}
+
+// handleRelayed forwards frames between users, like file transfers and
+// edits, without looking at their content.
+func handleRelayed(b *Broker, user User, id string, payload protocol.Relayed) {
+	if !protocol.HasCapability(user.capabilities, payload.Capability()) {
+		replyError(b, user.username, id, payload.MessageType()+" needs the "+payload.Capability()+" capability")
+		return
+	}
+	payload.SetSender(user.username)
+	// checks that depend on the sender, like the author of a reaction target
+	if err := payload.Validate(); err != nil {
+		replyError(b, user.username, id, err.Error())
+		return
+	}
+	b.forward(Delivery{
+		To:    payload.Recipient(),
+		Frame: protocol.Frame{ID: id, Payload: payload},
+	})
+}
+
+func replyError(b *Broker, username, id, message string) {
+	b.forward(Delivery{
+		To: username,
+		Frame: protocol.Frame{
+			ID:      id,
+			Payload: &protocol.Error{Message: message},
+		},
+	})
+}
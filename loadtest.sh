@@ -7,6 +7,7 @@ DURATION=${2:-60}        # seconds each client runs
 INTERVAL_MS=${3:-200}    # send interval in ms
 RAMP_MS=${4:-20}         # ramp-up delay between clients
 LOG_DIR=${5:-logs}
+CODEC=${6:-json}         # wire codec: json or msgpack
 
 mkdir -p "$LOG_DIR"
 
@@ -15,6 +16,7 @@ echo "  users      = $USERS"
 echo "  duration   = ${DURATION}s"
 echo "  interval   = ${INTERVAL_MS}ms"
 echo "  ramp-up    = ${RAMP_MS}ms"
+echo "  codec      = $CODEC"
 echo
 
 for i in $(seq 1 "$USERS"); do
@@ -27,6 +29,7 @@ for i in $(seq 1 "$USERS"); do
         -to "$to" \
         -duration "${DURATION}s" \
         -interval "${INTERVAL_MS}ms" \
+        -codec "$CODEC" \
         > "$LOG_DIR/$from.log" 2>&1 &
 
     sleep "$(awk "BEGIN {print $RAMP_MS/1000}")"